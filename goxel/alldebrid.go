@@ -1,11 +1,21 @@
 package goxel
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 var aderrors = map[int]string{
@@ -56,35 +66,410 @@ type LinkResponse struct {
 }
 
 // LinkInfos contains link related information as sent by Alldebrid
+// Delayed is set instead of the link when the link is being generated
 type LinkInfos struct {
 	Link     string `json:"link"`
 	Filename string `json:"filename"`
+	Delayed  int64  `json:"delayed"`
 }
 
-// AllDebridURLPreprocessor implements the UrlPreprocessor interface.
+// DelayedResponse is the status of a link being generated by AllDebrid
+type DelayedResponse struct {
+	Status   int    `json:"status"`
+	TimeLeft int    `json:"time_left"`
+	Link     string `json:"link"`
+}
+
+// APIResponse is the envelope of the AllDebrid v4 API responses, Data is only set on success
+type APIResponse struct {
+	Status string          `json:"status"`
+	Data   json.RawMessage `json:"data"`
+	Error  *APIError       `json:"error"`
+}
+
+// APIError is an error returned by the AllDebrid v4 API
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// PINResponse contains the PIN the user enters on AllDebrid to authorize GoXel
+type PINResponse struct {
+	PIN       string `json:"pin"`
+	Check     string `json:"check"`
+	UserURL   string `json:"user_url"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// PINCheckResponse contains the API key once the PIN is activated
+type PINCheckResponse struct {
+	Activated bool   `json:"activated"`
+	APIKey    string `json:"apikey"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// UserResponse contains the user owning the API key
+type UserResponse struct {
+	User AllDebridUser `json:"user"`
+}
+
+// HostsResponse contains the hosts and the redirectors supported by AllDebrid
+type HostsResponse struct {
+	Hosts       map[string]HostInfos `json:"hosts"`
+	Redirectors map[string]HostInfos `json:"redirectors"`
+}
+
+// HostInfos contains the regexps of the links supported for a host, either one or several regexps
+type HostInfos struct {
+	Regexp json.RawMessage `json:"regexp"`
+}
+
+// RedirectorResponse contains the links of a folder or behind a redirector
+type RedirectorResponse struct {
+	Links []string `json:"links"`
+}
+
+// AllDebridProvider is the AllDebrid provider of the DebridURLPreprocessor, it is not a URLPreprocessor
+// and is only used through the DebridURLPreprocessor.
 // It handles the conversion of links after the debriding
-type AllDebridURLPreprocessor struct {
+// The v4 API is used with the API key, the API key is requested with a PIN when PIN is set and
+// then cached in KeyFile. The legacy login is only used when no API key is available.
+// At most Concurrency links are unlocked at the same time. Magnets and torrent files are expanded
+// into the links of their files, the path of a file in the torrent is kept, AllDebrid is given
+// MagnetTimeout to download them. The folders and the
+// links behind a redirector are expanded into their links, Passwords holds the passwords of the
+// protected links.
+type AllDebridProvider struct {
 	Client                 *http.Client
 	Login, Password, Token string
+	APIKey, KeyFile        string
+	PIN                    bool
+	Concurrency            int
+	MagnetTimeout          time.Duration
 	Initialized, UseMe     bool
-	Domains                map[string]*regexp.Regexp
+	Domains, Redirectors   map[string]*regexp.Regexp
+	Passwords              map[string]string
 	API                    string
+	slots                  chan struct{}
+	mux                    sync.Mutex
+	names                  map[string]string
+	pending                map[string]bool
 }
 
 const (
 	api   = "https://api.alldebrid.com"
 	agent = "goxel"
+
+	defaultUnlockConcurrency = 4
+	// delayedReady and delayedFailed are the status of the delayed links once generated
+	delayedReady  = 2
+	delayedFailed = 3
+	// maxDelayedInterval bounds the delay between two checks of a delayed link
+	maxDelayedInterval = time.Minute
+
+	// maxRedirects is the number of redirectors followed to reach the links of a folder
+	maxRedirects = 3
+	// maxUnlockRetries is the number of times a link refused because of a limit is unlocked again
+	maxUnlockRetries = 5
 )
 
-func (s *AllDebridURLPreprocessor) initialize(url string) {
-	if url != "" {
-		s.API = url
+var (
+	// pinInterval is the delay between two checks of the PIN activation
+	pinInterval = 5 * time.Second
+	// unlockBackoff is the delay before unlocking a link again, it doubles after each retry
+	unlockBackoff = 2 * time.Second
+	// delayedInterval is the delay before the first check of a delayed link, it doubles after each check
+	delayedInterval = 5 * time.Second
+	// delayedTimeout is the time given to AllDebrid to generate a delayed link
+	delayedTimeout = 10 * time.Minute
+)
+
+// transientErrors are the legacy errors fixed by unlocking the link later
+var transientErrors = map[int]bool{
+	34: true,
+	35: true,
+}
+
+// transientCodes are the v4 errors fixed by unlocking the link later
+var transientCodes = map[string]bool{
+	"LINK_TOO_MANY_DOWNLOADS": true,
+	"LINK_HOST_FULL":          true,
+}
+
+// alldebrid builds the AllDebrid preprocessor from the settings, nil when AllDebrid is not used
+// The API key is taken from the arguments, the environment, the configuration or the cache, in that order.
+func (g *GoXel) alldebrid(config debridConfig) *AllDebridProvider {
+	key := g.AlldebridAPIKey
+	if key == "" {
+		key = os.Getenv("GOXEL_ALLDEBRID_APIKEY")
+	}
+	if key == "" && !g.AlldebridPIN {
+		key = config.AllDebrid.APIKey
+	}
+
+	// A new key is requested with the PIN even when one is cached
+	if key == "" && !g.AlldebridPIN && g.AlldebridKeyFile != "" {
+		cached, err := readAPIKey(g.AlldebridKeyFile)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[WARNING] Ignoring the cached AllDebrid API key: %v\n", err.Error())
+		}
+		key = cached
+	}
+
+	if key != "" || g.AlldebridPIN {
+		return &AllDebridProvider{APIKey: key, PIN: key == "", KeyFile: g.AlldebridKeyFile, Concurrency: g.AlldebridConcurrency, MagnetTimeout: g.MagnetTimeout}
+	}
+
+	login, password := g.AlldebridLogin, g.AlldebridPassword
+	if login == "" || password == "" {
+		login, password = os.Getenv("GOXEL_ALLDEBRID_USERNAME"), os.Getenv("GOXEL_ALLDEBRID_PASSWD")
+	}
+	if login == "" || password == "" {
+		login, password = config.AllDebrid.Username, config.AllDebrid.Password
+	}
+	if login == "" || password == "" {
+		return nil
+	}
+	return &AllDebridProvider{Login: login, Password: password, Concurrency: g.AlldebridConcurrency, MagnetTimeout: g.MagnetTimeout}
+}
+
+// configDir returns the configuration directory of the user, $XDG_CONFIG_HOME or ~/.config
+// An empty string is returned when neither $XDG_CONFIG_HOME nor $HOME is set.
+func configDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		return dir
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".config")
+	}
+	return ""
+}
+
+// defaultKeyFile returns the file the AllDebrid API key is cached in, an empty string when there is no configuration directory
+func defaultKeyFile() string {
+	dir := configDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "goxel", "alldebrid.key")
+}
+
+// readAPIKey reads the cached API key, the file must only be accessible by its owner
+func readAPIKey(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%v is accessible by other users, its permissions must be 0600", file)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// writeAPIKey caches the API key, the file is replaced at once and only accessible by its owner
+func writeAPIKey(file, key string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".alldebrid.key")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// TempFile creates the file with the 0600 permissions
+	if _, err := tmp.WriteString(key + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// call sends a request to the v4 API and decodes its data, the agent is added to the parameters
+func (s *AllDebridProvider) call(path string, params url.Values, data interface{}) error {
+	return s.send("GET", path, params, nil, "", data)
+}
+
+// send sends a request with a body to the v4 API and decodes its data
+// The API key is sent in the Authorization header so it doesn't appear in the logs of the proxies.
+func (s *AllDebridProvider) send(method, path string, params url.Values, body io.Reader, contentType string, data interface{}) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("agent", agent)
+
+	r, err := http.NewRequest(method, s.API+"/v4"+path+"?"+params.Encode(), body)
+	if err != nil {
+		return err
+	}
+	if s.APIKey != "" {
+		r.Header.Set("Authorization", "Bearer "+s.APIKey)
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+
+	req, err := s.Client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer req.Body.Close()
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	var resp APIResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		if req.StatusCode >= 400 {
+			return statusError(req.StatusCode)
+		}
+		return err
+	}
+
+	if resp.Status != "success" {
+		if resp.Error != nil {
+			return resp.Error
+		}
+		return fmt.Errorf("unexpected status [%v]", resp.Status)
+	}
+	return json.Unmarshal(resp.Data, data)
+}
+
+// authorize requests an API key with a PIN the user enters on AllDebrid
+// The PIN is checked until it is activated or expired.
+func (s *AllDebridProvider) authorize() (string, error) {
+	var pin PINResponse
+	if err := s.call("/pin/get", nil, &pin); err != nil {
+		return "", err
+	}
+
+	// The monitoring isn't started yet, the PIN must be displayed right away
+	fmt.Printf("[ALLDEBRID] Open %v and enter the PIN %v to authorize GoXel\n", pin.UserURL, pin.PIN)
+
+	expiration := time.Now().Add(time.Duration(pin.ExpiresIn) * time.Second)
+	for time.Now().Before(expiration) {
+		var check PINCheckResponse
+		if err := s.call("/pin/check", url.Values{"check": {pin.Check}, "pin": {pin.PIN}}, &check); err != nil {
+			return "", err
+		}
+
+		if check.Activated && check.APIKey != "" {
+			return check.APIKey, nil
+		}
+		time.Sleep(pinInterval)
+	}
+	return "", errors.New("the PIN expired before being entered")
+}
+
+// initializeAPIKey checks the user owning the API key and retrieves the supported hosts
+func (s *AllDebridProvider) initializeAPIKey() {
+	if s.PIN {
+		key, err := s.authorize()
+		if err != nil {
+			cMessages <- NewErrorMessage("ALLDEBRID", fmt.Sprintf("Can't authorize GoXel: %v", err.Error()))
+			return
+		}
+		s.APIKey = key
+
+		if s.KeyFile != "" {
+			if err := writeAPIKey(s.KeyFile, key); err != nil {
+				cMessages <- NewWarningMessage("ALLDEBRID", fmt.Sprintf("Can't cache the API key: %v", err.Error()))
+			}
+		}
+	}
+
+	var user UserResponse
+	if err := s.call("/user", nil, &user); err != nil {
+		cMessages <- NewErrorMessage("ALLDEBRID", fmt.Sprintf("Following error occurred while connecting to AllDebrid service: %v", err.Error()))
+		return
+	}
+
+	if !user.User.Premium {
+		cMessages <- NewWarningMessage("ALLDEBRID", "Non premium user are not supported, bypassing.")
+		return
+	}
+
+	cMessages <- NewInfoMessage("ALLDEBRID", fmt.Sprintf("Successfully logged as [%v]", user.User.Username))
+	s.UseMe = true
+
+	var resp HostsResponse
+	if err := s.call("/hosts", nil, &resp); err != nil {
+		cMessages <- NewErrorMessage("ALLDEBRID", fmt.Sprintf("Can't retrieve hosts listing: %v", err.Error()))
+		return
+	}
+
+	s.Domains = compileHosts(resp.Hosts)
+	s.Redirectors = compileHosts(resp.Redirectors)
+	s.Initialized = true
+}
+
+// compileHosts compiles the regexps of the hosts, a host has either one or several regexps
+// The expressions unsupported by the regexp package are skipped.
+func compileHosts(hosts map[string]HostInfos) map[string]*regexp.Regexp {
+	compiled := make(map[string]*regexp.Regexp, len(hosts))
+	for k, v := range hosts {
+		var expressions []string
+		if err := json.Unmarshal(v.Regexp, &expressions); err != nil {
+			var expression string
+			json.Unmarshal(v.Regexp, &expression)
+			expressions = []string{expression}
+		}
+
+		var valid []string
+		for _, expression := range expressions {
+			if _, err := regexp.Compile(expression); expression != "" && err == nil {
+				valid = append(valid, "(?:"+expression+")")
+			}
+		}
+		if len(valid) > 0 {
+			compiled[k] = regexp.MustCompile(strings.Join(valid, "|"))
+		}
+	}
+	return compiled
+}
+
+func (s *AllDebridProvider) initialize(apiURL string) {
+	if apiURL != "" {
+		s.API = apiURL
 	} else {
 		s.API = api
 	}
 
+	concurrency := s.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultUnlockConcurrency
+	}
+	s.slots = make(chan struct{}, concurrency)
+	s.names = make(map[string]string)
+	s.pending = make(map[string]bool)
+	if s.Passwords == nil {
+		s.Passwords = make(map[string]string)
+	}
+
 	s.Client, _ = NewClient()
-	req, err := s.Client.Get(s.API + "/user/login?agent=" + agent + "&username=" + s.Login + "&password=" + s.Password)
+	if s.APIKey != "" || s.PIN {
+		s.initializeAPIKey()
+		return
+	}
+
+	cMessages <- NewWarningMessage("ALLDEBRID", "The login with a username and a password is deprecated, use an API key instead")
+	login := url.Values{"agent": {agent}, "username": {s.Login}, "password": {s.Password}}
+	req, err := s.Client.Get(s.API + "/user/login?" + login.Encode())
 	if err != nil {
 		cMessages <- NewErrorMessage("ALLDEBRID", fmt.Sprintf("Following error occurred while connecting to AllDebrid service: %v", err.Error()))
 		return
@@ -139,51 +524,310 @@ func (s *AllDebridURLPreprocessor) initialize(url string) {
 	s.Initialized = true
 }
 
-func (s *AllDebridURLPreprocessor) process(urls []string) []string {
+// legacyError is an error code returned by the legacy API
+type legacyError int
+
+func (e legacyError) Error() string {
+	return aderrors[int(e)]
+}
+
+// statusError is an HTTP status returned by AllDebrid without any response
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("HTTP status %d", int(e))
+}
+
+// rejectedError is an error of AllDebrid which isn't reported with an error code
+type rejectedError string
+
+func (e rejectedError) Error() string {
+	return string(e)
+}
+
+// isTransient checks if the link was refused because of a limit, it is then unlocked again later
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case legacyError:
+		return transientErrors[int(e)]
+	case *APIError:
+		return transientCodes[e.Code]
+	case statusError:
+		return e == http.StatusTooManyRequests || e == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// isProtected checks if the link was refused because it is protected by a password
+func isProtected(err error) bool {
+	switch e := err.(type) {
+	case legacyError:
+		return e == 38
+	case *APIError:
+		return e.Code == "LINK_PASS_PROTECTED"
+	}
+	return false
+}
+
+// isRejected checks if AllDebrid refused to unlock the link, the other errors mean AllDebrid couldn't be reached
+func isRejected(err error) bool {
+	switch err.(type) {
+	case legacyError, *APIError, rejectedError:
+		return true
+	}
+	return false
+}
+
+// matches checks if the link is hosted on a domain supported by AllDebrid
+func (s *AllDebridProvider) matches(link string) bool {
+	for _, v := range s.Domains {
+		if v.MatchString(link) {
+			return true
+		}
+	}
+	return false
+}
+
+// unlockOnce sends a single unlocking request for the link
+func (s *AllDebridProvider) unlockOnce(link string) (LinkInfos, error) {
+	params := url.Values{"link": {link}}
+	if password := s.password(link); password != "" {
+		params.Set("password", password)
+	}
+
+	if s.APIKey != "" {
+		var infos LinkInfos
+		err := s.call("/link/unlock", params, &infos)
+		return infos, err
+	}
+
+	params.Set("agent", agent)
+	params.Set("token", s.Token)
+	req, err := s.Client.Get(s.API + "/link/unlock?" + params.Encode())
+	if err != nil {
+		return LinkInfos{}, err
+	}
+	defer req.Body.Close()
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return LinkInfos{}, err
+	}
+
+	var resp LinkResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		if req.StatusCode >= 400 {
+			return LinkInfos{}, statusError(req.StatusCode)
+		}
+		return LinkInfos{}, err
+	}
+
+	if !resp.Success {
+		return LinkInfos{}, legacyError(resp.Error)
+	}
+	return resp.Infos, nil
+}
+
+// unlock debrids the link, the links refused because of a limit are unlocked again after a backoff
+// At most Concurrency links are unlocked at the same time.
+func (s *AllDebridProvider) unlock(ctx context.Context, link string) (string, error) {
+	delay := unlockBackoff
+	for retry := 0; ; retry++ {
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		infos, err := s.unlockOnce(link)
+		<-s.slots
+
+		switch {
+		case err == nil && infos.Link != "":
+			return infos.Link, nil
+		case err == nil && infos.Delayed != 0:
+			return s.waitDelayed(ctx, link, infos.Delayed)
+		case err == nil:
+			return "", rejectedError("No link was generated")
+		case !isTransient(err) || retry == maxUnlockRetries:
+			return "", err
+		}
+
+		cMessages <- NewWarningMessage("ALLDEBRID", fmt.Sprintf("Unlocking [%v] again in %v: %v", link, delay, err.Error()))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// waitDelayed checks the link being generated until it is available
+// The delay between two checks doubles, the link is abandoned after delayedTimeout.
+func (s *AllDebridProvider) waitDelayed(ctx context.Context, link string, id int64) (string, error) {
+	timeout := time.NewTimer(delayedTimeout)
+	defer timeout.Stop()
+
+	delay := delayedInterval
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-timeout.C:
+			timer.Stop()
+			return "", rejectedError(fmt.Sprintf("The link wasn't generated after %v", delayedTimeout))
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		}
+
+		var resp DelayedResponse
+		if err := s.call("/link/delayed", url.Values{"id": {strconv.FormatInt(id, 10)}}, &resp); err != nil {
+			return "", err
+		}
+
+		switch {
+		case resp.Status == delayedReady && resp.Link != "":
+			return resp.Link, nil
+		case resp.Status == delayedReady || resp.Status == delayedFailed:
+			return "", rejectedError("The link couldn't be generated")
+		}
+
+		cMessages <- NewInfoMessage("ALLDEBRID", fmt.Sprintf("Waiting for the link of [%v] to be generated, %v left", link, time.Duration(resp.TimeLeft)*time.Second))
+		if delay *= 2; delay > maxDelayedInterval {
+			delay = maxDelayedInterval
+		}
+	}
+}
+
+// isRedirector checks if the link is a folder or a redirector whose links are extracted by AllDebrid
+func (s *AllDebridProvider) isRedirector(link string) bool {
+	for _, v := range s.Redirectors {
+		if v.MatchString(link) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectorLinks returns the links of the folder or behind the redirector, they inherit its password
+func (s *AllDebridProvider) redirectorLinks(link string) ([]string, error) {
+	params := url.Values{"link": {link}}
+	password := s.password(link)
+	if password != "" {
+		params.Set("password", password)
+	}
+
+	var resp RedirectorResponse
+	s.slots <- struct{}{}
+	err := s.call("/link/redirector", params, &resp)
+	<-s.slots
+
+	if err != nil {
+		if isProtected(err) && password == "" {
+			err = fmt.Errorf("%v Add its password after the URL: %v password=<password>", err.Error(), link)
+		}
+		return nil, err
+	}
+
+	if password != "" {
+		s.mux.Lock()
+		for _, child := range resp.Links {
+			s.Passwords[child] = password
+		}
+		s.mux.Unlock()
+	}
+	return resp.Links, nil
+}
+
+// password returns the password of the link, an empty string when it isn't protected
+func (s *AllDebridProvider) password(link string) string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.Passwords[link]
+}
+
+// providerName returns the name of AllDebrid in the messages
+func (s *AllDebridProvider) providerName() string {
+	return "AllDebrid"
+}
+
+// setup authenticates on AllDebrid, it is used if the user is premium
+func (s *AllDebridProvider) setup() bool {
 	if !s.Initialized {
-		s.initialize("")
-	}
-
-	if !s.UseMe {
-		return urls
-	}
-
-	output := make([]string, 0, len(urls))
-	for _, url := range urls {
-		var found bool
-		for _, v := range s.Domains {
-			if v.Match([]byte(url)) {
-				req, err := s.Client.Get(s.API + "/link/unlock?agent=" + agent + "&token=" + s.Token + "&link=" + url)
-				if err != nil {
-					cMessages <- NewErrorMessage("ALLDEBRID", fmt.Sprintf("An error occurred while debriding [%v]: %v", url, err.Error()))
-					continue
-				}
-				defer req.Body.Close()
-
-				b, _ := ioutil.ReadAll(req.Body)
-
-				var resp LinkResponse
-				err = json.Unmarshal(b, &resp)
-				if err != nil {
-					cMessages <- NewErrorMessage("ALLDEBRID", fmt.Sprintf("An error occurred while debriding [%v]: %v", url, err.Error()))
-					continue
-				}
-
-				if !resp.Success {
-					cMessages <- NewErrorMessage("ALLDEBRID", fmt.Sprintf("Ignoring [%v] due to an error: %v", url, aderrors[resp.Error]))
-				} else {
-					output = append(output, resp.Infos.Link)
-				}
-
-				found = true
-				break
-			}
+		s.initialize(s.API)
+	}
+	return s.Initialized && s.UseMe
+}
+
+// supports checks if AllDebrid unlocks the link, the links of the magnets are always unlocked
+func (s *AllDebridProvider) supports(link string) bool {
+	return s.matches(link) || s.isPending(link)
+}
+
+// debrid unlocks the link, the files of the magnets keep their path
+func (s *AllDebridProvider) debrid(ctx context.Context, link string) (debridLink, error) {
+	unlocked, err := s.unlock(ctx, link)
+	if err != nil {
+		kind := allDebridErrorKind(err)
+		if kind == debridProtected && s.password(link) == "" {
+			err = fmt.Errorf("%v Add its password after the URL: %v password=<password>", err.Error(), link)
 		}
+		return debridLink{}, &debridError{Kind: kind, Provider: s.providerName(), Err: err}
+	}
+	return debridLink{URL: unlocked, Name: s.name(link)}, nil
+}
+
+// expands checks if the link is a magnet, a torrent file, a folder or a redirector expanded by AllDebrid
+func (s *AllDebridProvider) expands(link string) bool {
+	return isTorrent(link) || s.isRedirector(link)
+}
+
+// expandLinks returns the links of the files of the magnet, the torrent file, the folder or behind the redirector
+func (s *AllDebridProvider) expandLinks(ctx context.Context, link string) ([]string, error) {
+	if !isTorrent(link) {
+		return s.redirectorLinks(link)
+	}
+
+	if s.APIKey == "" {
+		return nil, rejectedError("magnets and torrents require an API key")
+	}
+	return s.torrentLinks(ctx, link)
+}
 
-		if !found {
-			cMessages <- NewWarningMessage("ALLDEBRID", fmt.Sprintf("Ignore alldebrid for [%v] as no domain matches the URL", url))
-			output = append(output, url)
+// allDebridErrorKind classifies the errors of AllDebrid
+func allDebridErrorKind(err error) debridErrorKind {
+	switch {
+	case isTransient(err):
+		return debridLimited
+	case isProtected(err):
+		return debridProtected
+	case !isRejected(err):
+		return debridUnreachable
+	}
+
+	switch e := err.(type) {
+	case legacyError:
+		switch e {
+		case 33, 36:
+			return debridLimited
+		case 30, 32, 37:
+			return debridUnsupported
+		case 31:
+			return debridUnavailable
+		}
+	case *APIError:
+		switch e.Code {
+		case "LINK_HOST_LIMIT_REACHED", "FREE_TRIAL_LIMIT_REACHED":
+			return debridLimited
+		case "LINK_HOST_NOT_SUPPORTED", "LINK_HOST_UNAVAILABLE", "LINK_NOT_SUPPORTED", "MUST_BE_PREMIUM":
+			return debridUnsupported
+		case "LINK_DOWN":
+			return debridUnavailable
 		}
 	}
-	return output
+	return debridRefused
 }
@@ -1,11 +1,60 @@
 package goxel
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+var pinChecks int32
+
+// delayedLinks are the links generated later, the first one is ready on the second check
+// and the others respectively fail and are never generated
+var delayedLinks = map[string]string{
+	"http://upload.com/test/delayed.mp4":        "42",
+	"http://upload.com/test/delayed-failed.mp4": "43",
+	"http://upload.com/test/delayed-slow.mp4":   "44",
+}
+
+var delayedChecks int32
+
+// unlocks counts the unlocking requests of each link, slow links record the highest number of simultaneous requests
+var unlocks = struct {
+	sync.Mutex
+	count            map[string]int
+	running, maxSlow int
+}{count: make(map[string]int)}
+
+// bearer returns the API key sent in the Authorization header, the key must not be sent in the URL
+func bearer(r *http.Request) string {
+	if r.URL.Query().Get("apikey") != "" {
+		return ""
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func resetUnlocks() {
+	unlocks.Lock()
+	defer unlocks.Unlock()
+
+	unlocks.count = make(map[string]int)
+	unlocks.maxSlow = 0
+}
+
+// debridWith returns the debrid registry of an initialized provider
+func debridWith(p debridProvider) *DebridURLPreprocessor {
+	return &DebridURLPreprocessor{Providers: []debridProvider{p}}
+}
+
 func SetupAlldebridTest() {
 	http.HandleFunc("/user/login", func(w http.ResponseWriter, r *http.Request) {
 		gets := r.URL.Query()["username"]
@@ -20,6 +69,12 @@ func SetupAlldebridTest() {
 			fmt.Fprintf(w, "{\"success\":true, \"token\": \"alldebridtoken\", \"user\": {\"isPremium\":false, \"username\": \"alldebrid\", \"email\": \"alldebrid@mail.com\"}}")
 		case "test4":
 			fmt.Fprintf(w, "{\"success\":true, \"token\": \"alldebridtoken\", \"user\": {\"isPremium\":true, \"username\": \"alldebrid\", \"email\": \"alldebrid@mail.com\"}}")
+		case "test&5":
+			if r.URL.Query().Get("password") != "p&ss#w+rd" {
+				fmt.Fprintf(w, "{\"success\":false, \"errorCode\": 2}")
+				return
+			}
+			fmt.Fprintf(w, "{\"success\":true, \"token\": \"alldebridtoken\", \"user\": {\"isPremium\":true, \"username\": \"alldebrid\", \"email\": \"alldebrid@mail.com\"}}")
 		}
 	})
 
@@ -45,10 +100,121 @@ func SetupAlldebridTest() {
 			fmt.Fprintf(w, "{\"success\":true, \"infos\": {\"link\": \"http://test.com/ok.mp4\", \"filename\": \"test\"}}")
 		}
 	})
+
+	http.HandleFunc("/v4/pin/get", func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&pinChecks, 0)
+		fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"pin\": \"ABCD\", \"check\": \"pincheck\", \"user_url\": \"http://127.0.0.1:8080/pin?pin=ABCD\", \"expires_in\": 5}}")
+	})
+
+	// The PIN is activated on the second check
+	http.HandleFunc("/v4/pin/check", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("check") != "pincheck" || r.URL.Query().Get("pin") != "ABCD" {
+			fmt.Fprintf(w, "{\"status\":\"error\", \"error\": {\"code\": \"PIN_INVALID\", \"message\": \"Invalid PIN\"}}")
+		} else if atomic.AddInt32(&pinChecks, 1) < 2 {
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"activated\": false, \"expires_in\": 4}}")
+		} else {
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"activated\": true, \"apikey\": \"premiumkey\", \"expires_in\": 4}}")
+		}
+	})
+
+	http.HandleFunc("/v4/user", func(w http.ResponseWriter, r *http.Request) {
+		switch bearer(r) {
+		case "premiumkey":
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"user\": {\"isPremium\":true, \"username\": \"alldebrid\"}}}")
+		case "freekey":
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"user\": {\"isPremium\":false, \"username\": \"alldebrid\"}}}")
+		default:
+			fmt.Fprintf(w, "{\"status\":\"error\", \"error\": {\"code\": \"AUTH_BAD_APIKEY\", \"message\": \"The auth apikey is invalid\"}}")
+		}
+	})
+
+	http.HandleFunc("/v4/hosts", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"hosts\": {\"test\": {\"regexp\": [\".*test.*\", \"(?!unsupported)\"]}, \"single\": {\"regexp\": \".*single.*\"}}, \"redirectors\": {\"protector\": {\"regexp\": \"^http://protect\\\\.com/\"}}}}")
+	})
+
+	// Redirectors are expanded into hoster links, the nested one leads to another redirector
+	http.HandleFunc("/v4/link/redirector", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("link") {
+		case "http://protect.com/folder":
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"links\": [\"http://upload.com/test/a.mp4\", \"http://upload.com/test/b.mp4\"]}}")
+		case "http://protect.com/nested":
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"links\": [\"http://protect.com/folder\"]}}")
+		case "http://protect.com/loop":
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"links\": [\"http://protect.com/loop\"]}}")
+		case "http://protect.com/locked":
+			if r.URL.Query().Get("password") != "secret" {
+				fmt.Fprintf(w, "{\"status\":\"error\", \"error\": {\"code\": \"LINK_PASS_PROTECTED\", \"message\": \"Link is password protected.\"}}")
+				return
+			}
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"links\": [\"http://upload.com/test/locked.mp4\"]}}")
+		default:
+			fmt.Fprintf(w, "{\"status\":\"error\", \"error\": {\"code\": \"REDIRECTOR_NOT_SUPPORTED\", \"message\": \"Redirector not supported.\"}}")
+		}
+	})
+
+	http.HandleFunc("/v4/link/delayed", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("id") {
+		case "42":
+			if atomic.AddInt32(&delayedChecks, 1) < 2 {
+				fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"status\": 1, \"time_left\": 5}}")
+				return
+			}
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"status\": 2, \"time_left\": 0, \"link\": \"http://test.com/delayed.mp4\"}}")
+		case "43":
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"status\": 3, \"time_left\": 0}}")
+		default:
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"status\": 1, \"time_left\": 60}}")
+		}
+	})
+
+	http.HandleFunc("/v4/link/unlock", func(w http.ResponseWriter, r *http.Request) {
+		link := r.URL.Query().Get("link")
+
+		unlocks.Lock()
+		unlocks.count[link]++
+		count := unlocks.count[link]
+		unlocks.Unlock()
+
+		if strings.Contains(link, "slow") {
+			unlocks.Lock()
+			if unlocks.running++; unlocks.running > unlocks.maxSlow {
+				unlocks.maxSlow = unlocks.running
+			}
+			unlocks.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			unlocks.Lock()
+			unlocks.running--
+			unlocks.Unlock()
+		}
+
+		if bearer(r) != "premiumkey" {
+			fmt.Fprintf(w, "{\"status\":\"error\", \"error\": {\"code\": \"AUTH_BAD_APIKEY\", \"message\": \"The auth apikey is invalid\"}}")
+		} else if link == "http://upload.com/test/busy.mp4" && count <= 2 {
+			fmt.Fprintf(w, "{\"status\":\"error\", \"error\": {\"code\": \"LINK_TOO_MANY_DOWNLOADS\", \"message\": \"Too many concurrent downloads\"}}")
+		} else if link == "http://upload.com/test/full.mp4" {
+			fmt.Fprintf(w, "{\"status\":\"error\", \"error\": {\"code\": \"LINK_HOST_FULL\", \"message\": \"All servers are full for this host\"}}")
+		} else if id, ok := delayedLinks[link]; ok {
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"link\": \"\", \"delayed\": %v}}", id)
+		} else if link == "http://upload.com/test/empty.mp4" {
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"link\": \"\"}}")
+		} else if link == "http://upload.com/test/locked.mp4" && r.URL.Query().Get("password") != "secret" {
+			fmt.Fprintf(w, "{\"status\":\"error\", \"error\": {\"code\": \"LINK_PASS_PROTECTED\", \"message\": \"Link is password protected.\"}}")
+		} else if strings.HasPrefix(link, "http://alldebrid.com/f/") {
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"link\": \"http://test.com/%v\"}}", path.Base(link))
+		} else if link == "http://hoster.com/test/fallback" {
+			fmt.Fprintf(w, "{\"status\":\"error\", \"error\": {\"code\": \"LINK_HOST_UNAVAILABLE\", \"message\": \"Host under maintenance or not available\"}}")
+		} else if link == "http://upload.com/test/down.mp4" {
+			fmt.Fprintf(w, "{\"status\":\"error\", \"error\": {\"code\": \"LINK_DOWN\", \"message\": \"This link is not available on the file hoster website\"}}")
+		} else {
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"link\": \"http://test.com/ok.mp4\", \"filename\": \"ok.mp4\"}}")
+		}
+	})
 }
 
 func TestServerError(t *testing.T) {
-	alldebrid := AllDebridURLPreprocessor{}
+	alldebrid := AllDebridProvider{}
 	alldebrid.initialize("http://127.0.0.1:8080")
 
 	if alldebrid.Initialized || alldebrid.UseMe {
@@ -57,7 +223,7 @@ func TestServerError(t *testing.T) {
 }
 
 func TestBadJsonResponse(t *testing.T) {
-	alldebrid := AllDebridURLPreprocessor{
+	alldebrid := AllDebridProvider{
 		Login: "test1",
 	}
 	alldebrid.initialize("http://127.0.0.1:8080")
@@ -68,7 +234,7 @@ func TestBadJsonResponse(t *testing.T) {
 }
 
 func TestErrorLogin(t *testing.T) {
-	alldebrid := AllDebridURLPreprocessor{
+	alldebrid := AllDebridProvider{
 		Login: "test2",
 	}
 	alldebrid.initialize("http://127.0.0.1:8080")
@@ -79,7 +245,7 @@ func TestErrorLogin(t *testing.T) {
 }
 
 func TestNotPremium(t *testing.T) {
-	alldebrid := AllDebridURLPreprocessor{
+	alldebrid := AllDebridProvider{
 		Login: "test3",
 	}
 	alldebrid.initialize("http://127.0.0.1:8080")
@@ -90,7 +256,7 @@ func TestNotPremium(t *testing.T) {
 }
 
 func TestLoginOkAndPremium(t *testing.T) {
-	alldebrid := AllDebridURLPreprocessor{
+	alldebrid := AllDebridProvider{
 		Login: "test4",
 	}
 	alldebrid.initialize("http://127.0.0.1:8080")
@@ -100,8 +266,20 @@ func TestLoginOkAndPremium(t *testing.T) {
 	}
 }
 
+func TestLoginEscaped(t *testing.T) {
+	alldebrid := AllDebridProvider{
+		Login:    "test&5",
+		Password: "p&ss#w+rd",
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+
+	if !alldebrid.UseMe || alldebrid.Token != "alldebridtoken" {
+		t.Error("Login and password should be escaped")
+	}
+}
+
 func TestHosts(t *testing.T) {
-	alldebrid := AllDebridURLPreprocessor{
+	alldebrid := AllDebridProvider{
 		Login: "test4",
 	}
 	alldebrid.initialize("http://127.0.0.1:8080")
@@ -112,7 +290,7 @@ func TestHosts(t *testing.T) {
 }
 
 func TestNoUrlMatching(t *testing.T) {
-	alldebrid := AllDebridURLPreprocessor{
+	alldebrid := AllDebridProvider{
 		Login: "test4",
 	}
 	alldebrid.initialize("http://127.0.0.1:8080")
@@ -121,14 +299,14 @@ func TestNoUrlMatching(t *testing.T) {
 		t.Error("Alldebrid should be usable and initialized")
 	}
 
-	urls := alldebrid.process([]string{"http://upload.com/video.mp4"})
+	urls := debridWith(&alldebrid).process([]string{"http://upload.com/video.mp4"})
 	if len(urls) != 1 || urls[0] != "http://upload.com/video.mp4" {
 		t.Error("Url should have stayed unchanged")
 	}
 }
 
 func TestUrlMatchingButInvalidJson(t *testing.T) {
-	alldebrid := AllDebridURLPreprocessor{
+	alldebrid := AllDebridProvider{
 		Login: "test4",
 	}
 	alldebrid.initialize("http://127.0.0.1:8080")
@@ -138,14 +316,14 @@ func TestUrlMatchingButInvalidJson(t *testing.T) {
 	}
 	alldebrid.Token = "badtoken"
 
-	urls := alldebrid.process([]string{"http://upload.com/test/video.mp4"})
+	urls := debridWith(&alldebrid).process([]string{"http://upload.com/test/video.mp4"})
 	if len(urls) != 1 || urls[0] != "http://upload.com/test/video.mp4" {
 		t.Error("Url should have stayed unchanged")
 	}
 }
 
 func TestUnlinkError(t *testing.T) {
-	alldebrid := AllDebridURLPreprocessor{
+	alldebrid := AllDebridProvider{
 		Login: "test4",
 	}
 	alldebrid.initialize("http://127.0.0.1:8080")
@@ -154,14 +332,14 @@ func TestUnlinkError(t *testing.T) {
 		t.Error("Alldebrid should be usable and initialized")
 	}
 
-	urls := alldebrid.process([]string{"http://upload.com/test/video.mp4"})
+	urls := debridWith(&alldebrid).process([]string{"http://upload.com/test/video.mp4"})
 	if len(urls) > 0 {
 		t.Error("Urls should be empty")
 	}
 }
 
 func TestUnlinkSuccess(t *testing.T) {
-	alldebrid := AllDebridURLPreprocessor{
+	alldebrid := AllDebridProvider{
 		Login: "test4",
 	}
 	alldebrid.initialize("http://127.0.0.1:8080")
@@ -170,8 +348,275 @@ func TestUnlinkSuccess(t *testing.T) {
 		t.Error("Alldebrid should be usable and initialized")
 	}
 
-	urls := alldebrid.process([]string{"http://upload.com/test/video-ok.mp4"})
+	urls := debridWith(&alldebrid).process([]string{"http://upload.com/test/video-ok.mp4"})
 	if len(urls) != 1 || urls[0] != "http://test.com/ok.mp4" {
 		t.Error("Url should be debrided")
 	}
 }
+
+func TestAPIKey(t *testing.T) {
+	alldebrid := AllDebridProvider{
+		APIKey: "premiumkey",
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+
+	if !alldebrid.UseMe || !alldebrid.Initialized || len(alldebrid.Domains) != 2 {
+		t.Error("Alldebrid should be usable and initialized", alldebrid.Domains)
+	}
+
+	urls := debridWith(&alldebrid).process([]string{"http://upload.com/test/video.mp4", "http://upload.com/test/down.mp4", "http://single.com/video.mp4", "http://upload.com/video.mp4"})
+	if len(urls) != 3 || urls[0] != "http://test.com/ok.mp4" || urls[1] != "http://test.com/ok.mp4" || urls[2] != "http://upload.com/video.mp4" {
+		t.Error("Urls should be debrided", urls)
+	}
+}
+
+func TestInvalidAPIKey(t *testing.T) {
+	for _, key := range []string{"badkey", "freekey"} {
+		alldebrid := AllDebridProvider{
+			APIKey: key,
+		}
+		alldebrid.initialize("http://127.0.0.1:8080")
+
+		if alldebrid.Initialized || alldebrid.UseMe {
+			t.Error("Alldebrid should not be usable", key)
+		}
+	}
+}
+
+func TestPIN(t *testing.T) {
+	defer func(interval time.Duration) { pinInterval = interval }(pinInterval)
+	pinInterval = 10 * time.Millisecond
+
+	dir, _ := ioutil.TempDir("", "goxel-alldebrid")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "goxel", "alldebrid.key")
+
+	alldebrid := AllDebridProvider{
+		PIN:     true,
+		KeyFile: file,
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+
+	if !alldebrid.UseMe || !alldebrid.Initialized || alldebrid.APIKey != "premiumkey" {
+		t.Error("Alldebrid should be authorized with the PIN")
+	}
+
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("API key should only be readable by its owner", err)
+	}
+	if info, err := os.Stat(filepath.Dir(file)); err != nil || info.Mode().Perm() != 0700 {
+		t.Error("API key directory should only be accessible by its owner", err)
+	}
+	if key, err := readAPIKey(file); err != nil || key != "premiumkey" {
+		t.Error("API key should be cached", key, err)
+	}
+}
+
+func TestAPIKeyCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "goxel-alldebrid")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "alldebrid.key")
+
+	g := &GoXel{AlldebridKeyFile: file}
+	if g.alldebrid(debridConfig{}) != nil {
+		t.Error("Alldebrid should not be used without credentials")
+	}
+
+	writeAPIKey(file, "cachedkey")
+	if ad := g.alldebrid(debridConfig{}); ad == nil || ad.APIKey != "cachedkey" || ad.PIN {
+		t.Error("Cached API key should be used")
+	}
+
+	os.Setenv("GOXEL_ALLDEBRID_APIKEY", "envkey")
+	if ad := g.alldebrid(debridConfig{}); ad == nil || ad.APIKey != "envkey" {
+		t.Error("Environment API key should be preferred to the cached one")
+	}
+
+	g.AlldebridAPIKey = "flagkey"
+	if ad := g.alldebrid(debridConfig{}); ad == nil || ad.APIKey != "flagkey" {
+		t.Error("Argument API key should be preferred to the environment")
+	}
+	os.Unsetenv("GOXEL_ALLDEBRID_APIKEY")
+
+	g = &GoXel{AlldebridKeyFile: file, AlldebridPIN: true}
+	if ad := g.alldebrid(debridConfig{}); ad == nil || ad.APIKey != "" || !ad.PIN || ad.KeyFile != file {
+		t.Error("PIN should request a new API key")
+	}
+
+	// Keys readable by other users are ignored
+	os.Chmod(file, 0644)
+	if _, err := readAPIKey(file); err == nil {
+		t.Error("API key accessible by other users should be refused")
+	}
+	if ad := (&GoXel{AlldebridKeyFile: file}).alldebrid(debridConfig{}); ad != nil {
+		t.Error("Alldebrid should not be used with an unsafe cached key")
+	}
+}
+
+func TestUnlockRetry(t *testing.T) {
+	resetUnlocks()
+
+	defer func(backoff time.Duration) { unlockBackoff = backoff }(unlockBackoff)
+	unlockBackoff = time.Millisecond
+
+	alldebrid := AllDebridProvider{
+		APIKey: "premiumkey",
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+
+	urls := debridWith(&alldebrid).process([]string{"http://upload.com/test/busy.mp4", "http://upload.com/test/full.mp4"})
+	if len(urls) != 1 || urls[0] != "http://test.com/ok.mp4" {
+		t.Error("Busy link should be unlocked once available", urls)
+	}
+
+	unlocks.Lock()
+	defer unlocks.Unlock()
+	if unlocks.count["http://upload.com/test/busy.mp4"] != 3 {
+		t.Error("Busy link should be unlocked again after each limit, got", unlocks.count["http://upload.com/test/busy.mp4"])
+	}
+	if unlocks.count["http://upload.com/test/full.mp4"] != maxUnlockRetries+1 {
+		t.Error("Full link should be abandoned after the retries, got", unlocks.count["http://upload.com/test/full.mp4"])
+	}
+}
+
+func TestUnlockConcurrency(t *testing.T) {
+	resetUnlocks()
+	alldebrid := AllDebridProvider{
+		APIKey:      "premiumkey",
+		Concurrency: 2,
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+
+	var links []string
+	for i := 0; i < 8; i++ {
+		links = append(links, fmt.Sprintf("http://upload.com/test/slow%d.mp4", i))
+	}
+
+	urls := debridWith(&alldebrid).process(links)
+	if len(urls) != 8 {
+		t.Error("All the links should be unlocked", urls)
+	}
+
+	unlocks.Lock()
+	defer unlocks.Unlock()
+	if unlocks.maxSlow != 2 {
+		t.Error("Links should be unlocked concurrently within the limit, got", unlocks.maxSlow)
+	}
+}
+
+func TestLazyUnlock(t *testing.T) {
+	resetUnlocks()
+	alldebrid := AllDebridProvider{
+		APIKey: "premiumkey",
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+	d := debridWith(&alldebrid)
+	d.Lazy = true
+
+	links := []string{"http://upload.com/test/lazy.mp4", "http://upload.com/test/down.mp4", "http://upload.com/video.mp4"}
+	urls := d.process(links)
+	if strings.Join(urls, " ") != strings.Join(links, " ") {
+		t.Error("Lazy links should not be unlocked yet", urls)
+	}
+
+	unlocks.Lock()
+	count := unlocks.count["http://upload.com/test/lazy.mp4"]
+	unlocks.Unlock()
+	if count != 0 {
+		t.Error("Lazy link should not be unlocked by the preprocessing")
+	}
+
+	if d.resolver(links[2]) != nil {
+		t.Error("Unsupported link should not be resolved")
+	}
+
+	file := newFile(0, newDownload([]URLPreprocessor{d}, links[0]), output, false)
+	file.unlock(context.Background(), output, false)
+	if file.URL != "http://test.com/ok.mp4" || file.Output != filepath.Join(output, "ok.mp4") || file.failure() != "" {
+		t.Error("Lazy link should be unlocked when its file starts", file.URL, file.Output)
+	}
+
+	file = newFile(1, newDownload([]URLPreprocessor{d}, links[1]), output, false)
+	file.unlock(context.Background(), output, false)
+	if file.URL != links[1] || file.failure() == "" {
+		t.Error("Refused link should stop its file")
+	}
+}
+
+func TestRedirector(t *testing.T) {
+	alldebrid := AllDebridProvider{
+		APIKey: "premiumkey",
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+
+	urls := debridWith(&alldebrid).process([]string{"http://protect.com/folder", "http://protect.com/nested", "http://protect.com/loop", "http://protect.com/unknown"})
+	if len(urls) != 4 {
+		t.Error("Folders should be expanded into their unlocked links", urls)
+	}
+
+	d := debridWith(&alldebrid)
+	d.Lazy = true
+	urls = d.process([]string{"http://protect.com/folder"})
+	if strings.Join(urls, " ") != "http://upload.com/test/a.mp4 http://upload.com/test/b.mp4" || d.resolver(urls[0]) == nil {
+		t.Error("Lazy folder links should be unlocked when they start", urls)
+	}
+}
+
+func TestLinkPassword(t *testing.T) {
+	alldebrid := AllDebridProvider{
+		APIKey: "premiumkey",
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+
+	if urls := debridWith(&alldebrid).process([]string{"http://protect.com/locked", "http://upload.com/test/locked.mp4"}); len(urls) != 0 {
+		t.Error("Protected links should require a password", urls)
+	}
+
+	// The links of a protected folder inherit its password
+	alldebrid.Passwords["http://protect.com/locked"] = "secret"
+	if urls := debridWith(&alldebrid).process([]string{"http://protect.com/locked"}); len(urls) != 1 || urls[0] != "http://test.com/ok.mp4" {
+		t.Error("Protected folder should be unlocked with its password", urls)
+	}
+
+	alldebrid = AllDebridProvider{
+		APIKey:    "premiumkey",
+		Passwords: map[string]string{"http://upload.com/test/locked.mp4": "secret"},
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+	if urls := debridWith(&alldebrid).process([]string{"http://upload.com/test/locked.mp4"}); len(urls) != 1 || urls[0] != "http://test.com/ok.mp4" {
+		t.Error("Protected link should be unlocked with its password", urls)
+	}
+}
+
+func TestDelayedLink(t *testing.T) {
+	defer func(interval, timeout time.Duration) { delayedInterval, delayedTimeout = interval, timeout }(delayedInterval, delayedTimeout)
+	delayedInterval, delayedTimeout = time.Millisecond, 200*time.Millisecond
+	atomic.StoreInt32(&delayedChecks, 0)
+
+	defer func(messages chan Message) { cMessages = messages }(cMessages)
+	cMessages = make(chan Message, 100)
+
+	alldebrid := AllDebridProvider{
+		APIKey: "premiumkey",
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+
+	urls := debridWith(&alldebrid).process([]string{"http://upload.com/test/delayed.mp4", "http://upload.com/test/delayed-failed.mp4", "http://upload.com/test/delayed-slow.mp4", "http://upload.com/test/empty.mp4"})
+	if len(urls) != 1 || urls[0] != "http://test.com/delayed.mp4" {
+		t.Error("Delayed link should be unlocked once generated", urls)
+	}
+
+	if checks := atomic.LoadInt32(&delayedChecks); checks != 2 {
+		t.Error("Delayed link should be checked until generated, got", checks)
+	}
+
+	var waiting bool
+	for len(cMessages) > 0 {
+		if m := <-cMessages; strings.Contains(m.Content, "Waiting for the link of [http://upload.com/test/delayed.mp4]") {
+			waiting = true
+		}
+	}
+	if !waiting {
+		t.Error("Generation should be reported while waiting")
+	}
+}
@@ -0,0 +1,457 @@
+package goxel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const cancelledMessage = "Cancelled"
+
+// session holds the channels of a running download, it is used to control the files at runtime
+type session struct {
+	files    []*File
+	index    map[uint32]*File
+	headers  chan header
+	complete chan bool
+}
+
+// errNotRunning is returned by the controls when no download is running
+var errNotRunning = errors.New("No download is running")
+
+// PauseFile stops the connections of the file identified by id, they are freed for the other files
+// The progress is persisted so the file can be resumed later, even by another process.
+func (g *GoXel) PauseFile(id uint32) error {
+	f, err := g.file(id)
+	if err != nil {
+		return err
+	}
+
+	f.Pause()
+	return nil
+}
+
+// ResumeFile queues again the chunks of the paused file identified by id
+func (g *GoXel) ResumeFile(id uint32) error {
+	f, err := g.file(id)
+	if err != nil {
+		return err
+	}
+
+	g.resume(f)
+	return nil
+}
+
+// CancelFile stops the file identified by id, its progress is persisted so it can be resumed by another process
+func (g *GoXel) CancelFile(id uint32) error {
+	f, err := g.file(id)
+	if err != nil {
+		return err
+	}
+
+	f.Cancel()
+	return nil
+}
+
+// RetryFile queues again the chunks of the file identified by id once it has been stopped by an error
+// The failures of its chunks are reset, files cancelled by the user can be retried as well.
+func (g *GoXel) RetryFile(id uint32) error {
+	f, err := g.file(id)
+	if err != nil {
+		return err
+	}
+
+	s := g.current()
+	select {
+	case <-s.complete:
+		return errNotRunning
+	default:
+	}
+
+	if !f.Retry() {
+		return fmt.Errorf("File %v cannot be retried", id)
+	}
+
+	if err := f.open(); err != nil {
+		f.setError(err.Error())
+		return err
+	}
+
+	if !f.QueueChunks(s.headers, s.complete) {
+		return errNotRunning
+	}
+	return nil
+}
+
+// RemoveFile stops the file identified by id and hides it from the monitoring
+// Its progress is persisted like a cancelled file.
+func (g *GoXel) RemoveFile(id uint32) error {
+	f, err := g.file(id)
+	if err != nil {
+		return err
+	}
+
+	f.Remove()
+	return nil
+}
+
+// PauseAll pauses all the files of the running download
+func (g *GoXel) PauseAll() {
+	for _, f := range g.files() {
+		f.Pause()
+	}
+}
+
+// ResumeAll resumes all the paused files of the running download
+func (g *GoXel) ResumeAll() {
+	for _, f := range g.files() {
+		g.resume(f)
+	}
+}
+
+// CancelAll stops all the files of the running download
+func (g *GoXel) CancelAll() {
+	for _, f := range g.files() {
+		f.Cancel()
+	}
+}
+
+func (g *GoXel) start(s *session) {
+	g.sessionMux.Lock()
+	defer g.sessionMux.Unlock()
+
+	g.session = s
+}
+
+func (g *GoXel) stop() {
+	g.sessionMux.Lock()
+	defer g.sessionMux.Unlock()
+
+	g.session = nil
+}
+
+func (g *GoXel) current() *session {
+	g.sessionMux.Lock()
+	defer g.sessionMux.Unlock()
+
+	return g.session
+}
+
+func (g *GoXel) files() []*File {
+	if s := g.current(); s != nil {
+		return s.files
+	}
+	return nil
+}
+
+func (g *GoXel) file(id uint32) (*File, error) {
+	s := g.current()
+	if s == nil {
+		return nil, errNotRunning
+	}
+
+	if f, ok := s.index[id]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("Unknown file %v", id)
+}
+
+// resume sends the incomplete chunks of the file to the rebalancer
+func (g *GoXel) resume(f *File) {
+	s := g.current()
+	if s == nil || !f.Resume() {
+		return
+	}
+
+	f.QueueChunks(s.headers, s.complete)
+}
+
+// Pause stops the connections of the file and persists its progress
+func (f *File) Pause() {
+	f.Mux.Lock()
+	if f.paused || f.Finished || f.Error != "" {
+		f.Mux.Unlock()
+		return
+	}
+	f.paused = true
+	f.stopConnections()
+	f.Mux.Unlock()
+
+	if f.isValid() {
+		f.writeMetadata()
+	}
+}
+
+// Resume marks the paused file as running, it returns false when the file was not paused
+// The chunks must then be queued again, which is done by GoXel.ResumeFile.
+func (f *File) Resume() bool {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	if !f.paused {
+		return false
+	}
+	f.paused = false
+	return f.Error == ""
+}
+
+// Cancel stops the connections of the file and marks it in error
+func (f *File) Cancel() {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	if f.Finished || f.Error != "" {
+		return
+	}
+	f.Error = cancelledMessage
+	f.paused = false
+	f.stopConnections()
+}
+
+// Retry clears the error of the file, it returns false when the file can't be downloaded again
+// The chunks must then be queued again, which is done by GoXel.RetryFile.
+func (f *File) Retry() bool {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	if !f.Valid || f.Finished || f.removed || f.Error == "" {
+		return false
+	}
+
+	f.Error = ""
+	f.paused = false
+	for i := range f.Chunks {
+		f.Chunks[i].failures = 0
+	}
+	return true
+}
+
+// Remove cancels the file and hides it from the monitoring
+func (f *File) Remove() {
+	f.Cancel()
+
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	f.removed = true
+}
+
+// isRemoved checks if the file has been removed by the user
+func (f *File) isRemoved() bool {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	return f.removed
+}
+
+// IsPaused checks if the file is paused
+func (f *File) IsPaused() bool {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	return f.paused
+}
+
+// track registers the cancel function of a connection so it can be stopped when the file is paused
+// It returns false when the file doesn't accept new connections, untrack must be called once the connection is closed.
+func (f *File) track(cancel context.CancelFunc) (untrack func(), ok bool) {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	if f.paused || f.Error != "" {
+		return func() {}, false
+	}
+
+	if f.connections == nil {
+		f.connections = make(map[uint64]context.CancelFunc)
+	}
+	id := f.connectionID
+	f.connectionID++
+	f.connections[id] = cancel
+
+	return func() {
+		f.Mux.Lock()
+		defer f.Mux.Unlock()
+
+		delete(f.connections, id)
+	}, true
+}
+
+// stopConnections must be called with the Mux held
+func (f *File) stopConnections() {
+	for id, cancel := range f.connections {
+		cancel()
+		delete(f.connections, id)
+	}
+}
+
+// incompleteChunks returns the IDs of the chunks which are not completely downloaded
+func (f *File) incompleteChunks() []uint32 {
+	var ids []uint32
+	for _, chunk := range f.snapshot() {
+		if chunk.Remaining() > 0 {
+			ids = append(ids, chunk.ID)
+		}
+	}
+	return ids
+}
+
+// command is an action requested on a file, or on all the files when all is set
+type command struct {
+	action byte
+	file   uint32
+	all    bool
+}
+
+// commandParser reads the keyboard shortcuts: an optional file number followed by an action key
+// "p" pauses, "r" resumes and "c" cancels, e.g. "2p" pauses the file 2 and "p" pauses all the files.
+type commandParser struct {
+	number []byte
+}
+
+// feed adds a key to the parser, ok is true once a command is complete
+func (p *commandParser) feed(key byte) (cmd command, ok bool) {
+	switch {
+	case key >= '0' && key <= '9':
+		p.number = append(p.number, key)
+		return command{}, false
+
+	case key == 'p' || key == 'r' || key == 'c':
+		cmd = command{action: key, all: len(p.number) == 0}
+		for _, digit := range p.number {
+			cmd.file = cmd.file*10 + uint32(digit-'0')
+		}
+		p.number = nil
+		return cmd, true
+	}
+
+	// Any other key resets the selection
+	p.number = nil
+	return command{}, false
+}
+
+// apply runs the command on the running download
+func (g *GoXel) apply(cmd command) error {
+	if cmd.all {
+		switch cmd.action {
+		case 'p':
+			g.PauseAll()
+		case 'r':
+			g.ResumeAll()
+		case 'c':
+			g.CancelAll()
+		}
+		return nil
+	}
+
+	switch cmd.action {
+	case 'p':
+		return g.PauseFile(cmd.file)
+	case 'r':
+		return g.ResumeFile(cmd.file)
+	case 'c':
+		return g.CancelFile(cmd.file)
+	}
+	return nil
+}
+
+// keyHandler handles the keys typed by the user
+type keyHandler interface {
+	key(key byte)
+}
+
+// commandKeys applies the commands typed as an optional file number followed by an action key
+type commandKeys struct {
+	g      *GoXel
+	parser commandParser
+}
+
+func (c *commandKeys) key(key byte) {
+	if cmd, ok := c.parser.feed(key); ok {
+		if err := c.g.apply(cmd); err != nil {
+			cMessages <- NewWarningMessage("CONTROL", err.Error())
+		}
+	}
+}
+
+// handleControls applies the keyboard shortcuts and the signals until the session is complete
+// SIGUSR1 pauses and SIGUSR2 resumes all the files, the first interrupt cancels them so their progress is persisted.
+// The keys are read from the terminal when keys is set, the returned function restores the terminal.
+// A second interrupt exits right away once the terminal and the screen are restored by reset.
+func (g *GoXel) handleControls(complete chan bool, keys keyHandler, reset func()) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2, os.Interrupt, syscall.SIGTERM)
+
+	typed := make(chan byte)
+	restore := func() {}
+	if keys != nil {
+		if r, err := rawTerminal(syscall.Stdin); err == nil {
+			restore = r
+			go readKeys(os.Stdin, typed, complete)
+		}
+	}
+
+	go func() {
+		defer signal.Stop(signals)
+
+		var interrupted bool
+		for {
+			select {
+			case s := <-signals:
+				switch s {
+				case syscall.SIGUSR1:
+					g.PauseAll()
+				case syscall.SIGUSR2:
+					g.ResumeAll()
+				default:
+					if interrupted {
+						restore()
+						reset()
+						os.Exit(1)
+					}
+					interrupted = true
+					g.CancelAll()
+				}
+
+			case key := <-typed:
+				keys.key(key)
+
+			case <-complete:
+				return
+			}
+		}
+	}()
+
+	return restore
+}
+
+// readKeys sends the keys read from the input until done is closed, it stops at the first error
+// The raw terminal returns no key when none is typed for a while so done is checked regularly.
+func readKeys(input io.Reader, keys chan byte, done chan bool) {
+	buf := make([]byte, 1)
+	for {
+		n, err := input.Read(buf)
+		if err != nil && err != io.EOF {
+			return
+		}
+
+		if n == 0 {
+			select {
+			case <-done:
+				return
+			default:
+				continue
+			}
+		}
+
+		select {
+		case keys <- buf[0]:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package goxel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCommandParser(t *testing.T) {
+	var parser commandParser
+
+	expected := []command{
+		{action: 'p', all: true},
+		{action: 'r', file: 12},
+		{action: 'c', file: 3},
+	}
+
+	var commands []command
+	for _, key := range []byte("p12rx4y3c") {
+		if cmd, ok := parser.feed(key); ok {
+			commands = append(commands, cmd)
+		}
+	}
+
+	if len(commands) != len(expected) {
+		t.Fatal("Unexpected commands", commands)
+	}
+
+	for i, cmd := range commands {
+		if cmd != expected[i] {
+			t.Error("Unexpected command", cmd, expected[i])
+		}
+	}
+}
+
+// throttledWriter slows down the responses so the downloads can be controlled
+type throttledWriter struct {
+	http.ResponseWriter
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		n := 4096
+		if n > len(b) {
+			n = len(b)
+		}
+
+		time.Sleep(time.Millisecond)
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func startThrottledServer(content []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(&throttledWriter{w}, r, "throttled", time.Now(), bytes.NewReader(content))
+	}))
+}
+
+// startControlledRun runs the download in background and waits for the session to start
+func startControlledRun(t *testing.T, g *GoXel) chan bool {
+	resetTransport()
+
+	done := make(chan bool)
+	go func() {
+		g.Run()
+		close(done)
+	}()
+
+	for g.files() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Wait for the downloads to start
+	for downloaded(g.files()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return done
+}
+
+func TestPauseResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, 4<<20)
+	rand.Read(content)
+
+	ts := startThrottledServer(content)
+	defer ts.Close()
+
+	g := &GoXel{
+		URLs:                  []string{ts.URL + "/paused"},
+		Headers:               map[string]string{},
+		OutputDirectory:       dir,
+		MaxConnections:        4,
+		MaxConnectionsPerFile: 4,
+		Quiet:                 true,
+		BufferSize:            16,
+		Resume:                true,
+	}
+	done := startControlledRun(t, g)
+
+	if err := g.PauseFile(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.PauseFile(1); err == nil {
+		t.Error("Unknown file should be reported")
+	}
+
+	// Connections are stopped
+	time.Sleep(200 * time.Millisecond)
+	paused := downloaded(g.files())
+	time.Sleep(200 * time.Millisecond)
+
+	if downloaded(g.files()) != paused {
+		t.Error("Paused file should not progress")
+	}
+
+	if _, err := os.Stat(path.Join(dir, "paused."+workExtension)); err != nil {
+		t.Error("Progress should be persisted when pausing", err)
+	}
+
+	g.ResumeAll()
+	<-done
+
+	b, _ := ioutil.ReadFile(path.Join(dir, "paused"))
+	if !bytes.Equal(b, content) {
+		t.Error("Resumed file should be complete")
+	}
+
+	if err := g.PauseFile(0); err != errNotRunning {
+		t.Error("Controls should fail once the download is over")
+	}
+}
+
+func TestCancelFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, 4<<20)
+	rand.Read(content)
+
+	ts := startThrottledServer(content)
+	defer ts.Close()
+
+	g := &GoXel{
+		URLs:                  []string{ts.URL + "/cancelled", ts.URL + "/kept"},
+		Headers:               map[string]string{},
+		OutputDirectory:       dir,
+		MaxConnections:        4,
+		MaxConnectionsPerFile: 2,
+		Quiet:                 true,
+		BufferSize:            16,
+		Resume:                true,
+	}
+	done := startControlledRun(t, g)
+
+	if err := g.CancelFile(0); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	files := g.files()
+	if files != nil {
+		t.Error("Session should be over")
+	}
+
+	if _, err := os.Stat(path.Join(dir, "cancelled."+workExtension)); err != nil {
+		t.Error("Progress of the cancelled file should be persisted", err)
+	}
+
+	b, _ := ioutil.ReadFile(path.Join(dir, "kept"))
+	if !bytes.Equal(b, content) {
+		t.Error("Other files should be downloaded")
+	}
+}
+
+func TestRetryRemove(t *testing.T) {
+	file := File{Size: 100, Valid: true, Error: "Too many retries", Chunks: []Chunk{{Range: Range{Start: 0, End: 100}, Done: 50, failures: maxRetries}}}
+
+	if !file.Retry() {
+		t.Fatal("File in error should be retried")
+	}
+	if file.failure() != "" || file.Chunks[0].failures != 0 {
+		t.Error("Retry should reset the error and the failures")
+	}
+	if file.Retry() {
+		t.Error("Running file should not be retried")
+	}
+
+	file.Remove()
+	if !file.isRemoved() || file.failure() != cancelledMessage {
+		t.Error("Removed file should be cancelled")
+	}
+	if file.Retry() {
+		t.Error("Removed file should not be retried")
+	}
+}
+
+func TestReadKeys(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	keys := make(chan byte)
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		readKeys(r, keys, done)
+		close(stopped)
+	}()
+
+	w.Write([]byte("pj"))
+	if key := <-keys; key != 'p' {
+		t.Error("Keys should be read in order", key)
+	}
+
+	// The pending key is dropped once the run ends
+	close(done)
+	w.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Keys should not be read once the run ends")
+	}
+}
@@ -0,0 +1,388 @@
+package goxel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// debridErrorKind classifies the errors of the debrid providers
+type debridErrorKind int
+
+const (
+	// debridUnreachable means the provider couldn't be reached
+	debridUnreachable debridErrorKind = iota
+	// debridUnsupported means the provider doesn't support the link
+	debridUnsupported
+	// debridLimited means a limit of the provider or of the host was reached
+	debridLimited
+	// debridProtected means the link is protected by a password
+	debridProtected
+	// debridUnavailable means the file is not available on the host
+	debridUnavailable
+	// debridRefused means the provider refused the link for another reason
+	debridRefused
+)
+
+func (k debridErrorKind) String() string {
+	return [...]string{"unreachable", "unsupported", "limited", "protected", "unavailable", "refused"}[k]
+}
+
+// debridError is an error of a provider, the link falls back to the next provider supporting it
+type debridError struct {
+	Kind     debridErrorKind
+	Provider string
+	Err      error
+}
+
+func (e *debridError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Provider, e.Err.Error())
+}
+
+// debridLink is a link unlocked by a provider
+// The name is the output path relative to the output directory, the size is 0 when it is unknown.
+type debridLink struct {
+	URL, Name string
+	Size      uint64
+}
+
+// debridProvider is a debrid or premium link service unlocking the links of the hosts it supports
+type debridProvider interface {
+	// providerName returns the name of the provider used in the messages
+	providerName() string
+	// setup authenticates on the provider and retrieves its hosts, it returns false when the provider can't be used
+	setup() bool
+	// supports checks if the provider unlocks the link
+	supports(link string) bool
+	// debrid unlocks the link, the errors are debridErrors
+	debrid(ctx context.Context, link string) (debridLink, error)
+}
+
+// debridExpander is implemented by the providers expanding links into other links, as folders or magnets
+type debridExpander interface {
+	expands(link string) bool
+	expandLinks(ctx context.Context, link string) ([]string, error)
+}
+
+// debridProviders are the names of the providers in their default priority
+var debridProviders = []string{"alldebrid", "realdebrid"}
+
+// DebridURLPreprocessor implements the UrlPreprocessor interface with several debrid providers.
+// The hosts of the providers are merged, each link is unlocked by the first provider supporting it
+// by priority and falls back to the next one when the provider fails. When Lazy is set, the links
+// are only unlocked when their file starts. At most Concurrency links are processed at the same time.
+type DebridURLPreprocessor struct {
+	Providers   []debridProvider
+	Lazy        bool
+	Initialized bool
+	Concurrency int
+	active      []debridProvider
+	mux         sync.Mutex
+	links       map[string]debridLink
+}
+
+func (d *DebridURLPreprocessor) initialize() {
+	d.links = make(map[string]debridLink)
+	for _, p := range d.Providers {
+		if p.setup() {
+			d.active = append(d.active, p)
+		}
+	}
+	d.Initialized = true
+}
+
+// providers returns the providers supporting the link by priority
+func (d *DebridURLPreprocessor) providers(link string) []debridProvider {
+	var providers []debridProvider
+	for _, p := range d.active {
+		if p.supports(link) {
+			providers = append(providers, p)
+		}
+	}
+	return providers
+}
+
+// resolve unlocks the link with the providers supporting it, a failed provider falls back to the next one
+// The link is kept as is when none of the providers can be reached.
+func (d *DebridURLPreprocessor) resolve(ctx context.Context, link string) (string, error) {
+	providers := d.providers(link)
+
+	var errs []string
+	reachable := false
+	for i, p := range providers {
+		unlocked, err := p.debrid(ctx, link)
+		if err == nil {
+			d.mux.Lock()
+			d.links[unlocked.URL] = unlocked
+			d.mux.Unlock()
+			return unlocked.URL, nil
+		}
+
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		if e, ok := err.(*debridError); !ok || e.Kind != debridUnreachable {
+			reachable = true
+		}
+		errs = append(errs, err.Error())
+
+		if i < len(providers)-1 {
+			cMessages <- NewWarningMessage("DEBRID", fmt.Sprintf("Trying the next provider for [%v]: %v", link, err.Error()))
+		}
+	}
+
+	if !reachable {
+		cMessages <- NewErrorMessage("DEBRID", fmt.Sprintf("An error occurred while debriding [%v]: %v", link, strings.Join(errs, ", ")))
+		return link, nil
+	}
+	return "", fmt.Errorf("No provider could unlock the link: %v", strings.Join(errs, ", "))
+}
+
+// processLink returns the links downloaded for the link, they are unlocked unless they are lazy
+// The depth is the number of expansions followed to reach the link.
+func (d *DebridURLPreprocessor) processLink(ctx context.Context, link string, depth int) []string {
+	var expandErr error
+	for _, p := range d.active {
+		e, ok := p.(debridExpander)
+		if !ok || !e.expands(link) {
+			continue
+		}
+
+		if depth >= maxRedirects {
+			cMessages <- NewErrorMessage("DEBRID", fmt.Sprintf("Ignoring [%v]: too many redirections", link))
+			return nil
+		}
+
+		children, err := e.expandLinks(ctx, link)
+		if err != nil {
+			cMessages <- NewWarningMessage("DEBRID", fmt.Sprintf("%v can't expand [%v]: %v", p.providerName(), link, err.Error()))
+			expandErr = err
+			continue
+		}
+
+		var links []string
+		for _, child := range children {
+			links = append(links, d.processLink(ctx, child, depth+1)...)
+		}
+		return links
+	}
+
+	switch {
+	case expandErr != nil:
+		cMessages <- NewErrorMessage("DEBRID", fmt.Sprintf("Ignoring [%v] due to an error: %v", link, expandErr.Error()))
+		return nil
+
+	case isTorrent(link):
+		cMessages <- NewErrorMessage("DEBRID", fmt.Sprintf("Ignoring [%v]: no provider could expand it", link))
+		return nil
+
+	case len(d.providers(link)) == 0:
+		cMessages <- NewWarningMessage("DEBRID", fmt.Sprintf("Ignore debrid for [%v] as no provider supports the URL", link))
+		return []string{link}
+
+	// Lazy links are unlocked by their resolver
+	case d.Lazy:
+		return []string{link}
+	}
+
+	resolved, err := d.resolve(ctx, link)
+	if err != nil {
+		cMessages <- NewErrorMessage("DEBRID", fmt.Sprintf("Ignoring [%v] due to an error: %v", link, err.Error()))
+		return nil
+	}
+	return []string{resolved}
+}
+
+// resolver unlocks the link when its file starts, nil when no provider supports the link
+func (d *DebridURLPreprocessor) resolver(link string) func(ctx context.Context) (string, error) {
+	if !d.Lazy || len(d.providers(link)) == 0 {
+		return nil
+	}
+
+	return func(ctx context.Context) (string, error) {
+		return d.resolve(ctx, link)
+	}
+}
+
+// describe returns the name and the size of the file announced by its provider
+func (d *DebridURLPreprocessor) describe(link string) (string, uint64) {
+	d.mux.Lock()
+	unlocked, ok := d.links[link]
+	d.mux.Unlock()
+
+	if ok {
+		return unlocked.Name, unlocked.Size
+	}
+
+	// The files of the expanded links are named before being unlocked
+	for _, p := range d.active {
+		if describer, ok := p.(urlDescriber); ok {
+			if name, size := describer.describe(link); name != "" || size != 0 {
+				return name, size
+			}
+		}
+	}
+	return "", 0
+}
+
+func (d *DebridURLPreprocessor) process(urls []string) []string {
+	if !d.Initialized {
+		d.initialize()
+	}
+
+	if len(d.active) == 0 {
+		return urls
+	}
+
+	concurrency := d.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultProbeConcurrency
+	}
+
+	// The links are unlocked by a pool of workers, the order of the URLs is kept
+	unlocked := make([][]string, len(urls))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(urls); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				unlocked[i] = d.processLink(context.Background(), urls[i], 0)
+			}
+		}()
+	}
+	for i := range urls {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	output := make([]string, 0, len(urls))
+	for _, links := range unlocked {
+		output = append(output, links...)
+	}
+	return output
+}
+
+// debridConfig is the configuration file of the debrid providers, the arguments and the environment take precedence
+type debridConfig struct {
+	Priority  []string `json:"priority"`
+	AllDebrid struct {
+		APIKey   string `json:"apikey"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"alldebrid"`
+	RealDebrid struct {
+		Token string `json:"token"`
+	} `json:"realdebrid"`
+}
+
+// defaultDebridConfigFile returns the configuration file of the debrid providers, an empty string when there is no configuration directory
+func defaultDebridConfigFile() string {
+	dir := configDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "goxel", "debrid.json")
+}
+
+// readDebridConfig reads the configuration file, it holds credentials so it must only be accessible by its owner
+func readDebridConfig(file string) (debridConfig, error) {
+	var config debridConfig
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return config, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return config, fmt.Errorf("%v is accessible by other users, its permissions must be 0600", file)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return config, err
+	}
+
+	if err := json.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("invalid configuration %v: %v", file, err.Error())
+	}
+	return config, nil
+}
+
+// debridPriority returns the names of the providers by priority
+// The providers missing from the configured priority keep their default order after the others.
+func (g *GoXel) debridPriority(config debridConfig) []string {
+	priority := g.DebridPriority
+	if len(priority) == 0 && os.Getenv("GOXEL_DEBRID_PRIORITY") != "" {
+		priority = strings.Split(os.Getenv("GOXEL_DEBRID_PRIORITY"), ",")
+	}
+	if len(priority) == 0 {
+		priority = config.Priority
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range append(priority, debridProviders...) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		switch name {
+		case "alldebrid", "realdebrid":
+			names = append(names, name)
+		default:
+			fmt.Printf("[WARNING] Ignoring the unknown debrid provider [%v]\n", name)
+		}
+	}
+	return names
+}
+
+// debrid builds the debrid preprocessor with the configured providers, nil when no provider is configured
+// The passwords are the passwords of the protected links, each provider gets its own copy.
+func (g *GoXel) debrid(passwords map[string]string) *DebridURLPreprocessor {
+	var config debridConfig
+	if g.DebridConfigFile != "" {
+		var err error
+		if config, err = readDebridConfig(g.DebridConfigFile); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[WARNING] Ignoring the debrid configuration: %v\n", err.Error())
+		}
+	}
+
+	d := &DebridURLPreprocessor{Lazy: true, Concurrency: g.ProbeConcurrency}
+	for _, name := range g.debridPriority(config) {
+		switch name {
+		case "alldebrid":
+			if alldebrid := g.alldebrid(config); alldebrid != nil {
+				alldebrid.Passwords = copyPasswords(passwords)
+				d.Providers = append(d.Providers, alldebrid)
+			}
+		case "realdebrid":
+			if realdebrid := g.realdebrid(config); realdebrid != nil {
+				realdebrid.Passwords = copyPasswords(passwords)
+				d.Providers = append(d.Providers, realdebrid)
+			}
+		}
+	}
+
+	if len(d.Providers) == 0 {
+		return nil
+	}
+	return d
+}
+
+func copyPasswords(passwords map[string]string) map[string]string {
+	c := make(map[string]string, len(passwords))
+	for k, v := range passwords {
+		c[k] = v
+	}
+	return c
+}
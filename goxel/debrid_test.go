@@ -0,0 +1,191 @@
+package goxel
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newDebridTest(providers ...string) *DebridURLPreprocessor {
+	d := &DebridURLPreprocessor{}
+	for _, p := range providers {
+		switch p {
+		case "alldebrid":
+			d.Providers = append(d.Providers, &AllDebridProvider{APIKey: "premiumkey", API: "http://127.0.0.1:8080"})
+		case "realdebrid":
+			d.Providers = append(d.Providers, &RealDebridProvider{Token: "premiumtoken", API: "http://127.0.0.1:8080/rd"})
+		}
+	}
+	return d
+}
+
+func TestDebridPriority(t *testing.T) {
+	d := newDebridTest("realdebrid", "alldebrid")
+	urls := d.process([]string{"http://hoster.com/test/movie", "http://upload.com/test/video.mp4", "http://other.com/video.mp4"})
+	if strings.Join(urls, " ") != "http://download.com/movie http://test.com/ok.mp4 http://other.com/video.mp4" {
+		t.Error("Links should be unlocked by the first provider supporting them", urls)
+	}
+
+	if name, size := d.describe("http://download.com/movie"); name != "movie.mkv" || size != 1024 {
+		t.Error("The file should be described by the provider which unlocked it", name, size)
+	}
+
+	d = newDebridTest("alldebrid", "realdebrid")
+	if urls := d.process([]string{"http://hoster.com/test/movie"}); strings.Join(urls, " ") != "http://test.com/ok.mp4" {
+		t.Error("Links should be unlocked by AllDebrid first", urls)
+	}
+}
+
+func TestDebridFallback(t *testing.T) {
+	d := newDebridTest("alldebrid", "realdebrid")
+	urls := d.process([]string{"http://hoster.com/test/fallback", "http://upload.com/test/down.mp4"})
+	if strings.Join(urls, " ") != "http://download.com/movie" {
+		t.Error("Links refused by a provider should be unlocked by the next one", urls)
+	}
+
+	_, err := d.resolve(context.Background(), "http://upload.com/test/down.mp4")
+	if err == nil || !strings.Contains(err.Error(), "AllDebrid") {
+		t.Error("The error of the last provider should be returned", err)
+	}
+}
+
+func TestDebridLazy(t *testing.T) {
+	d := newDebridTest("alldebrid", "realdebrid")
+	d.Lazy = true
+
+	urls := d.process([]string{"http://hoster.com/test/fallback", "http://other.com/video.mp4"})
+	if strings.Join(urls, " ") != "http://hoster.com/test/fallback http://other.com/video.mp4" {
+		t.Error("Lazy links should not be unlocked", urls)
+	}
+
+	if d.resolver("http://other.com/video.mp4") != nil {
+		t.Error("Unsupported links should not be resolved")
+	}
+
+	resolve := d.resolver("http://hoster.com/test/fallback")
+	if resolve == nil {
+		t.Fatal("Supported links should be resolved")
+	}
+	if link, err := resolve(context.Background()); err != nil || link != "http://download.com/movie" {
+		t.Error("Lazy links should fall back to the next provider", link, err)
+	}
+}
+
+// countingProvider unlocks every link and records the highest number of links unlocked at the same time
+type countingProvider struct {
+	mux          sync.Mutex
+	running, max int
+}
+
+func (p *countingProvider) providerName() string      { return "Counting" }
+func (p *countingProvider) setup() bool               { return true }
+func (p *countingProvider) supports(link string) bool { return true }
+
+func (p *countingProvider) debrid(ctx context.Context, link string) (debridLink, error) {
+	p.mux.Lock()
+	if p.running++; p.running > p.max {
+		p.max = p.running
+	}
+	p.mux.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	p.mux.Lock()
+	p.running--
+	p.mux.Unlock()
+	return debridLink{URL: link + "/unlocked"}, nil
+}
+
+func TestDebridConcurrency(t *testing.T) {
+	p := &countingProvider{}
+	d := &DebridURLPreprocessor{Providers: []debridProvider{p}, Concurrency: 3}
+
+	var links, expected []string
+	for i := 0; i < 20; i++ {
+		link := fmt.Sprintf("http://hoster.com/file%d", i)
+		links = append(links, link)
+		expected = append(expected, link+"/unlocked")
+	}
+
+	if urls := d.process(links); strings.Join(urls, " ") != strings.Join(expected, " ") {
+		t.Error("Links should be unlocked in order", urls)
+	}
+	if p.max > 3 || p.max == 0 {
+		t.Error("Unlocked links should be bounded, got", p.max)
+	}
+}
+
+func TestDebridErrorKind(t *testing.T) {
+	for err, kind := range map[error]debridErrorKind{
+		&APIError{Code: "LINK_HOST_FULL"}:        debridLimited,
+		&APIError{Code: "LINK_PASS_PROTECTED"}:   debridProtected,
+		&APIError{Code: "LINK_HOST_UNAVAILABLE"}: debridUnsupported,
+		&APIError{Code: "LINK_DOWN"}:             debridUnavailable,
+		legacyError(39):                          debridRefused,
+		statusError(500):                         debridUnreachable,
+	} {
+		if k := allDebridErrorKind(err); k != kind {
+			t.Error("Invalid AllDebrid error kind", err, k)
+		}
+	}
+
+	for err, kind := range map[error]debridErrorKind{
+		&RealDebridError{Code: 21}: debridLimited,
+		&RealDebridError{Code: 16}: debridUnsupported,
+		&RealDebridError{Code: 24}: debridUnavailable,
+		&RealDebridError{Code: 8}:  debridRefused,
+		statusError(502):           debridUnreachable,
+	} {
+		if k := realDebridErrorKind(err); k != kind {
+			t.Error("Invalid Real-Debrid error kind", err, k)
+		}
+	}
+}
+
+func TestDebridConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "goxel-debrid")
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "debrid.json")
+	ioutil.WriteFile(file, []byte(`{"priority": ["realdebrid"], "alldebrid": {"apikey": "configkey"}, "realdebrid": {"token": "configtoken"}}`), 0600)
+
+	config, err := readDebridConfig(file)
+	if err != nil || config.AllDebrid.APIKey != "configkey" || config.RealDebrid.Token != "configtoken" {
+		t.Error("The configuration should be read", config, err)
+	}
+
+	os.Chmod(file, 0644)
+	if _, err := readDebridConfig(file); err == nil {
+		t.Error("A configuration readable by other users should be refused")
+	}
+
+	g := &GoXel{}
+	if p := g.debridPriority(config); strings.Join(p, ",") != "realdebrid,alldebrid" {
+		t.Error("The configured priority should come first", p)
+	}
+
+	os.Setenv("GOXEL_DEBRID_PRIORITY", "alldebrid")
+	defer os.Unsetenv("GOXEL_DEBRID_PRIORITY")
+	if p := g.debridPriority(config); strings.Join(p, ",") != "alldebrid,realdebrid" {
+		t.Error("The environment should take precedence over the configuration", p)
+	}
+
+	g.DebridPriority = []string{"RealDebrid"}
+	if p := g.debridPriority(config); strings.Join(p, ",") != "realdebrid,alldebrid" {
+		t.Error("The arguments should take precedence over the environment", p)
+	}
+
+	g.RealdebridToken = "flagtoken"
+	if rd := g.realdebrid(config); rd == nil || rd.Token != "flagtoken" {
+		t.Error("The arguments should take precedence over the configuration")
+	}
+	if ad := g.alldebrid(config); ad == nil || ad.APIKey != "configkey" {
+		t.Error("The API key should be read from the configuration")
+	}
+}
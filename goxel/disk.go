@@ -0,0 +1,234 @@
+package goxel
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/dustin/go-humanize"
+)
+
+const noSpaceMessage = "No space left on device, free some space and run GoXel again to resume the download"
+
+// isNoSpaceError checks if the error was caused by a full disk
+func isNoSpaceError(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ENOSPC
+}
+
+// allocatedSize returns the number of bytes already allocated on disk for the file
+func allocatedSize(filename string) uint64 {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Blocks) * 512
+	}
+	return uint64(info.Size())
+}
+
+// availableSpace returns the number of bytes available to the user in the directory
+func availableSpace(directory string) (uint64, error) {
+	if directory == "" {
+		directory = "."
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(directory, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// knownSize returns the size of the file, the size announced by the preprocessors until it is probed
+func (f *File) knownSize() uint64 {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	if f.Error != "" {
+		return 0
+	}
+	if f.Size > 0 {
+		return f.Size
+	}
+	return f.expected
+}
+
+// checkDiskSpace ensures the directory has enough free space to store all the files and the reserved bytes
+// Space already allocated by previous runs is deducted from the required space, the files whose size
+// is not known yet are ignored.
+func checkDiskSpace(directory string, files []*File, reserved uint64) error {
+	required := reserved
+	for _, f := range files {
+		size := f.knownSize()
+		if size == 0 {
+			continue
+		}
+
+		if allocated := allocatedSize(f.Output); allocated < size {
+			required += size - allocated
+		}
+	}
+
+	available, err := availableSpace(directory)
+	if err != nil {
+		return fmt.Errorf("Can't retrieve free disk space: %v", err.Error())
+	}
+
+	if required > available {
+		return fmt.Errorf("Not enough disk space: %s required, %s available", humanize.Bytes(required), humanize.Bytes(available))
+	}
+	return nil
+}
+
+// open opens the output file, the handle is shared by all the chunks of the file
+func (f *File) open() error {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	if f.handle != nil {
+		return nil
+	}
+
+	handle, err := os.OpenFile(f.Output, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	f.handle = handle
+	return nil
+}
+
+// output returns the handle of the output file, nil if the file is not opened
+func (f *File) output() *os.File {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	return f.handle
+}
+
+// sync commits the written bytes of the output file to the disk
+func (f *File) sync() error {
+	if handle := f.output(); handle != nil {
+		return handle.Sync()
+	}
+	return nil
+}
+
+// close syncs and closes the output file
+func (f *File) close() error {
+	f.Mux.Lock()
+	handle := f.handle
+	f.handle = nil
+	f.Mux.Unlock()
+
+	if handle == nil {
+		return nil
+	}
+
+	err := handle.Sync()
+	if cerr := handle.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// checkSize verifies the size of the output file once downloaded
+// Bytes left past the end by a previous file are removed, a shorter file is an error.
+func (f *File) checkSize() error {
+	info, err := os.Stat(f.Output)
+	if err != nil {
+		return fmt.Errorf("Can't check file: %v", err.Error())
+	}
+
+	size := uint64(info.Size())
+	if size > f.Size {
+		return os.Truncate(f.Output, int64(f.Size))
+	}
+
+	if size < f.Size {
+		return fmt.Errorf("Incomplete file: %v bytes expected, got %v", f.Size, size)
+	}
+	return nil
+}
+
+// checksums are the algorithms of the checksums announced by the preprocessors
+var checksums = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// parseChecksum splits the checksum "<algorithm>:<hex digest>", an empty checksum isn't checked
+func parseChecksum(checksum string) (func() hash.Hash, []byte, error) {
+	if checksum == "" {
+		return nil, nil, nil
+	}
+
+	split := strings.SplitN(checksum, ":", 2)
+	algorithm, ok := checksums[strings.ToLower(split[0])]
+	if !ok || len(split) != 2 {
+		return nil, nil, fmt.Errorf("Invalid checksum [%v]", checksum)
+	}
+
+	digest, err := hex.DecodeString(split[1])
+	if err != nil || len(digest) != algorithm().Size() {
+		return nil, nil, fmt.Errorf("Invalid checksum [%v]", checksum)
+	}
+	return algorithm, digest, nil
+}
+
+// checkChecksum checks the digest of the complete file against the announced checksum
+func (f *File) checkChecksum() error {
+	algorithm, digest, err := parseChecksum(f.checksum)
+	if err != nil || algorithm == nil {
+		return err
+	}
+
+	file, err := os.Open(f.Output)
+	if err != nil {
+		return fmt.Errorf("Can't check file: %v", err.Error())
+	}
+	defer file.Close()
+
+	h := algorithm()
+	if _, err := io.Copy(h, file); err != nil {
+		return fmt.Errorf("Can't check file: %v", err.Error())
+	}
+
+	if sum := h.Sum(nil); string(sum) != string(digest) {
+		return fmt.Errorf("Checksum mismatch: %x expected, got %x", digest, sum)
+	}
+	return nil
+}
+
+// preallocate reserves the disk space of the whole file before it is downloaded
+func (f *File) preallocate() error {
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	handle := f.output()
+
+	info, err := handle.Stat()
+	if err != nil {
+		return err
+	}
+
+	if uint64(info.Size()) >= f.Size {
+		return nil
+	}
+	return allocate(handle, int64(f.Size))
+}
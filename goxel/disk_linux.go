@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package goxel
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocate reserves the disk blocks of the file using fallocate
+// It falls back to a sparse file when the filesystem does not support it.
+func allocate(out *os.File, size int64) error {
+	err := syscall.Fallocate(int(out.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return out.Truncate(size)
+	}
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: out.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package goxel
+
+import (
+	"os"
+)
+
+// allocate sets the size of the file, blocks are allocated while downloading
+func allocate(out *os.File, size int64) error {
+	return out.Truncate(size)
+}
@@ -0,0 +1,138 @@
+package goxel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestIsNoSpaceError(t *testing.T) {
+	if !isNoSpaceError(&os.PathError{Op: "write", Path: "video.mp4", Err: syscall.ENOSPC}) || !isNoSpaceError(syscall.ENOSPC) {
+		t.Error("ENOSPC should be detected")
+	}
+
+	if isNoSpaceError(&os.PathError{Op: "write", Path: "video.mp4", Err: syscall.EIO}) {
+		t.Error("Only ENOSPC should be detected")
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []*File{
+		{Output: path.Join(dir, "small.mp4"), Size: 1024},
+	}
+	if err := checkDiskSpace(dir, files, 0); err != nil {
+		t.Error("Disk space should be sufficient", err)
+	}
+
+	files = append(files, &File{Output: path.Join(dir, "huge.mp4"), Size: 1 << 62})
+	if err := checkDiskSpace(dir, files, 0); err == nil {
+		t.Error("Disk space should be insufficient")
+	}
+
+	files[1].Error = "An HTTP error occurred: status 404"
+	if err := checkDiskSpace(dir, files, 0); err != nil {
+		t.Error("Files in error should be ignored", err)
+	}
+
+	if err := checkDiskSpace(dir, []*File{{Output: path.Join(dir, "announced.mp4"), expected: 1 << 62}}, 0); err == nil {
+		t.Error("Size announced by the preprocessors should be checked")
+	}
+	if err := checkDiskSpace(dir, files[:1], 1<<62); err == nil {
+		t.Error("Reserved space should be checked")
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := File{
+		Output: path.Join(dir, "video.mp4"),
+		Size:   1024 * 1024,
+	}
+	if err := file.preallocate(); err != nil {
+		t.Error("Preallocation should succeed", err)
+	}
+
+	info, err := os.Stat(file.Output)
+	if err != nil || uint64(info.Size()) != file.Size {
+		t.Error("Preallocated file should have the final size")
+	}
+
+	if err := checkDiskSpace(dir, []*File{&file}, 0); err != nil {
+		t.Error("Preallocated space should not be required again", err)
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := File{
+		Output: path.Join(dir, "video.mp4"),
+		Size:   1024,
+	}
+
+	ioutil.WriteFile(file.Output, make([]byte, 512), 0644)
+	if err := file.checkSize(); err == nil {
+		t.Error("Incomplete file should be detected")
+	}
+
+	ioutil.WriteFile(file.Output, make([]byte, 2048), 0644)
+	if err := file.checkSize(); err != nil {
+		t.Error("Bigger file should be truncated", err)
+	}
+
+	if info, _ := os.Stat(file.Output); info.Size() != 1024 {
+		t.Error("File should have been truncated")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("goxel checksum")
+	sum := sha256.Sum256(content)
+
+	file := File{
+		Output:   path.Join(dir, "video.mp4"),
+		checksum: "SHA256:" + hex.EncodeToString(sum[:]),
+	}
+	ioutil.WriteFile(file.Output, content, 0644)
+
+	if err := file.checkChecksum(); err != nil {
+		t.Error("Valid checksum should be accepted", err)
+	}
+
+	ioutil.WriteFile(file.Output, []byte("corrupted"), 0644)
+	if err := file.checkChecksum(); err == nil {
+		t.Error("Checksum mismatch should be detected")
+	}
+
+	for _, checksum := range []string{"sha256", "crc32:00000000", "md5:xyz", "sha1:" + hex.EncodeToString(sum[:])} {
+		if _, _, err := parseChecksum(checksum); err == nil {
+			t.Error("Invalid checksum should be refused", checksum)
+		}
+	}
+}
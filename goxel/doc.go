@@ -4,6 +4,11 @@ Package goxel provides the GoXel download accelerator written in Go.
 The GoXel strict contains all the allowed parameters.
 Then the Run method needs to be called to start the downloads.
 
-GoXel includes an Alldebrid preprocessor that tries to debrid supported links.
+GoXel includes Alldebrid and Real-Debrid preprocessors that try to debrid supported links,
+they can be combined with a priority and fall back on each other.
+
+Other packages can transform the downloads by adding a Preprocessor to the GoXel Preprocessors.
+They receive the downloads once the builtin preprocessors ran and can rewrite their URL, name
+them, announce their size and checksum, add headers, resolve them when they start or report errors.
 */
 package goxel
@@ -1,68 +1,76 @@
 package goxel
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
-	"os"
 	"strconv"
 	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
 )
 
 type download struct {
-	Chunk                *Chunk
-	OutputPath, InputURL string
-	FileID               uint32
-}
-
-func teeReaderFunc(d *download, r io.Reader, w io.Writer) io.Reader {
-	return &teeReader{d, r, w}
+	Chunk                      *Chunk
+	File                       *File
+	OutputPath, InputURL, Host string
+	FileID                     uint32
 }
 
-type teeReader struct {
-	d *download
-	r io.Reader
-	w io.Writer
-}
+// RebalanceChunks ensures new connections have a chunk attributed to help delayed ones
+// and queues again the chunks whose download stopped before their end.
+// It is the only sender of the chunks channel: the downloads are kept in a queue so headers
+// are always received, and once the complete channel is closed it closes the chunks channel
+// so the workers can exit.
+// The hosts are served in turn and a download is only sent once its host has a connection available.
+func RebalanceChunks(h chan header, d chan download, files []*File, complete chan bool) {
+	index := indexFiles(files)
 
-func (t *teeReader) Read(p []byte) (n int, err error) {
-	n, err = t.r.Read(p)
-	if n > 0 && t.d.Chunk.Total > t.d.Chunk.Done {
-		if n, err := t.w.Write(p[:n]); err != nil {
-			return n, err
+	var queue fairQueue
+	for {
+		var out chan download
+		next, ok := queue.peek(hosts)
+		if ok {
+			out = d
 		}
-	}
-	return
-}
 
-// RebalanceChunks ensures new connections have a chunk attributed to help delayed ones
-func RebalanceChunks(h chan header, d chan download, files []*File) {
-	for {
-		f := <-h
-
-		for _, fi := range files {
-			if fi.ID == f.FileID {
-				remaining := fi.Size
-
-				var idx int
-				for i, chunk := range fi.Chunks {
-					if chunk.Total-chunk.Done > uint64(0.1*float64(fi.Size)) && remaining > chunk.Total-chunk.Done {
-						remaining = chunk.Total - chunk.Done
-						idx = i
-					}
-				}
+		select {
+		case f := <-h:
+			fi, ok := index[f.FileID]
+			if !ok {
+				continue
+			}
 
-				if remaining != fi.Size {
-					chunk := fi.splitChunkInPlace(&fi.Chunks[idx], f.ChunkID)
-					d <- download{
-						Chunk:      chunk,
-						InputURL:   fi.URL,
-						OutputPath: fi.Output,
-					}
-				}
-				break
+			var chunk *Chunk
+			if f.Retry {
+				chunk = fi.chunk(f.ChunkID)
+			} else {
+				chunk = fi.rebalance(f.ChunkID)
 			}
+
+			if chunk != nil {
+				queue.push(download{
+					Chunk:      chunk,
+					File:       fi,
+					InputURL:   fi.URL,
+					OutputPath: fi.Output,
+					Host:       hostOf(fi.URL),
+					FileID:     fi.ID,
+				})
+			}
+
+		case out <- next:
+			queue.pop(next)
+			hosts.reserve(next.Host)
+
+		case <-hosts.releases():
+
+		case <-complete:
+			close(d)
+			return
 		}
 	}
 }
@@ -70,7 +78,9 @@ func RebalanceChunks(h chan header, d chan download, files []*File) {
 // DownloadWorker is the worker functions that processes the download of one Chunk.
 // It takes a WaitGroup to ensure all workers have finished before exiting the program.
 // It also takes a Channel of Chunks to receive the chunks to download.
-func DownloadWorker(i int, wg *sync.WaitGroup, chunks chan download, bs int, finished chan header) {
+// Incomplete chunks are sent back to the rebalancer until the complete channel is closed.
+// Cancelling the context aborts the running download.
+func DownloadWorker(ctx context.Context, i int, wg *sync.WaitGroup, chunks chan download, bs int, finished chan header, complete chan bool) {
 	defer wg.Done()
 
 	client, err := NewClient()
@@ -84,66 +94,196 @@ func DownloadWorker(i int, wg *sync.WaitGroup, chunks chan download, bs int, fin
 			break
 		}
 
-		handleChunkDownload(&download, i, client, bs)
+		if err := hosts.wait(ctx, download.Host); err == nil {
+			handleChunkDownload(ctx, &download, i, client, bs)
+		}
+		hosts.release(download.Host)
+
+		if download.File.retry(download.Chunk, uint32(i)) {
+			time.Sleep(download.File.retryDelay(download.Chunk))
 
+			select {
+			case finished <- header{
+				FileID:  download.FileID,
+				ChunkID: download.Chunk.ID,
+				Retry:   true,
+			}:
+			case <-complete:
+			}
+			continue
+		}
+
+		// Rebalancing is skipped when the rebalancer is busy
 		if len(chunks) == 0 {
-			finished <- header{
+			select {
+			case finished <- header{
 				FileID:  download.FileID,
 				ChunkID: download.Chunk.ID,
+			}:
+			default:
 			}
 		}
 	}
 }
 
-func handleChunkDownload(download *download, i int, client *http.Client, bs int) {
-	activeConnections.inc()
-	defer activeConnections.dec()
-
+// handleChunkDownload downloads the chunk until its end, an error or an abort of the connection
+// The connection is aborted when it doesn't receive data for the read timeout or when it is
+// slower than the lowest speed limit.
+func handleChunkDownload(ctx context.Context, download *download, i int, client *http.Client, bs int) {
 	chunk := download.Chunk
-	chunk.Worker = uint32(i)
 
-	if chunk.Total <= chunk.Done {
+	pending, ok := download.File.startChunk(chunk, uint32(i))
+	if !ok {
+		return
+	}
+
+	// The connection is stopped when the file is paused or cancelled
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	untrack, ok := download.File.track(cancel)
+	if !ok {
 		return
 	}
+	defer untrack()
 
+	// HTTP ranges include their last byte
 	req, err := http.NewRequest("GET", download.InputURL, nil)
-	req.Header.Set("Range", "bytes="+strconv.FormatUint(chunk.Start+chunk.Done, 10)+"-"+strconv.FormatUint(chunk.End, 10))
+	if err != nil {
+		cMessages <- NewErrorMessageForFile(download.FileID, "DOWNLOAD", fmt.Sprintf("An error occurred: %v", err.Error()))
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", "bytes="+strconv.FormatUint(pending.Start, 10)+"-"+strconv.FormatUint(pending.End-1, 10))
 
 	for name, value := range goxel.Headers {
 		req.Header.Set(name, value)
 	}
+	for name, value := range download.File.headers {
+		req.Header.Set(name, value)
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println(err.Error())
+		cMessages <- NewWarningMessageForFile(download.FileID, "DOWNLOAD", err.Error())
 		return
 	}
 	defer resp.Body.Close()
 
+	// Temporary errors of the server are retried, the file stops once the chunk is retried too many times
+	if resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		cMessages <- NewWarningMessageForFile(download.FileID, "DOWNLOAD", fmt.Sprintf("A temporary HTTP error occurred: status %v", resp.StatusCode))
+		return
+	}
+
 	if resp.StatusCode > 399 {
 		cMessages <- NewErrorMessageForFile(download.FileID, "DOWNLOAD", fmt.Sprintf("An HTTP error occurred: status %v", resp.StatusCode))
 		return
 	}
 
-	out, err := os.OpenFile(download.OutputPath, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		log.Println(err.Error())
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if err := checkContentRange(resp.Header.Get("Content-Range"), pending, download.File.Size); err != nil {
+			cMessages <- NewErrorMessageForFile(download.FileID, "DOWNLOAD", err.Error())
+			return
+		}
+
+	case http.StatusOK:
+		// The range was ignored and the body starts at the first byte of the file
+		if resp.ContentLength >= 0 && uint64(resp.ContentLength) != download.File.Size {
+			cMessages <- NewErrorMessageForFile(download.FileID, "DOWNLOAD", fmt.Sprintf("The file size changed: %v bytes expected, got %v", download.File.Size, resp.ContentLength))
+			return
+		}
+
+		if pending.Start > 0 {
+			var first bool
+			chunk, first = download.File.downgrade()
+			if first {
+				cMessages <- NewWarningMessageForFile(download.FileID, "DOWNLOAD", "Ranges are not supported by the server, downloading with a single connection")
+			}
+
+			if pending, ok = download.File.startChunk(chunk, uint32(i)); !ok {
+				return
+			}
+
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, int64(pending.Start)); err != nil {
+				cMessages <- NewWarningMessageForFile(download.FileID, "DOWNLOAD", err.Error())
+				return
+			}
+		}
+
+	default:
+		cMessages <- NewErrorMessageForFile(download.FileID, "DOWNLOAD", fmt.Sprintf("Unexpected HTTP status %v", resp.StatusCode))
 		return
 	}
-	defer out.Close()
 
-	out.Seek(int64(chunk.Start+chunk.Done), 0)
+	out := download.File.output()
+	if out == nil {
+		cMessages <- NewWarningMessageForFile(download.FileID, "DOWNLOAD", "Output file is not opened")
+		return
+	}
+
+	watch := watchConnection(cancel, goxel.ReadTimeout, goxel.LowestSpeedLimit, goxel.LowestSpeedWindow)
+	defer watch.stop()
+
+	buf := make([]byte, bs*1024)
+	offset := pending.Start
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			// The download stops at the end of the chunk, which can be shortened by a split
+			m := download.File.writable(chunk, uint32(i), offset, uint64(n))
+			if m == 0 {
+				return
+			}
+
+			// Progress is only increased once the bytes are written to the output file
+			if _, err := out.WriteAt(buf[:m], int64(offset)); err != nil {
+				if isNoSpaceError(err) {
+					download.File.setError(noSpaceMessage)
+					download.File.writeMetadata()
+					cMessages <- NewErrorMessage("DISK", noSpaceMessage)
+					return
+				}
+				cMessages <- NewWarningMessageForFile(download.FileID, "DOWNLOAD", err.Error())
+				return
+			}
+			offset += m
 
-	src := teeReaderFunc(download, resp.Body, chunk)
+			download.File.advance(chunk, m)
+			if m < uint64(n) {
+				return
+			}
+
+			if !watch.received(n) {
+				cMessages <- NewWarningMessageForFile(download.FileID, "DOWNLOAD", fmt.Sprintf("Connection slower than %v/s aborted", humanize.Bytes(goxel.LowestSpeedLimit)))
+				return
+			}
+		}
 
-	size := bs * 1024
-	if l, ok := src.(*io.LimitedReader); ok && int64(size) > l.N {
-		if l.N < 1 {
-			size = 1
-		} else {
-			size = int(l.N)
+		if rerr != nil {
+			if rerr != io.EOF {
+				cMessages <- NewWarningMessageForFile(download.FileID, "DOWNLOAD", rerr.Error())
+			}
+			return
 		}
 	}
-	buf := make([]byte, size)
-	_, err = io.CopyBuffer(out, src, buf)
+}
+
+// checkContentRange verifies the Content-Range of a partial response starts at the requested range
+// A shorter range is accepted, the rest of the chunk is downloaded when it is retried.
+func checkContentRange(value string, requested Range, size uint64) error {
+	r, total, err := parseContentRange(value)
+	if err != nil {
+		return err
+	}
+
+	if total > 0 && total != size {
+		return fmt.Errorf("The file size changed: %v bytes expected, got %v", size, total)
+	}
+
+	if r.Start != requested.Start {
+		return fmt.Errorf("Unexpected range %v, %v was requested", r, requested)
+	}
+	return nil
 }
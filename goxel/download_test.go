@@ -0,0 +1,303 @@
+package goxel
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startContentServer(content []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Now(), bytes.NewReader(content))
+	}))
+}
+
+func TestChunksShareFileHandle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	ts := startContentServer(content)
+	defer ts.Close()
+
+	file := File{
+		URL:    ts.URL,
+		Output: path.Join(dir, "content"),
+		Size:   uint64(len(content)),
+		Chunks: []Chunk{
+			{Range: Range{Start: 0, End: 5000}},
+			{Range: Range{Start: 5000, End: 10000}},
+		},
+	}
+	if err := file.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient()
+	for i := len(file.Chunks) - 1; i >= 0; i-- {
+		handleChunkDownload(context.Background(), &download{Chunk: &file.Chunks[i], File: &file, InputURL: file.URL}, i, client, 1)
+	}
+	file.close()
+
+	for _, chunk := range file.Chunks {
+		if chunk.Remaining() != 0 {
+			t.Error("Chunk should be complete")
+		}
+	}
+
+	b, _ := ioutil.ReadFile(file.Output)
+	if !bytes.Equal(b, content) {
+		t.Error("Downloaded content doesn't match")
+	}
+}
+
+func TestProgressOnlyAfterWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	ts := startContentServer(content)
+	defer ts.Close()
+
+	file := File{
+		URL:    ts.URL,
+		Output: path.Join(dir, "content"),
+		Size:   uint64(len(content)),
+		Chunks: []Chunk{
+			{Range: Range{Start: 0, End: 10000}},
+		},
+	}
+
+	// A read only handle makes all the writes fail
+	ioutil.WriteFile(file.Output, []byte{}, 0644)
+	file.handle, _ = os.Open(file.Output)
+	defer file.close()
+
+	client, _ := NewClient()
+	handleChunkDownload(context.Background(), &download{Chunk: &file.Chunks[0], File: &file, InputURL: file.URL}, 0, client, 1)
+
+	if file.Chunks[0].Done != 0 {
+		t.Error("Progress should not include bytes that were not written")
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	r, total, err := parseContentRange("bytes 100-199/1000")
+	if err != nil || r != (Range{Start: 100, End: 200}) || total != 1000 {
+		t.Error("Content-Range should be parsed", r, total, err)
+	}
+
+	if _, total, err := parseContentRange("bytes 0-99/*"); err != nil || total != 0 {
+		t.Error("Unknown total should be accepted", err)
+	}
+
+	for _, value := range []string{"", "bytes */1000", "bytes 200-100/1000", "bytes 0-1000/1000", "items 0-99/1000"} {
+		if _, _, err := parseContentRange(value); err == nil {
+			t.Error("Content-Range should be invalid:", value)
+		}
+	}
+}
+
+func TestIgnoredRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cMessages = make(chan Message, 10)
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	file := File{
+		URL:    ts.URL,
+		Output: path.Join(dir, "content"),
+		Size:   uint64(len(content)),
+		Chunks: []Chunk{
+			{Range: Range{Start: 0, End: 5000}, Done: 1000},
+			{Range: Range{Start: 5000, End: 10000}},
+		},
+	}
+	if err := file.open(); err != nil {
+		t.Fatal(err)
+	}
+	file.output().WriteAt(content[:1000], 0)
+
+	client, _ := NewClient()
+	handleChunkDownload(context.Background(), &download{Chunk: &file.Chunks[1], File: &file, InputURL: file.URL}, 1, client, 1)
+	file.close()
+
+	if len(cMessages) != 1 || (<-cMessages).Type != Warning {
+		t.Error("Downgrade to a single connection should be notified")
+	}
+
+	if err := file.checkChunks(); err != nil {
+		t.Error(err)
+	}
+
+	for _, chunk := range file.Chunks {
+		if chunk.Remaining() != 0 {
+			t.Error("Chunks should be complete")
+		}
+	}
+
+	b, _ := ioutil.ReadFile(file.Output)
+	if !bytes.Equal(b, content) {
+		t.Error("Downloaded content doesn't match")
+	}
+}
+
+func TestInvalidContentRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cMessages = make(chan Message, 10)
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-4999/10000")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[:5000])
+	}))
+	defer ts.Close()
+
+	file := File{
+		URL:    ts.URL,
+		Output: path.Join(dir, "content"),
+		Size:   uint64(len(content)),
+		Chunks: []Chunk{
+			{Range: Range{Start: 0, End: 5000}},
+			{Range: Range{Start: 5000, End: 10000}},
+		},
+	}
+	if err := file.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+
+	client, _ := NewClient()
+	handleChunkDownload(context.Background(), &download{Chunk: &file.Chunks[1], File: &file, InputURL: file.URL}, 1, client, 1)
+
+	if len(cMessages) != 1 || (<-cMessages).Type != Error {
+		t.Error("Unexpected range should be reported")
+	}
+
+	if file.Chunks[1].Done != 0 {
+		t.Error("Unexpected range should not be written")
+	}
+}
+
+func TestShortContentRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cMessages = make(chan Message, 10)
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 5000-7499/10000")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[5000:7500])
+	}))
+	defer ts.Close()
+
+	file := File{
+		URL:    ts.URL,
+		Output: path.Join(dir, "content"),
+		Size:   uint64(len(content)),
+		Chunks: []Chunk{
+			{Range: Range{Start: 0, End: 5000}},
+			{Range: Range{Start: 5000, End: 10000}},
+		},
+	}
+	if err := file.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+
+	client, _ := NewClient()
+	handleChunkDownload(context.Background(), &download{Chunk: &file.Chunks[1], File: &file, InputURL: file.URL}, 1, client, 1)
+
+	if len(cMessages) != 0 {
+		t.Error("Shorter range should be accepted", (<-cMessages).Content)
+	}
+
+	if file.Chunks[1].Done != 2500 || !file.retry(&file.Chunks[1], 1) {
+		t.Error("Shorter range should be written and the rest retried", file.Chunks[1].Done)
+	}
+
+	if err := checkContentRange("bytes 5000-9999/20000", Range{Start: 5000, End: 10000}, 10000); err == nil {
+		t.Error("Changed size should be refused")
+	}
+}
+
+func TestTemporaryHTTPError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cMessages = make(chan Message, 10)
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "content", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	file := File{
+		URL:    ts.URL,
+		Output: path.Join(dir, "content"),
+		Size:   uint64(len(content)),
+		Chunks: []Chunk{{Range: Range{Start: 0, End: 10000}}},
+	}
+	if err := file.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+
+	client, _ := NewClient()
+	handleChunkDownload(context.Background(), &download{Chunk: &file.Chunks[0], File: &file, InputURL: file.URL}, 1, client, 1)
+
+	if len(cMessages) != 1 || (<-cMessages).Type != Warning {
+		t.Error("Temporary error should be reported as a warning")
+	}
+	if !file.retry(&file.Chunks[0], 1) {
+		t.Error("Chunk should be retried after a temporary error")
+	}
+
+	handleChunkDownload(context.Background(), &download{Chunk: &file.Chunks[0], File: &file, InputURL: file.URL}, 1, client, 1)
+	if file.Chunks[0].Remaining() != 0 || file.failure() != "" {
+		t.Error("Chunk should be downloaded once the server is available", file.Chunks[0].Done)
+	}
+}
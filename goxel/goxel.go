@@ -1,13 +1,13 @@
 package goxel
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"math"
-	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -15,7 +15,6 @@ import (
 	flag "github.com/spf13/pflag"
 )
 
-var activeConnections counter
 var goxel *GoXel
 var cMessages chan Message
 
@@ -26,15 +25,43 @@ const (
 
 // GoXel structure contains all the parameters to be used for the GoXel accelerator
 // Credentials can either be passed in command line arguments or using the following environment variables:
+// - GOXEL_ALLDEBRID_APIKEY
 // - GOXEL_ALLDEBRID_USERNAME
 // - GOXEL_ALLDEBRID_PASSWD
+// - GOXEL_REALDEBRID_TOKEN
+// The debrid credentials and the priority of the providers can also be set in a configuration file.
 type GoXel struct {
 	AlldebridLogin, AlldebridPassword                                 string
+	AlldebridAPIKey, AlldebridKeyFile                                 string
+	AlldebridPIN                                                      bool
+	AlldebridConcurrency                                              int
+	MagnetTimeout                                                     time.Duration
+	RealdebridToken                                                   string
+	DebridConfigFile                                                  string
+	DebridPriority                                                    []string
 	IgnoreSSLVerification, OverwriteOutputFile, Quiet, Scroll, Resume bool
+	Preallocate                                                       bool
 	OutputDirectory, InputFile, Proxy                                 string
+	HTTPProxy, HTTPSProxy, NoProxy                                    string
 	MaxConnections, MaxConnectionsPerFile, BufferSize                 int
+	MaxConcurrentFiles, ProbeConcurrency, MaxConnectionsPerHost       int
+	HostDelay                                                         time.Duration
 	Headers                                                           map[string]string
 	URLs                                                              []string
+	CACertificates, ClientCertificates, ClientKeys                    []string
+	TLSMinVersions, PinnedPublicKeys                                  []string
+	ConnectTimeout, TLSHandshakeTimeout, ResponseHeaderTimeout        time.Duration
+	AllowHTTP2                                                        bool
+	ReadTimeout, LowestSpeedWindow, StallTimeout                      time.Duration
+	LowestSpeedLimit                                                  uint64
+	Controls                                                          bool
+	Preprocessors                                                     []Preprocessor
+	Plugins                                                           []string
+	RewriteRulesFile                                                  string
+	DryRun                                                            bool
+	PluginTimeout                                                     time.Duration
+	session                                                           *session
+	sessionMux                                                        sync.Mutex
 }
 
 // NewGoXel builds a GoXel instance based on the command line arguments
@@ -43,23 +70,63 @@ func NewGoXel() *GoXel {
 
 	flag.IntVarP(&goxel.MaxConnectionsPerFile, "max-conn-file", "m", 4, "Max number of connections per file")
 	flag.IntVar(&goxel.MaxConnections, "max-conn", 8, "Max number of connections")
+	flag.IntVar(&goxel.MaxConnectionsPerHost, "max-conn-per-host", 0, "Max number of connections to a host, 0 for no limit")
+	flag.DurationVar(&goxel.HostDelay, "host-delay", 0, "Minimum delay between two requests sent to a host")
+	flag.IntVar(&goxel.MaxConcurrentFiles, "max-concurrent-files", 0, "Max number of files downloaded at the same time, defaults to the max number of connections")
+	flag.IntVar(&goxel.ProbeConcurrency, "probe-concurrency", defaultProbeConcurrency, "Max number of files whose size is requested and of links debrided at the same time")
 
 	flag.StringVarP(&goxel.InputFile, "file", "f", "", "File containing links to download (1 per line)")
 	flag.StringVarP(&goxel.OutputDirectory, "output", "o", "", "Output directory")
 
 	flag.BoolVar(&goxel.IgnoreSSLVerification, "insecure", false, "Bypass SSL validation")
+
+	var caCerts, clientCerts, clientKeys, tlsMinVersions, pins hostOptionFlag
+	flag.Var(&caCerts, "ca-cert", "PEM file containing the CA certificate(s) to trust, optionally restricted to a host")
+	flag.Var(&clientCerts, "client-cert", "PEM file containing the client certificate, optionally restricted to a host")
+	flag.Var(&clientKeys, "client-key", "PEM file containing the client private key, optionally restricted to a host")
+	flag.Var(&tlsMinVersions, "tls-min-version", "Minimum TLS version (1.0, 1.1, 1.2 or 1.3), optionally restricted to a host")
+	flag.Var(&pins, "pin", "Pinned public key (sha256//<base64 SPKI hash>), optionally restricted to a host")
 	flag.BoolVar(&goxel.OverwriteOutputFile, "overwrite", false, "Overwrite existing file(s)")
+	flag.BoolVar(&goxel.Preallocate, "preallocate", false, "Allocate the disk space of the file(s) before downloading")
+
+	flag.DurationVar(&goxel.ConnectTimeout, "connect-timeout", 30*time.Second, "Timeout for establishing a connection")
+	flag.DurationVar(&goxel.TLSHandshakeTimeout, "tls-handshake-timeout", 10*time.Second, "Timeout for the TLS handshake")
+	flag.DurationVar(&goxel.ResponseHeaderTimeout, "response-header-timeout", 30*time.Second, "Timeout waiting for the response headers")
+	flag.BoolVar(&goxel.AllowHTTP2, "http2", false, "Allow HTTP/2, requests to a host are then multiplexed over a single connection")
+	flag.DurationVar(&goxel.ReadTimeout, "read-timeout", 30*time.Second, "Abort and retry a connection which doesn't receive data for this duration, 0 to disable")
+	lowestSpeedLimit := flag.String("lowest-speed-limit", "", "Abort and retry a connection slower than this speed per second over the lowest speed window (e.g. 50KB)")
+	flag.DurationVar(&goxel.LowestSpeedWindow, "lowest-speed-window", 30*time.Second, "Duration over which the speed of a connection is measured")
+	flag.DurationVar(&goxel.StallTimeout, "stall-timeout", 5*time.Minute, "Abort the downloads when no data is received for this duration, 0 to disable")
 
 	flag.BoolVarP(&goxel.Quiet, "quiet", "q", false, "No stdout output")
-	flag.StringVarP(&goxel.Proxy, "proxy", "p", "", "Proxy string: (http|https|socks5)://0.0.0.0:0000")
+	flag.StringVarP(&goxel.Proxy, "proxy", "p", "", "Proxy string: (http|https|socks5|socks5h)://[user:password@]0.0.0.0:0000, defaults to the HTTP_PROXY, HTTPS_PROXY and ALL_PROXY environment variables")
+	flag.StringVar(&goxel.HTTPProxy, "http-proxy", "", "Proxy string for http:// URLs, overrides --proxy")
+	flag.StringVar(&goxel.HTTPSProxy, "https-proxy", "", "Proxy string for https:// URLs, overrides --proxy")
+	flag.StringVar(&goxel.NoProxy, "no-proxy", "", "Comma separated list of hosts, domains, IPs or CIDRs to reach without proxy, defaults to the NO_PROXY environment variable")
 	flag.IntVar(&goxel.BufferSize, "buffer-size", 256, "Buffer size in KB")
-	flag.BoolVarP(&goxel.Scroll, "scroll", "s", false, "Scroll output instead of in place display")
+	flag.BoolVarP(&goxel.Scroll, "scroll", "s", false, "Print a plain output instead of the full screen interface")
 
 	noresume := flag.Bool("no-resume", false, "Don't resume downloads")
 
+	flag.StringVar(&goxel.AlldebridAPIKey, "alldebrid-apikey", "", "Alldebrid API key, can also be passed in the GOXEL_ALLDEBRID_APIKEY environment variable")
+	flag.BoolVar(&goxel.AlldebridPIN, "alldebrid-pin", false, "Authorize GoXel on Alldebrid with a PIN, the API key is then cached for the next downloads")
+	flag.IntVar(&goxel.AlldebridConcurrency, "alldebrid-concurrency", defaultUnlockConcurrency, "Max number of links unlocked by Alldebrid at the same time")
+	flag.DurationVar(&goxel.MagnetTimeout, "magnet-timeout", defaultMagnetTimeout, "Time given to Alldebrid to download a magnet or a torrent file, 0 for no limit")
 	flag.StringVar(&goxel.AlldebridLogin, "alldebrid-username", "", "Alldebrid username, can also be passed in the GOXEL_ALLDEBRID_USERNAME environment variable")
 	flag.StringVar(&goxel.AlldebridPassword, "alldebrid-password", "", "Alldebrid password, can also be passed in the GOXEL_ALLDEBRID_PASSWD environment variable")
 
+	flag.StringVar(&goxel.RealdebridToken, "realdebrid-token", "", "Real-Debrid API token, can also be passed in the GOXEL_REALDEBRID_TOKEN environment variable")
+
+	flag.StringSliceVar(&goxel.DebridPriority, "debrid-priority", []string{}, "Comma separated debrid providers tried in that order for the links they support, can also be passed in the GOXEL_DEBRID_PRIORITY environment variable (default alldebrid,realdebrid)")
+	flag.StringVar(&goxel.DebridConfigFile, "debrid-config", "", "JSON configuration file of the debrid providers (default $XDG_CONFIG_HOME/goxel/debrid.json)")
+
+	var plugins pluginFlag
+	flag.Var(&plugins, "plugin", "Executable resolving the URLs whose host matches the regular expression, see the README for its JSON protocol")
+	flag.DurationVar(&goxel.PluginTimeout, "plugin-timeout", defaultPluginTimeout, "Time given to a plugin to resolve a URL")
+
+	flag.StringVar(&goxel.RewriteRulesFile, "rewrite-rules", "", "JSON file of the rules rewriting the URLs, see the README for its format")
+	flag.BoolVar(&goxel.DryRun, "dry-run", false, "Print the rewritten URLs without downloading them")
+
 	versionFlag := flag.Bool("version", false, "Version")
 
 	var h headerFlag
@@ -96,21 +163,82 @@ func NewGoXel() *GoXel {
 	// Resume must be inverted
 	goxel.Resume = !*noresume
 
+	if *lowestSpeedLimit != "" {
+		limit, err := humanize.ParseBytes(*lowestSpeedLimit)
+		if err != nil {
+			fmt.Printf("[ERROR] Invalid lowest speed limit [%v]\n", *lowestSpeedLimit)
+			os.Exit(1)
+		}
+		goxel.LowestSpeedLimit = limit
+	}
+
+	goxel.CACertificates = caCerts
+	goxel.ClientCertificates = clientCerts
+	goxel.ClientKeys = clientKeys
+	goxel.TLSMinVersions = tlsMinVersions
+	goxel.PinnedPublicKeys = pins
+	goxel.Plugins = plugins
+
+	goxel.AlldebridKeyFile = defaultKeyFile()
+	if goxel.DebridConfigFile == "" {
+		goxel.DebridConfigFile = defaultDebridConfigFile()
+	}
+	goxel.Controls = true
+
 	return goxel
 }
 
+// holdMessages collects the messages sent while nothing reads them, as while the URLs are preprocessed
+// The returned function stops collecting and queues the messages again in a channel large enough to hold them.
+func holdMessages() func() {
+	stop, held := make(chan bool), make(chan []Message)
+	go func() {
+		var messages []Message
+		for {
+			select {
+			case m := <-cMessages:
+				messages = append(messages, m)
+			case <-stop:
+				for len(cMessages) > 0 {
+					messages = append(messages, <-cMessages)
+				}
+				held <- messages
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		messages := <-held
+
+		cMessages = make(chan Message, len(messages)+100)
+		for _, m := range messages {
+			cMessages <- m
+		}
+	}
+}
+
 // Run starts the downloading process
 func (g *GoXel) Run() {
-	activeConnections = counter{}
+	// The connections and the files read the settings of the running GoXel
+	goxel = g
+
+	hosts = newHostLimiter(g.MaxConnectionsPerHost, g.HostDelay)
 
 	// errors will contain all global errors to be displayed by the monitoring
 	cMessages = make(chan Message, 100)
 
-	if g.IgnoreSSLVerification {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	// Ensure the connection settings are valid before starting anything
+	resetTransport()
+	defer resetTransport()
+
+	if _, err := NewClient(); err != nil {
+		fmt.Printf("[ERROR] %v\n", err.Error())
+		os.Exit(1)
 	}
 
-	urls := BuildURLSlice(g.URLs, g.InputFile)
+	urls, passwords := parseLinkPasswords(BuildURLSlice(g.URLs, g.InputFile))
 	if len(urls) == 0 {
 		return
 	}
@@ -118,54 +246,140 @@ func (g *GoXel) Run() {
 	g.MaxConnections = int(math.Min(float64(g.MaxConnections), float64(g.MaxConnectionsPerFile*len(urls))))
 
 	urlPreprocessors := []URLPreprocessor{&StandardURLPreprocessor{}}
-	if g.AlldebridLogin != "" && g.AlldebridPassword != "" || os.Getenv("GOXEL_ALLDEBRID_USERNAME") != "" && os.Getenv("GOXEL_ALLDEBRID_PASSWD") != "" {
-		var login, password string
-		if g.AlldebridLogin != "" {
-			login = g.AlldebridLogin
-			password = g.AlldebridPassword
-		} else {
-			login = os.Getenv("GOXEL_ALLDEBRID_USERNAME")
-			password = os.Getenv("GOXEL_ALLDEBRID_PASSWD")
-		}
-		urlPreprocessors = append(urlPreprocessors, &AllDebridURLPreprocessor{Login: login, Password: password})
+	rewrite, err := g.rewrite(passwords)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err.Error())
+		os.Exit(1)
+	}
+	if rewrite != nil {
+		urlPreprocessors = append(urlPreprocessors, rewrite)
 	}
 
+	// The dry run stops before the plugins and the debrid services are called
+	if g.DryRun {
+		g.dryRun(urlPreprocessors, urls)
+		return
+	}
+
+	// The messages of the preprocessors are queued again once the monitoring reads them
+	release := holdMessages()
+
+	// The URLs are rewritten before the plugins and the debrid services read the passwords
 	for _, up := range urlPreprocessors {
 		urls = up.process(urls)
 	}
+	rewritten := len(urlPreprocessors)
 
-	results := make([]*File, 0)
-	chunks := make(chan download, len(urls)*g.MaxConnections)
-	done := make(chan bool)
+	plugins, err := g.plugins(passwords)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err.Error())
+		os.Exit(1)
+	}
+	if plugins != nil {
+		urlPreprocessors = append(urlPreprocessors, plugins)
+	}
+	if debrid := g.debrid(passwords); debrid != nil {
+		urlPreprocessors = append(urlPreprocessors, debrid)
+	}
+
+	for _, up := range urlPreprocessors[rewritten:] {
+		urls = up.process(urls)
+	}
+
+	downloads := make([]Download, 0, len(urls))
+	for _, url := range urls {
+		downloads = append(downloads, newDownload(urlPreprocessors, url))
+	}
 
-	var wgP sync.WaitGroup
-	for i, url := range urls {
-		file := File{
-			URL: url,
-			ID:  uint32(i),
+	for _, p := range g.Preprocessors {
+		if downloads, err = p.Preprocess(context.Background(), downloads); err != nil {
+			fmt.Printf("[ERROR] %v\n", err.Error())
+			os.Exit(1)
 		}
+	}
 
-		file.setOutput(g.OutputDirectory, g.OverwriteOutputFile)
+	release()
 
-		wgP.Add(1)
-		go file.BuildChunks(&wgP, chunks, g.MaxConnectionsPerFile)
+	// Files are only probed by the scheduler, until then they are lightweight
+	results := make([]*File, 0, len(downloads))
+	for i, d := range downloads {
+		results = append(results, newFile(uint32(i), d, g.OutputDirectory, g.OverwriteOutputFile))
+	}
 
-		results = append(results, &file)
+	// The sizes announced by the preprocessors are checked before anything is downloaded,
+	// the other files are checked when they start
+	if err := checkDiskSpace(g.OutputDirectory, results, 0); err != nil {
+		fmt.Printf("[ERROR] %v\n", err.Error())
+		return
+	}
+
+	if g.ProbeConcurrency <= 0 {
+		g.ProbeConcurrency = defaultProbeConcurrency
+	}
+	if g.MaxConcurrentFiles <= 0 {
+		g.MaxConcurrentFiles = g.MaxConnections
 	}
 
+	// The rebalancer keeps the queue of chunks, the channel only holds the next ones
+	chunks := make(chan download, g.MaxConnections)
+	done := make(chan bool)
+
 	finished := make(chan header)
-	go RebalanceChunks(finished, chunks, results)
+	complete := make(chan bool)
+	go RebalanceChunks(finished, chunks, results, complete)
+
+	// The watchdog cancels the context to abort the downloads once they are stalled
+	ctx, abort := context.WithCancel(context.Background())
+	defer abort()
 
 	start := time.Now()
 	var wg sync.WaitGroup
 	for i := 0; i < g.MaxConnections; i++ {
 		wg.Add(1)
-		go DownloadWorker(i, &wg, chunks, g.BufferSize, finished)
+		go DownloadWorker(ctx, i, &wg, chunks, g.BufferSize, finished, complete)
+	}
+
+	m := newMonitorer(g.Quiet, g.Scroll, g)
+	m.start()
+	go Monitoring(results, done, complete, m)
+
+	stalled := make(chan bool, 1)
+	go func() {
+		stalled <- Watchdog(results, g.StallTimeout, complete, abort)
+	}()
+
+	g.start(&session{files: results, index: indexFiles(results), headers: finished, complete: complete})
+	defer g.stop()
+
+	// The terminal must be restored before exiting
+	restore := func() {}
+	if g.Controls {
+		// The TUI handles its own keys, the other outputs use the file number commands
+		var keys keyHandler
+		if h, ok := m.(keyHandler); ok {
+			keys = h
+		} else if !g.Quiet && isTerminal(syscall.Stdin) {
+			keys = &commandKeys{g: g}
+		}
+
+		// The screen of the TUI is restored when a second interrupt exits
+		reset := func() {}
+		if t, ok := m.(*TUIMonitoring); ok {
+			reset = t.reset
+		}
+		restore = g.handleControls(complete, keys, reset)
 	}
-	go Monitoring(results, done, chunks, g.Quiet)
+	defer restore()
+
+	scheduled := make(chan bool)
+	go func() {
+		s := &scheduler{g: g, files: results, headers: finished, complete: complete}
+		s.run(ctx)
+		close(scheduled)
+	}()
 
-	wgP.Wait()
 	wg.Wait()
+	<-scheduled
 
 	time.Sleep(1 * time.Second)
 	done <- true
@@ -173,9 +387,24 @@ func (g *GoXel) Run() {
 	var totalBytes uint64
 	for _, f := range results {
 		f.finish()
+		if !f.Finished && f.isValid() {
+			// Persist the progress of incomplete files so they can be resumed
+			f.writeMetadata()
+		}
+		f.close()
 		totalBytes += f.Size - f.Initial
 	}
 
+	restore()
+	m.stop(results)
+
+	if <-stalled {
+		for _, line := range stallReport(results, g.StallTimeout) {
+			fmt.Println(line)
+		}
+		os.Exit(1)
+	}
+
 	if !g.Quiet {
 		fmt.Printf("\nDownloaded %s in %s [%s/s]\n", humanize.Bytes(totalBytes), time.Since(start), humanize.Bytes(uint64(float64(totalBytes)/(float64(time.Since(start)/time.Nanosecond)/1000000000))))
 	}
@@ -0,0 +1,55 @@
+package goxel_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/m1ck43l/goxel/goxel"
+)
+
+// TestExternalRun runs GoXel as an external package would, only with its exported settings
+func TestExternalRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-External") != "1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "external", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	g := &goxel.GoXel{
+		URLs:                  []string{ts.URL + "/external"},
+		Headers:               map[string]string{"X-External": "1"},
+		OutputDirectory:       dir,
+		MaxConnections:        2,
+		MaxConnectionsPerFile: 2,
+		BufferSize:            16,
+		Quiet:                 true,
+		Preprocessors: []goxel.Preprocessor{goxel.PreprocessorFunc(func(ctx context.Context, downloads []goxel.Download) ([]goxel.Download, error) {
+			for i := range downloads {
+				downloads[i].Name = "renamed"
+			}
+			return downloads, nil
+		})},
+	}
+	g.Run()
+
+	if b, _ := ioutil.ReadFile(path.Join(dir, "renamed")); !bytes.Equal(b, content) {
+		t.Error("File should be downloaded with the settings of the running GoXel")
+	}
+}
@@ -1,6 +1,7 @@
 package goxel
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
@@ -8,11 +9,14 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"strings"
 	"testing"
+	"time"
 )
 
 func computeMD5(filename string) (string, error) {
@@ -84,6 +88,8 @@ func TestMain(m *testing.M) {
 	go http.ListenAndServe(":"+port, nil)
 
 	SetupAlldebridTest()
+	SetupMagnetTest()
+	SetupRealDebridTest()
 
 	os.Exit(m.Run())
 }
@@ -268,3 +274,167 @@ func TestNoRange(t *testing.T) {
 		t.Error("Download error")
 	}
 }
+
+func TestPreallocatedRun(t *testing.T) {
+	goxel = &GoXel{
+		URLs:                  []string{"http://" + host + ":" + port + "/25MB"},
+		Headers:               map[string]string{},
+		OutputDirectory:       path.Join(output, "prealloc"),
+		MaxConnections:        4,
+		MaxConnectionsPerFile: 4,
+		Quiet:                 true,
+		BufferSize:            256,
+		Preallocate:           true,
+	}
+	goxel.Run()
+
+	filename := path.Join(output, "prealloc", "25MB")
+
+	info, err := os.Stat(filename)
+	if err != nil || info.Size() != 25000000 {
+		t.Error("Download error")
+	}
+
+	hash, _ := computeMD5(filename)
+	orig, _ := computeMD5(path.Join(output, "25MB"))
+	if hash != orig {
+		t.Error(fmt.Sprintf("Hashes don't match: orig [%s] != downloaded [%v]", orig, hash))
+	}
+}
+
+func TestRunManyWorkers(t *testing.T) {
+	goxel = &GoXel{
+		URLs:                  []string{"http://" + host + ":" + port + "/25MB", "http://" + host + ":" + port + "/30MB", "http://" + host + ":" + port + "/50MB"},
+		Headers:               map[string]string{},
+		OutputDirectory:       path.Join(output, "workers"),
+		MaxConnections:        32,
+		MaxConnectionsPerFile: 16,
+		Quiet:                 true,
+		BufferSize:            16,
+	}
+	goxel.Run()
+
+	for _, suffix := range []string{"25MB", "30MB", "50MB"} {
+		hash, _ := computeMD5(path.Join(output, "workers", suffix))
+		orig, _ := computeMD5(path.Join(output, suffix))
+		if hash != orig {
+			t.Error(fmt.Sprintf("Hashes don't match: orig [%s] != downloaded [%v]", orig, hash))
+		}
+	}
+}
+
+func TestHoldMessages(t *testing.T) {
+	previous := cMessages
+	defer func() { cMessages = previous }()
+
+	cMessages = make(chan Message, 100)
+	release := holdMessages()
+	for i := 0; i < 250; i++ {
+		cMessages <- NewWarningMessage("DEBRID", fmt.Sprintf("Message %v", i))
+	}
+	release()
+
+	if len(cMessages) != 250 || (<-cMessages).Content != "Message 0" {
+		t.Error("Messages sent while preprocessing should be kept in order", len(cMessages))
+	}
+}
+
+func TestPreprocessors(t *testing.T) {
+	var resolved bool
+	goxel = &GoXel{
+		URLs:                  []string{"http://" + host + ":" + port + "/short/img", "http://" + host + ":" + port + "/short/25MB", "http://" + host + ":" + port + "/short/30MB"},
+		Headers:               map[string]string{},
+		OutputDirectory:       path.Join(output, "preprocessors"),
+		MaxConnections:        4,
+		MaxConnectionsPerFile: 4,
+		Quiet:                 true,
+		BufferSize:            256,
+		Preprocessors: []Preprocessor{PreprocessorFunc(func(ctx context.Context, downloads []Download) ([]Download, error) {
+			for i := range downloads {
+				downloads[i].URL = strings.Replace(downloads[i].URL, "/short", "", 1)
+			}
+
+			// The image is only served with the header of its download
+			downloads[0].Name = "pixel.png"
+			downloads[0].Headers = map[string]string{"User-Agent": "GoXel"}
+			downloads[0].Checksum = "md5:38c2ac6022f8ebf983bf5fadb1513b5c"
+
+			url := downloads[1].URL
+			downloads[1].URL = "http://" + host + ":" + port + "/unresolved"
+			downloads[1].Resolve = func(ctx context.Context) (Download, error) {
+				resolved = true
+				return Download{URL: url, Name: "resolved", Size: 25000000}, nil
+			}
+
+			downloads[2].Err = fmt.Errorf("Unknown short link")
+			return downloads, nil
+		})},
+	}
+	goxel.Run()
+
+	if hash, _ := computeMD5(path.Join(output, "preprocessors", "pixel.png")); hash != "38c2ac6022f8ebf983bf5fadb1513b5c" {
+		t.Error("Download should be named and requested with its headers")
+	}
+
+	if info, err := os.Stat(path.Join(output, "preprocessors", "resolved")); !resolved || err != nil || info.Size() != 25000000 {
+		t.Error("Download should be resolved when its file starts")
+	}
+
+	if _, err := os.Stat(path.Join(output, "preprocessors", "30MB")); !os.IsNotExist(err) {
+		t.Error("Download in error should not be downloaded")
+	}
+}
+
+// droppingWriter aborts the connection once limit bytes of the body have been written
+type droppingWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *droppingWriter) Write(b []byte) (int, error) {
+	if len(b) > w.limit {
+		w.ResponseWriter.Write(b[:w.limit])
+		panic(http.ErrAbortHandler)
+	}
+	w.limit -= len(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func TestDroppedConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(&droppingWriter{ResponseWriter: w, limit: 64 * 1024}, r, "dropped", time.Now(), strings.NewReader(string(content)))
+	}))
+	defer ts.Close()
+
+	goxel = &GoXel{
+		URLs:                  []string{ts.URL + "/dropped"},
+		Headers:               map[string]string{},
+		OutputDirectory:       dir,
+		MaxConnections:        4,
+		MaxConnectionsPerFile: 4,
+		Quiet:                 true,
+		BufferSize:            16,
+		Resume:                true,
+	}
+	goxel.Run()
+
+	filename := path.Join(dir, "dropped")
+
+	b, _ := ioutil.ReadFile(filename)
+	if string(b) != string(content) {
+		t.Error("Dropped connections should be resumed until the file is complete")
+	}
+
+	if _, err := os.Stat(filename + "." + workExtension); !os.IsNotExist(err) {
+		t.Error("Metadata should be removed once the file is complete")
+	}
+}
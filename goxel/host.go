@@ -0,0 +1,190 @@
+package goxel
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var hosts *hostLimiter
+
+// hostOf returns the host the URL is downloaded from, an empty string when the URL is invalid
+func hostOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// hostLimiter bounds the number of connections opened to each host and spaces the requests sent to a host
+// A nil hostLimiter doesn't limit anything.
+type hostLimiter struct {
+	max         int
+	delay       time.Duration
+	mux         sync.Mutex
+	connections map[string]int
+	next        map[string]time.Time
+	released    chan struct{}
+}
+
+func newHostLimiter(max int, delay time.Duration) *hostLimiter {
+	return &hostLimiter{
+		max:         max,
+		delay:       delay,
+		connections: make(map[string]int),
+		next:        make(map[string]time.Time),
+		released:    make(chan struct{}, 1),
+	}
+}
+
+// available checks if a connection can be opened to the host
+func (l *hostLimiter) available(host string) bool {
+	if l == nil || l.max <= 0 {
+		return true
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return l.connections[host] < l.max
+}
+
+// reserve takes a connection to the host, it returns false when the host has no connection available
+// The connection must be given back using release.
+func (l *hostLimiter) reserve(host string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.max > 0 && l.connections[host] >= l.max {
+		return false
+	}
+	l.connections[host]++
+	return true
+}
+
+// release gives back a connection to the host and wakes up the rebalancer
+func (l *hostLimiter) release(host string) {
+	if l == nil {
+		return
+	}
+
+	l.mux.Lock()
+	if l.connections[host]--; l.connections[host] <= 0 {
+		delete(l.connections, host)
+	}
+	l.mux.Unlock()
+
+	select {
+	case l.released <- struct{}{}:
+	default:
+	}
+}
+
+// releases returns the channel notified when a connection is released, nil when nothing is limited
+func (l *hostLimiter) releases() chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.released
+}
+
+// wait waits until a request can be sent to the host, the requests to a host are spaced by the delay
+// It returns the error of the context when it is cancelled before.
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	if l == nil || l.delay <= 0 {
+		return nil
+	}
+
+	l.mux.Lock()
+	now := time.Now()
+	at := l.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[host] = at.Add(l.delay)
+	l.mux.Unlock()
+
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fairQueue holds the downloads waiting for a worker with one queue per host
+// The hosts are served in turn, a host is skipped while it has no connection available.
+type fairQueue struct {
+	hosts  []string
+	queues map[string][]download
+	next   int
+	size   int
+}
+
+func (q *fairQueue) push(d download) {
+	if q.queues == nil {
+		q.queues = make(map[string][]download)
+	}
+
+	if _, ok := q.queues[d.Host]; !ok {
+		q.hosts = append(q.hosts, d.Host)
+	}
+	q.queues[d.Host] = append(q.queues[d.Host], d)
+	q.size++
+}
+
+// peek returns the next download whose host has a connection available
+func (q *fairQueue) peek(l *hostLimiter) (download, bool) {
+	for i := range q.hosts {
+		host := q.hosts[(q.next+i)%len(q.hosts)]
+		if l.available(host) {
+			return q.queues[host][0], true
+		}
+	}
+	return download{}, false
+}
+
+// pop removes the download returned by peek, the following host is served next
+func (q *fairQueue) pop(d download) {
+	queue := q.queues[d.Host][1:]
+	q.size--
+
+	idx := 0
+	for i, host := range q.hosts {
+		if host == d.Host {
+			idx = i
+			break
+		}
+	}
+
+	if len(queue) > 0 {
+		q.queues[d.Host] = queue
+		q.next = idx + 1
+	} else {
+		// The host keeps its turn once removed, the following host takes its index
+		delete(q.queues, d.Host)
+		q.hosts = append(q.hosts[:idx], q.hosts[idx+1:]...)
+		q.next = idx
+	}
+
+	if len(q.hosts) > 0 {
+		q.next %= len(q.hosts)
+	} else {
+		q.next = 0
+	}
+}
+
+// len returns the number of downloads waiting
+func (q *fairQueue) len() int {
+	return q.size
+}
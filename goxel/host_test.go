@@ -0,0 +1,139 @@
+package goxel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFairQueue(t *testing.T) {
+	var q fairQueue
+	for _, id := range []string{"a1", "a2", "a3", "b1", "c1"} {
+		q.push(download{Host: id[:1], OutputPath: id})
+	}
+
+	var order []string
+	for q.len() > 0 {
+		d, ok := q.peek(nil)
+		if !ok {
+			t.Fatal("Download should be available")
+		}
+		q.pop(d)
+		order = append(order, d.OutputPath)
+	}
+
+	if strings.Join(order, " ") != "a1 b1 c1 a2 a3" {
+		t.Error("Hosts should be served in turn", order)
+	}
+
+	// Hosts without connection available are skipped
+	l := newHostLimiter(1, 0)
+	q.push(download{Host: "a", OutputPath: "a1"})
+	q.push(download{Host: "b", OutputPath: "b1"})
+	l.reserve("a")
+
+	if d, ok := q.peek(l); !ok || d.OutputPath != "b1" {
+		t.Error("Busy host should be skipped", d)
+	}
+	q.pop(download{Host: "b"})
+	l.reserve("b")
+
+	if _, ok := q.peek(l); ok {
+		t.Error("No download should be available")
+	}
+
+	l.release("a")
+	if d, ok := q.peek(l); !ok || d.OutputPath != "a1" {
+		t.Error("Released host should be served", d)
+	}
+
+	select {
+	case <-l.releases():
+	default:
+		t.Error("Release should be notified")
+	}
+}
+
+func TestHostDelay(t *testing.T) {
+	l := newHostLimiter(0, 50*time.Millisecond)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		l.wait(ctx, "a")
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("Requests to a host should be spaced")
+	}
+
+	start = time.Now()
+	l.wait(ctx, "b")
+	if time.Since(start) > 20*time.Millisecond {
+		t.Error("Other hosts should not wait")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.wait(cancelled, "a"); err == nil {
+		t.Error("Cancelled wait should fail")
+	}
+}
+
+func TestMaxConnectionsPerHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, 512*1024)
+	rand.Read(content)
+
+	first := startConcurrencyServer(content)
+	defer first.Close()
+	second := startConcurrencyServer(content)
+	defer second.Close()
+
+	var urls []string
+	for i := 0; i < 4; i++ {
+		urls = append(urls, fmt.Sprintf("%v/first%d", first.URL, i))
+	}
+	for i := 0; i < 2; i++ {
+		urls = append(urls, fmt.Sprintf("%v/second%d", second.URL, i))
+	}
+
+	g := &GoXel{
+		URLs:                  urls,
+		Headers:               map[string]string{},
+		OutputDirectory:       dir,
+		MaxConnections:        8,
+		MaxConnectionsPerFile: 4,
+		MaxConnectionsPerHost: 2,
+		Quiet:                 true,
+		BufferSize:            16,
+		Resume:                true,
+	}
+	resetTransport()
+	g.Run()
+
+	for _, url := range urls {
+		b, _ := ioutil.ReadFile(path.Join(dir, path.Base(url)))
+		if !bytes.Equal(b, content) {
+			t.Error("File should be downloaded", url)
+		}
+	}
+
+	for _, s := range []*concurrencyServer{first, second} {
+		if s.maxGets > 2 || s.maxGets == 0 {
+			t.Error("Connections to a host should be bounded, got", s.maxGets)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package goxel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// magnetReady is the status code of the magnets whose files are available, the higher codes are errors
+	magnetReady = 4
+	// defaultMagnetTimeout is the time given to AllDebrid to download a magnet
+	defaultMagnetTimeout = time.Hour
+)
+
+// magnetLimits are the upload errors of the users who reached the limits of AllDebrid
+var magnetLimits = map[string]string{
+	"MAGNET_TOO_MANY_ACTIVE": "too many magnets are downloading",
+	"MAGNET_TOO_MANY":        "too many magnets were uploaded",
+	"MAGNET_NO_SERVER":       "no server is available to download the magnet",
+}
+
+// magnetInterval is the delay between two checks of the status of a magnet
+var magnetInterval = 5 * time.Second
+
+// MagnetUploadResponse contains the magnets or the torrent files uploaded to AllDebrid
+type MagnetUploadResponse struct {
+	Magnets []MagnetUpload `json:"magnets"`
+	Files   []MagnetUpload `json:"files"`
+}
+
+// MagnetUpload identifies an uploaded magnet, Error is set when AllDebrid refused it
+type MagnetUpload struct {
+	ID    int64     `json:"id"`
+	Name  string    `json:"name"`
+	Ready bool      `json:"ready"`
+	Error *APIError `json:"error"`
+}
+
+// MagnetStatusResponse contains the status of a magnet
+type MagnetStatusResponse struct {
+	Magnets MagnetStatus `json:"magnets"`
+}
+
+// MagnetStatus is the status of a magnet, the links are set once it is ready
+type MagnetStatus struct {
+	ID         int64        `json:"id"`
+	Filename   string       `json:"filename"`
+	Status     string       `json:"status"`
+	StatusCode int          `json:"statusCode"`
+	Links      []MagnetLink `json:"links"`
+}
+
+// MagnetLink is the link of a file of the magnet, Files is the tree leading to the file
+type MagnetLink struct {
+	Link     string        `json:"link"`
+	Filename string        `json:"filename"`
+	Files    []MagnetEntry `json:"files"`
+}
+
+// MagnetEntry is a directory or a file of the magnet tree
+type MagnetEntry struct {
+	Name    string        `json:"n"`
+	Entries []MagnetEntry `json:"e"`
+}
+
+// torrentFile is a file of a magnet with its path in the torrent
+type torrentFile struct {
+	Link, Path string
+}
+
+// isTorrent checks if the URL is a magnet or a torrent file
+func isTorrent(link string) bool {
+	lower := strings.ToLower(link)
+	return strings.HasPrefix(lower, "magnet:") || strings.HasSuffix(lower, ".torrent")
+}
+
+// entryPath returns the path of the first file of the tree
+func entryPath(entries []MagnetEntry) string {
+	var names []string
+	for len(entries) > 0 {
+		names = append(names, entries[0].Name)
+		entries = entries[0].Entries
+	}
+	return path.Join(names...)
+}
+
+// torrentPath cleans the path of a file of the torrent so it stays in the output directory
+func torrentPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// readTorrent reads a local torrent file or downloads a remote one
+func (s *AllDebridProvider) readTorrent(link string) ([]byte, error) {
+	if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+		return ioutil.ReadFile(link)
+	}
+
+	req, err := s.Client.Get(link)
+	if err != nil {
+		return nil, err
+	}
+	defer req.Body.Close()
+
+	if req.StatusCode > 399 {
+		return nil, fmt.Errorf("HTTP status %d", req.StatusCode)
+	}
+	return ioutil.ReadAll(req.Body)
+}
+
+// upload sends the magnet or the torrent file to AllDebrid and returns the ID of the magnet
+func (s *AllDebridProvider) upload(link string) (int64, error) {
+	var resp MagnetUploadResponse
+	if strings.HasPrefix(strings.ToLower(link), "magnet:") {
+		if err := s.call("/magnet/upload", url.Values{"magnets[]": {link}}, &resp); err != nil {
+			return 0, err
+		}
+	} else {
+		content, err := s.readTorrent(link)
+		if err != nil {
+			return 0, err
+		}
+
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		part, err := w.CreateFormFile("files[]", path.Base(link))
+		if err != nil {
+			return 0, err
+		}
+		part.Write(content)
+		w.Close()
+
+		if err := s.send("POST", "/magnet/upload/file", nil, &body, w.FormDataContentType(), &resp); err != nil {
+			return 0, err
+		}
+	}
+
+	uploads := append(resp.Magnets, resp.Files...)
+	switch {
+	case len(uploads) == 0:
+		return 0, errors.New("no magnet uploaded")
+	case uploads[0].Error != nil:
+		if limit, ok := magnetLimits[uploads[0].Error.Code]; ok {
+			return 0, fmt.Errorf("AllDebrid queue is full, %v: %v", limit, uploads[0].Error.Error())
+		}
+		return 0, uploads[0].Error
+	}
+	return uploads[0].ID, nil
+}
+
+// waitMagnet checks the status of the magnet until its files are available or the magnet timeout expires
+func (s *AllDebridProvider) waitMagnet(ctx context.Context, id int64) (MagnetStatus, error) {
+	parent := ctx
+	if s.MagnetTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.MagnetTimeout)
+		defer cancel()
+	}
+
+	var reported string
+	for {
+		var resp MagnetStatusResponse
+		if err := s.call("/magnet/status", url.Values{"id": {strconv.FormatInt(id, 10)}}, &resp); err != nil {
+			return MagnetStatus{}, err
+		}
+
+		status := resp.Magnets
+		switch {
+		case status.StatusCode == magnetReady:
+			return status, nil
+		case status.StatusCode > magnetReady:
+			return status, errors.New(status.Status)
+		}
+
+		// The monitoring isn't started yet, the changes of status are displayed right away
+		if status.Status != reported {
+			reported = status.Status
+			fmt.Printf("[ALLDEBRID] Magnet [%v]: %v\n", status.Filename, status.Status)
+		}
+
+		timer := time.NewTimer(magnetInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			if parent.Err() == nil {
+				return status, fmt.Errorf("Magnet [%v] is not ready after %v: %v", status.Filename, s.MagnetTimeout, status.Status)
+			}
+			return status, ctx.Err()
+		}
+	}
+}
+
+// expand uploads the magnet or the torrent file and returns its files once they are available
+func (s *AllDebridProvider) expand(ctx context.Context, link string) ([]torrentFile, error) {
+	id, err := s.upload(link)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := s.waitMagnet(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]torrentFile, 0, len(status.Links))
+	for _, l := range status.Links {
+		p := entryPath(l.Files)
+		if p == "" {
+			p = l.Filename
+		}
+		files = append(files, torrentFile{Link: l.Link, Path: torrentPath(p)})
+	}
+	return files, nil
+}
+
+// torrentLinks returns the links of the files of the magnet or the torrent file, they aren't unlocked yet
+// The path of the files in the torrent is kept as their name.
+func (s *AllDebridProvider) torrentLinks(ctx context.Context, link string) ([]string, error) {
+	files, err := s.expand(ctx, link)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	links := make([]string, 0, len(files))
+	for _, f := range files {
+		s.names[f.Link] = f.Path
+		s.pending[f.Link] = true
+		links = append(links, f.Link)
+	}
+	return links, nil
+}
+
+// isPending checks if the link of a magnet file must be unlocked
+func (s *AllDebridProvider) isPending(link string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.pending[link]
+}
+
+// name returns the path of the file of a magnet relative to the output directory, an empty string for the other links
+func (s *AllDebridProvider) name(link string) string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.names[link]
+}
+
+// describe returns the path of the file of a magnet, the size of the files is unknown
+func (s *AllDebridProvider) describe(link string) (string, uint64) {
+	return s.name(link), 0
+}
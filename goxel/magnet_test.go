@@ -0,0 +1,161 @@
+package goxel
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var magnetChecks int32
+
+func SetupMagnetTest() {
+	http.HandleFunc("/v4/magnet/upload", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("magnets[]") {
+		case "magnet:?xt=urn:btih:show":
+			atomic.StoreInt32(&magnetChecks, 0)
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"magnets\": [{\"id\": 1, \"name\": \"Show\", \"ready\": false}]}}")
+		case "magnet:?xt=urn:btih:queued":
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"magnets\": [{\"id\": 4, \"name\": \"Queued\", \"ready\": false}]}}")
+		case "magnet:?xt=urn:btih:full":
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"magnets\": [{\"error\": {\"code\": \"MAGNET_TOO_MANY_ACTIVE\", \"message\": \"Already have maximum allowed active magnets\"}}]}}")
+		case "magnet:?xt=urn:btih:dead":
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"magnets\": [{\"id\": 3, \"name\": \"Dead\", \"ready\": false}]}}")
+		default:
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"magnets\": [{\"error\": {\"code\": \"MAGNET_INVALID_URI\", \"message\": \"Magnet is not valid\"}}]}}")
+		}
+	})
+
+	http.HandleFunc("/v4/magnet/upload/file", func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("files[]")
+		if err != nil || r.Method != "POST" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		if b, _ := ioutil.ReadAll(file); string(b) != "torrent" || header.Filename != "movie.torrent" {
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"files\": [{\"error\": {\"code\": \"MAGNET_INVALID_FILE\", \"message\": \"File is not a valid torrent\"}}]}}")
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"files\": [{\"id\": 2, \"name\": \"movie.torrent\", \"ready\": true}]}}")
+	})
+
+	// The show is ready on the second check, the dead magnet stops on an error
+	http.HandleFunc("/v4/magnet/status", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("id") {
+		case "1":
+			if atomic.AddInt32(&magnetChecks, 1) < 2 {
+				fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"magnets\": {\"id\": 1, \"filename\": \"Show\", \"status\": \"Downloading\", \"statusCode\": 1}}}")
+				return
+			}
+			fmt.Fprintf(w, `{"status":"success", "data": {"magnets": {"id": 1, "filename": "Show", "status": "Ready", "statusCode": 4, "links": [
+				{"link": "http://alldebrid.com/f/episode1", "filename": "episode1.mkv", "files": [{"n": "Show", "e": [{"n": "Season 1", "e": [{"n": "episode1.mkv"}]}]}]},
+				{"link": "http://alldebrid.com/f/escape", "filename": "escape.nfo", "files": [{"n": "..", "e": [{"n": "escape.nfo"}]}]}
+			]}}}`)
+		case "4":
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"magnets\": {\"id\": 4, \"filename\": \"Queued\", \"status\": \"In Queue\", \"statusCode\": 0}}}")
+		case "2":
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"magnets\": {\"id\": 2, \"filename\": \"movie.mkv\", \"status\": \"Ready\", \"statusCode\": 4, \"links\": [{\"link\": \"http://alldebrid.com/f/movie\", \"filename\": \"movie.mkv\"}]}}}")
+		default:
+			fmt.Fprintf(w, "{\"status\":\"success\", \"data\": {\"magnets\": {\"id\": 3, \"filename\": \"Dead\", \"status\": \"Download took more than 72h\", \"statusCode\": 8}}}")
+		}
+	})
+}
+
+func TestMagnet(t *testing.T) {
+	defer func(interval time.Duration) { magnetInterval = interval }(magnetInterval)
+	magnetInterval = 10 * time.Millisecond
+
+	alldebrid := AllDebridProvider{
+		APIKey: "premiumkey",
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+
+	d := debridWith(&alldebrid)
+	urls := d.process([]string{"magnet:?xt=urn:btih:show", "magnet:?xt=urn:btih:dead", "magnet:?xt=urn:btih:invalid", "http://upload.com/test/video.mp4"})
+	if strings.Join(urls, " ") != "http://test.com/episode1 http://test.com/escape http://test.com/ok.mp4" {
+		t.Error("Magnet should be expanded into its unlocked files", urls)
+	}
+
+	// Paths can't leave the output directory
+	if name, _ := d.describe("http://test.com/episode1"); name != "Show/Season 1/episode1.mkv" {
+		t.Error("File should keep its path in the torrent, got", name)
+	}
+	if name, _ := d.describe("http://test.com/escape"); name != "escape.nfo" {
+		t.Error("File should stay in the output directory, got", name)
+	}
+	if name, _ := d.describe("http://test.com/ok.mp4"); name != "" {
+		t.Error("Hoster links should be named after their URL")
+	}
+}
+
+func TestMagnetLimits(t *testing.T) {
+	defer func(interval time.Duration) { magnetInterval = interval }(magnetInterval)
+	magnetInterval = 10 * time.Millisecond
+
+	alldebrid := AllDebridProvider{
+		APIKey:        "premiumkey",
+		MagnetTimeout: 100 * time.Millisecond,
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+
+	start := time.Now()
+	if _, err := alldebrid.torrentLinks(context.Background(), "magnet:?xt=urn:btih:queued"); err == nil || !strings.Contains(err.Error(), "not ready after") {
+		t.Error("Magnet should stop waiting after the timeout", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("Magnet timeout should be respected")
+	}
+
+	if _, err := alldebrid.torrentLinks(context.Background(), "magnet:?xt=urn:btih:full"); err == nil || !strings.Contains(err.Error(), "queue is full") {
+		t.Error("Upload limits should be reported", err)
+	}
+}
+
+func TestTorrentFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "goxel-torrent")
+	defer os.RemoveAll(dir)
+
+	torrent := filepath.Join(dir, "movie.torrent")
+	ioutil.WriteFile(torrent, []byte("torrent"), 0644)
+
+	alldebrid := AllDebridProvider{
+		APIKey: "premiumkey",
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+	d := debridWith(&alldebrid)
+	d.Lazy = true
+
+	urls := d.process([]string{torrent, filepath.Join(dir, "missing.torrent")})
+	if len(urls) != 1 || urls[0] != "http://alldebrid.com/f/movie" {
+		t.Error("Torrent file should be expanded into its files", urls)
+	}
+
+	file := newFile(0, newDownload([]URLPreprocessor{d}, urls[0]), output, false)
+	if file.resolve == nil {
+		t.Fatal("Torrent files should be unlocked when they start")
+	}
+
+	file.unlock(context.Background(), filepath.Join(output, "torrent"), false)
+	if file.URL != "http://test.com/movie" || file.Output != filepath.Join(output, "torrent", "movie.mkv") {
+		t.Error("Torrent file should be unlocked with its name", file.URL, file.Output)
+	}
+}
+
+func TestMagnetWithoutAPIKey(t *testing.T) {
+	alldebrid := AllDebridProvider{
+		Login: "test4",
+	}
+	alldebrid.initialize("http://127.0.0.1:8080")
+
+	if urls := debridWith(&alldebrid).process([]string{"magnet:?xt=urn:btih:show"}); len(urls) != 0 {
+		t.Error("Magnets should require an API key", urls)
+	}
+}
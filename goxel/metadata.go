@@ -0,0 +1,122 @@
+package goxel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// metadataVersion starts the metadata files storing half-open chunk ranges
+// Files written by previous versions start directly with the number of chunks.
+const metadataVersion uint64 = 0x4758000000000002
+
+// chunkRecord is the representation of a Chunk in the metadata file
+type chunkRecord struct {
+	Start, End, Done uint64
+}
+
+// legacyChunkRecord is the representation of a Chunk in the metadata files written by
+// previous versions, the End byte was part of the chunk and the downloaded bytes were not
+// always covered by a chunk
+type legacyChunkRecord struct {
+	ID, Worker              uint32
+	Start, End, Done, Total uint64
+}
+
+// writeMetadata encodes the chunks to w
+func writeMetadata(w io.Writer, chunks []Chunk) error {
+	if err := binary.Write(w, binary.BigEndian, metadataVersion); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint64(len(chunks))); err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		record := chunkRecord{Start: chunk.Start, End: chunk.End, Done: chunk.Done}
+		if err := binary.Write(w, binary.BigEndian, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMetadata decodes the chunks of a file of the given size from r
+func readMetadata(r io.Reader, size uint64) ([]Chunk, error) {
+	var version uint64
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, fmt.Errorf("Can't read metadata: %v", err.Error())
+	}
+
+	if version != metadataVersion {
+		return readLegacyMetadata(r, version, size)
+	}
+
+	var count uint64
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("Can't read metadata: %v", err.Error())
+	}
+
+	var chunks []Chunk
+	for i := uint64(0); i < count; i++ {
+		var record chunkRecord
+		if err := binary.Read(r, binary.BigEndian, &record); err != nil {
+			return nil, fmt.Errorf("Can't read metadata: %v", err.Error())
+		}
+
+		chunks = append(chunks, Chunk{
+			Range: Range{Start: record.Start, End: record.End},
+			Done:  record.Done,
+		})
+	}
+	return chunks, nil
+}
+
+// readLegacyMetadata decodes the count chunks written by previous versions
+// The inclusive ranges are converted and the gaps between them, which were already
+// downloaded, are filled with completed chunks.
+func readLegacyMetadata(r io.Reader, count, size uint64) ([]Chunk, error) {
+	var chunks []Chunk
+	for i := uint64(0); i < count; i++ {
+		var record legacyChunkRecord
+		if err := binary.Read(r, binary.BigEndian, &record); err != nil {
+			return nil, fmt.Errorf("Can't read metadata: %v", err.Error())
+		}
+
+		// Files downloaded without ranges already stored an exclusive End
+		end := record.End + 1
+		if end > size {
+			end = size
+		}
+
+		chunk := Chunk{Range: Range{Start: record.Start, End: end}, Done: record.Done}
+		if chunk.Done > chunk.Len() {
+			chunk.Done = chunk.Len()
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].Start < chunks[j].Start
+	})
+
+	var offset uint64
+	var filled []Chunk
+	for _, chunk := range chunks {
+		if chunk.Start > offset {
+			filled = append(filled, Chunk{Range: Range{Start: offset, End: chunk.Start}, Done: chunk.Start - offset})
+		}
+		filled = append(filled, chunk)
+
+		if chunk.End > offset {
+			offset = chunk.End
+		}
+	}
+
+	if offset < size {
+		filled = append(filled, Chunk{Range: Range{Start: offset, End: size}, Done: size - offset})
+	}
+	return filled, nil
+}
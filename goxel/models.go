@@ -2,7 +2,7 @@ package goxel
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"log"
 	"math"
@@ -13,12 +13,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"unsafe"
+	"time"
 )
 
 const (
 	workExtension = "gx"
 	maxUint32     = ^uint32(0)
+	maxRetries    = 5
 )
 
 // MessageType identifies the severity of the message
@@ -91,74 +92,147 @@ func NewMessageForFile(fileID uint32, context string, content string, t MessageT
 }
 
 // Chunk stores a part of a file being downloaded
+// The chunk covers the half-open Range [Start, End), Done bytes have been written from Start.
+// Resumed is the part of Done that was written during a previous process.
+// Worker is the last worker which started the chunk, only this worker can write it.
 type Chunk struct {
-	ID, Worker              uint32
-	Start, End, Done, Total uint64
+	ID, Worker uint32
+	Range
+	Done, Resumed uint64
+	failures      uint32
 }
 
-func (c *Chunk) Write(b []byte) (int, error) {
-	n := len(b)
-	c.Done += uint64(n)
-	return n, nil
+// Next returns the offset of the next byte to download
+func (c *Chunk) Next() uint64 {
+	return c.Start + c.Done
 }
 
-// BuildProgress builds the progress display for a specific Chunk
-// "-" means downloaded during this process
-// " " means not yet downloaded
-func (c *Chunk) BuildProgress(buf []string, unit float64) {
-	if c.End <= c.Start {
-		return
+// Remaining returns the number of bytes left to download
+func (c *Chunk) Remaining() uint64 {
+	if c.Done >= c.Len() {
+		return 0
 	}
+	return c.Len() - c.Done
+}
 
-	rng := int(float64(c.End-c.Start)*unit) + 1
-	offset := int(float64(c.Start) * unit)
+// Pending returns the range of bytes left to download
+func (c *Chunk) Pending() Range {
+	return Range{Start: c.Start + c.Len() - c.Remaining(), End: c.End}
+}
 
-	for j := 0; j < int(math.Min(float64(c.Done)*unit, float64(rng)-1)); j++ {
-		buf[offset+j] = "-"
+// check verifies the invariants of the chunk
+func (c *Chunk) check() error {
+	if err := c.Range.check(); err != nil {
+		return err
 	}
 
-	if offset+int(math.Max(math.Min(float64(c.Done)*unit, float64(rng)-1), 0)) >= len(buf) {
-		// Progress is already done, do not add worker ID
-		return
+	if c.Done > c.Len() {
+		return fmt.Errorf("Chunk %v has %d bytes done for %d bytes", c.Range, c.Done, c.Len())
+	}
+
+	if c.Resumed > c.Done {
+		return fmt.Errorf("Chunk %v has %d bytes resumed for %d bytes done", c.Range, c.Resumed, c.Done)
 	}
+	return nil
+}
 
-	buf[offset+int(math.Max(math.Min(float64(c.Done)*unit, float64(rng)-1), 0))] = fmt.Sprintf("%d", c.Worker)
+// workerSymbols are the characters showing the worker downloading a chunk
+const workerSymbols = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
-	for j := int(math.Max(math.Min(float64(c.Done)*unit, float64(rng)-1), 0)) + 1; j < rng; j++ {
-		if offset+j >= len(buf) {
-			break
+// BuildProgress builds the progress display for a specific Chunk
+// "+" means downloaded during a previous process
+// "-" means downloaded during this process
+// " " means not yet downloaded
+// The character j of the display shows the byte j/unit, so the chunks of a file never draw the same character.
+func (c *Chunk) BuildProgress(buf []byte, unit float64) {
+	if c.Len() == 0 {
+		return
+	}
+
+	from := int(math.Ceil(float64(c.Start) * unit))
+	to := int(math.Ceil(float64(c.End) * unit))
+	resumed := int(math.Ceil(float64(c.Start+c.Resumed) * unit))
+	next := int(math.Ceil(float64(c.Next()) * unit))
+
+	for j := from; j < to && j < len(buf); j++ {
+		switch {
+		case j < resumed:
+			buf[j] = '+'
+		case j < next:
+			buf[j] = '-'
+		case j == next && c.Remaining() > 0:
+			buf[j] = workerSymbols[c.Worker%uint32(len(workerSymbols))]
+		default:
+			buf[j] = ' '
 		}
-		buf[offset+j] = " "
 	}
 }
 
 // File stores a file to be downloaded
+// Once the download has started, the chunks, the status and the output handle are shared between
+// the workers and the monitoring: they must be accessed using the File's methods which hold the Mux.
+// The revision is increased each time the chunks change, the monitoring only reads the files which progressed.
 type File struct {
 	URL, Output, OutputWork      string
 	Chunks                       []Chunk
 	Finished, Valid, Initialized bool
 	Error                        string
 	Size, Initial                uint64
-	Progress                     []string
+	Progress                     []byte
 	Mux                          sync.Mutex
 	ID                           uint32
+	rangeless, paused, removed   bool
+	revision                     uint64
+	progressChunks               []Chunk
+	connections                  map[uint64]context.CancelFunc
+	connectionID                 uint64
+	handle                       *os.File
+	metadataMux                  sync.Mutex
+	resolve                      func(ctx context.Context) (Download, error)
+	name                         string
+	expected                     uint64
+	headers                      map[string]string
+	checksum                     string
 }
 
+// header identifies a chunk whose download stopped
+// Retry is set when the chunk is incomplete and must be queued again.
 type header struct {
 	FileID, ChunkID uint32
+	Retry           bool
 }
 
+// checkName checks the output path announced for a file, it must be relative and can't go up a directory
+func checkName(name string) error {
+	if path.IsAbs(name) || strings.HasPrefix(name, "\\") {
+		return fmt.Errorf("Invalid file name [%v]: absolute paths are not allowed", name)
+	}
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return fmt.Errorf("Invalid file name [%v]: the file must stay in the output directory", name)
+		}
+	}
+	return nil
+}
+
+// setOutput sets the output of the file in the directory, the name is cleaned so the file stays in the directory
 func (f *File) setOutput(directory string, OverwriteOutputFile bool) {
-	if directory != "" {
-		err := os.MkdirAll(directory, 0755)
+	// The name keeps the path of the file in its torrent
+	name := torrentPath(path.Base(f.URL))
+	if f.name != "" {
+		name = torrentPath(f.name)
+	}
+	if name == "" {
+		name = "download"
+	}
+	f.Output = path.Join(directory, name)
+
+	if dir := path.Dir(f.Output); dir != "." {
+		err := os.MkdirAll(dir, 0755)
 		if err != nil {
-			fmt.Printf("[ERROR] Can't create directory [%v]\n", directory)
+			fmt.Printf("[ERROR] Can't create directory [%v]\n", dir)
 			os.Exit(1)
 		}
-
-		f.Output = path.Join(directory, path.Base(f.URL))
-	} else {
-		f.Output = path.Base(f.URL)
 	}
 
 	initialOutput := f.Output
@@ -187,48 +261,199 @@ func (f *File) setOutput(directory string, OverwriteOutputFile bool) {
 // "-" means downloaded during this process
 // " " means not yet downloaded
 // "+" means already downloaded during a previous process (resumed)
-func (f *File) BuildProgress(unit float64) string {
+// Only the chunks which changed since the previous call are drawn again, the returned
+// slice is reused by the next call.
+func (f *File) BuildProgress(unit float64) []byte {
 	rng := int(float64(f.Size) * unit)
 
-	if !f.Initialized {
-		f.Progress = make([]string, rng)
-		for i := 0; i < rng; i++ {
-			f.Progress[i] = "+"
+	// The progress is rebuilt when the width changes
+	if !f.Initialized || len(f.Progress) != rng {
+		f.Progress = make([]byte, rng)
+		for i := range f.Progress {
+			f.Progress[i] = '+'
 		}
+		f.progressChunks = nil
 		f.Initialized = true
 	}
 
-	for _, chunk := range f.Chunks {
-		chunk.BuildProgress(f.Progress, unit)
+	chunks := f.snapshot()
+	for i := range chunks {
+		if i < len(f.progressChunks) && f.progressChunks[i] == chunks[i] {
+			continue
+		}
+		chunks[i].BuildProgress(f.Progress, unit)
+	}
+	f.progressChunks = chunks
+
+	return f.Progress
+}
+
+// snapshot returns a copy of the chunks that can be read while the download is running
+func (f *File) snapshot() []Chunk {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	chunks := make([]Chunk, len(f.Chunks))
+	copy(chunks, f.Chunks)
+	return chunks
+}
+
+// setError marks the file in error
+func (f *File) setError(message string) {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	f.Error = message
+}
+
+// failure returns the error message of the file, it is empty when the file is not in error
+func (f *File) failure() string {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	return f.Error
+}
+
+// isFinished checks if the file has been completely downloaded
+func (f *File) isFinished() bool {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	return f.Finished
+}
+
+// startChunk attributes the chunk to the worker
+// It returns the range of bytes left to download, ok is false when there is nothing to download.
+func (f *File) startChunk(c *Chunk, worker uint32) (pending Range, ok bool) {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	if c.Worker != worker {
+		c.Worker = worker
+		f.revision++
+	}
+	if c.Remaining() == 0 || f.Error != "" || f.paused {
+		return Range{}, false
+	}
+	return c.Pending(), true
+}
+
+// writable returns how many of the n bytes read at offset belong to the chunk
+// A split can shorten the chunk while it is downloaded, the bytes past its end belong to another chunk.
+// Nothing is writable once another worker took the chunk over.
+func (f *File) writable(c *Chunk, worker uint32, offset, n uint64) uint64 {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	if c.Worker != worker || !c.Contains(offset) || offset != c.Next() {
+		return 0
+	}
+	if offset+n > c.End {
+		return c.End - offset
+	}
+	return n
+}
+
+// advance increases the progress of the chunk with bytes written to the output file
+func (f *File) advance(c *Chunk, n uint64) {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	if n > c.Remaining() {
+		n = c.Remaining()
+	}
+	c.Done += n
+
+	if n > 0 {
+		c.failures = 0
+		f.revision++
+	}
+}
+
+// retry checks if the chunk must be downloaded again once the worker stopped downloading it
+// The file is marked in error when the chunk failed maxRetries times in a row without progress.
+func (f *File) retry(c *Chunk, worker uint32) bool {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	// Paused chunks are queued again once the file is resumed
+	if f.Error != "" || f.paused || c.Worker != worker || c.Remaining() == 0 {
+		return false
 	}
 
-	return strings.Join(f.Progress, "")
+	c.failures++
+	if c.failures > maxRetries {
+		f.Error = fmt.Sprintf("Download stopped %v times at byte %v", maxRetries, c.Next())
+		return false
+	}
+	return true
+}
+
+// retryDelay returns how long to wait before retrying the chunk, the first retry is immediate
+func (f *File) retryDelay(c *Chunk) time.Duration {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	if c.failures == 0 {
+		return 0
+	}
+	return time.Duration(c.failures-1) * time.Second
+}
+
+// chunk returns the chunk identified by id, nil if the file has no such chunk
+func (f *File) chunk(id uint32) *Chunk {
+	for i := range f.Chunks {
+		if f.Chunks[i].ID == id {
+			return &f.Chunks[i]
+		}
+	}
+	return nil
+}
+
+// checkChunks verifies the invariants of every chunk and that the chunks tile the whole file
+func (f *File) checkChunks() error {
+	return checkChunks(f.snapshot(), f.Size)
+}
+
+func checkChunks(chunks []Chunk, size uint64) error {
+	ranges := make([]Range, len(chunks))
+	for i, chunk := range chunks {
+		if err := chunk.check(); err != nil {
+			return err
+		}
+		ranges[i] = chunk.Range
+	}
+	return checkTiling(ranges, size)
 }
 
 func (f *File) writeMetadata() {
-	if f.Finished {
+	if !goxel.Resume || f.isFinished() {
 		return
 	}
 
-	f.Valid = true
+	// Metadata must not be written while the file is being finished
+	f.metadataMux.Lock()
+	defer f.metadataMux.Unlock()
 
-	if !goxel.Resume {
+	var buf bytes.Buffer
+	if err := writeMetadata(&buf, f.snapshot()); err != nil {
+		log.Println(err.Error())
 		return
 	}
 
-	file, err := os.OpenFile(f.OutputWork, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+	// Progress is only increased once the bytes are written, syncing the output after
+	// taking the snapshot ensures the metadata never runs ahead of the data on disk
+	if err := f.sync(); err != nil {
 		log.Println(err.Error())
 		return
 	}
-	defer file.Close()
-
-	var buf bytes.Buffer
-	binary.Write(&buf, binary.BigEndian, uint64(len(f.Chunks)))
 
-	for _, chunk := range f.Chunks {
-		binary.Write(&buf, binary.BigEndian, chunk)
+	file, err := os.OpenFile(f.OutputWork, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Println(err.Error())
+		return
 	}
+	defer file.Close()
 
 	_, err = file.Write(buf.Bytes())
 	if err != nil {
@@ -237,61 +462,193 @@ func (f *File) writeMetadata() {
 }
 
 func (f *File) finish() {
-	if f.Finished || f.Error != "" {
+	if f.isFinished() || f.failure() != "" {
 		return
 	}
+
+	f.metadataMux.Lock()
+	defer f.metadataMux.Unlock()
+
+	if err := f.close(); err != nil {
+		f.setError(fmt.Sprintf("Can't write file: %v", err.Error()))
+		return
+	}
+
+	// The metadata is kept until the file on disk is known to be complete
+	if err := f.checkSize(); err != nil {
+		f.setError(err.Error())
+		return
+	}
+	if err := f.checkChecksum(); err != nil {
+		f.setError(err.Error())
+		return
+	}
+
+	f.Mux.Lock()
 	f.Finished = true
+	f.Mux.Unlock()
 
 	_ = os.Remove(f.OutputWork)
 }
 
-func (f *File) splitChunkInPlace(baseChunk *Chunk, id uint32) *Chunk {
+// rebalance splits the chunk having the most remaining bytes to help it
+// The new part replaces the completed chunk identified by id, nil is returned when no chunk is worth splitting.
+func (f *File) rebalance(id uint32) *Chunk {
 	f.Mux.Lock()
 	defer f.Mux.Unlock()
 
-	remainingPerChunk := (baseChunk.End - baseChunk.Start - baseChunk.Done) / 2
+	if f.rangeless || f.paused {
+		return nil
+	}
 
+	remaining := f.Size
+
+	idx := -1
 	for i, chunk := range f.Chunks {
-		if chunk.ID != uint32(id) {
+		if chunk.Remaining() > uint64(0.1*float64(f.Size)) && remaining > chunk.Remaining() {
+			remaining = chunk.Remaining()
+			idx = i
+		}
+	}
+
+	if idx == -1 {
+		return nil
+	}
+	return f.splitChunkInPlace(&f.Chunks[idx], id)
+}
+
+// splitChunkInPlace must be called with the Mux held
+func (f *File) splitChunkInPlace(baseChunk *Chunk, id uint32) *Chunk {
+	if baseChunk.Remaining() < 2 {
+		return nil
+	}
+
+	for i := range f.Chunks {
+		chunk2 := &f.Chunks[i]
+		if chunk2.ID != id {
 			continue
 		}
 
-		chunk2 := Chunk{
-			Start:  baseChunk.End - remainingPerChunk + 1,
-			End:    baseChunk.End,
-			Worker: 0,
-			Done:   0,
-			Total:  remainingPerChunk,
-			ID:     chunk.ID,
+		// Only a completed chunk can be replaced without losing data, its bytes
+		// are given to a neighbour so the chunks still cover the whole file
+		if chunk2 == baseChunk || chunk2.Remaining() > 0 || !f.absorb(i) {
+			return nil
 		}
-		f.Chunks[i] = chunk2
 
-		baseChunk.End -= remainingPerChunk
-		baseChunk.Total = baseChunk.End - baseChunk.Start
+		tail, _ := baseChunk.split()
+
+		// The ID is left unchanged as it is read by the worker without holding the Mux
+		chunk2.Range = tail.Range
+		chunk2.Worker = 0
+		chunk2.Done = 0
+		chunk2.Resumed = 0
+		chunk2.failures = 0
+		f.revision++
 
-		return &f.Chunks[i]
+		return chunk2
 	}
 	return nil
 }
 
-func (f *File) splitChunk(baseChunk *Chunk) Chunk {
+// absorb merges the completed chunk at index i into a neighbour, it must be called with the Mux held
+// The next chunk can always take it as downloaded bytes at its beginning, the previous one only
+// when it is also completed. The chunk at index i is left untouched, ok is false when no neighbour can take it.
+func (f *File) absorb(i int) bool {
+	completed := f.Chunks[i]
+
+	for j := range f.Chunks {
+		next := &f.Chunks[j]
+		if j == i || next.Start != completed.End {
+			continue
+		}
+
+		next.Range, _ = next.Merge(completed.Range)
+		next.Done += completed.Len()
+		next.Resumed += completed.Resumed
+		return true
+	}
+
+	for j := range f.Chunks {
+		previous := &f.Chunks[j]
+		if j == i || previous.End != completed.Start || previous.Remaining() > 0 {
+			continue
+		}
+
+		previous.Range, _ = previous.Merge(completed.Range)
+		previous.Done += completed.Len()
+		previous.Resumed += completed.Resumed
+		return true
+	}
+	return false
+}
+
+// downgrade merges the chunks so the file is downloaded by a single connection from its first byte
+// It is used once the server has ignored a range: the downloaded bytes following the first
+// byte are kept and the other chunks are emptied. The returned chunk covers the whole file,
+// first is true for the call which downgraded the file.
+func (f *File) downgrade() (chunk *Chunk, first bool) {
 	f.Mux.Lock()
 	defer f.Mux.Unlock()
 
-	remainingPerChunk := (baseChunk.End - baseChunk.Start - baseChunk.Done) / 2
+	if !f.rangeless {
+		f.rangeless = true
+		first = true
 
-	chunk2 := Chunk{
-		Start:  baseChunk.End - remainingPerChunk + 1,
-		End:    baseChunk.End,
-		Worker: 0,
-		Done:   0,
-		Total:  remainingPerChunk,
+		sorted := make([]Chunk, len(f.Chunks))
+		copy(sorted, f.Chunks)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].Start < sorted[j].Start
+		})
+
+		var done, resumed uint64
+		for _, c := range sorted {
+			done += c.Done
+			resumed += c.Resumed
+			if c.Remaining() > 0 {
+				break
+			}
+		}
+
+		for i := range f.Chunks {
+			f.Chunks[i].Range = Range{Start: f.Size, End: f.Size}
+			f.Chunks[i].Done = 0
+			f.Chunks[i].Resumed = 0
+		}
+
+		f.Chunks[0].Range = Range{Start: 0, End: f.Size}
+		f.Chunks[0].Done = done
+		f.Chunks[0].Resumed = resumed
+		f.revision++
+	}
+
+	for i := range f.Chunks {
+		if f.Chunks[i].Start == 0 {
+			return &f.Chunks[i], first
+		}
+	}
+	return &f.Chunks[0], first
+}
+
+// split cuts the bytes left to download in two halves
+// The chunk keeps the first half and the second half is returned, ok is false when less than 2 bytes are left.
+func (c *Chunk) split() (Chunk, bool) {
+	pending := c.Pending()
+	if pending.Len() < 2 {
+		return Chunk{}, false
 	}
 
-	baseChunk.End -= remainingPerChunk
-	baseChunk.Total = baseChunk.End - baseChunk.Start + 1
+	head, tail := pending.Split(pending.Start + pending.Len()/2)
+	c.End = head.End
 
-	return chunk2
+	return Chunk{Range: tail}, true
+}
+
+// remaining returns the number of bytes left to download
+func (f *File) remaining() (remaining uint64) {
+	for _, chunk := range f.snapshot() {
+		remaining += chunk.Remaining()
+	}
+	return remaining
 }
 
 // UpdateStatus returns the current status of the download
@@ -301,19 +658,18 @@ func (f *File) splitChunk(baseChunk *Chunk) Chunk {
 // The last returned value is the number of bytes downloaded during this session
 func (f *File) UpdateStatus(commit bool) (float64, uint64, uint64, uint64) {
 	var remaining, total, conn uint64
-	for i := 0; i < len(f.Chunks); i++ {
-		v := f.Chunks[i]
-		remaining += v.End - v.Start - v.Done
-		total += v.Total
+	for _, v := range f.snapshot() {
+		remaining += v.Remaining()
+		total += v.Len() - v.Resumed
 
-		if v.Done < v.Total && v.Done > 0 {
+		if v.Remaining() > 0 && v.Done > v.Resumed {
 			conn++
 		}
 	}
 
 	done := f.Size - remaining
-	if !f.Finished {
-		if done >= f.Size && done > 0 {
+	if !f.isFinished() {
+		if remaining == 0 && f.Valid {
 			f.finish()
 		}
 
@@ -331,100 +687,66 @@ func (f *File) UpdateStatus(commit bool) (float64, uint64, uint64, uint64) {
 }
 
 // ResumeChunks tries to resume the current download by checking if the file exists and is valid
+// The chunks read from the metadata file must cover the whole file, otherwise the download starts over.
 func (f *File) ResumeChunks(maxConnPerFile int) bool {
 	if !goxel.Resume {
 		return false
 	}
 
-	if _, err := os.Stat(f.OutputWork); !os.IsNotExist(err) {
-		var initial []Chunk
-
-		file, err := os.Open(f.OutputWork)
-		if err != nil {
+	file, err := os.Open(f.OutputWork)
+	if err != nil {
+		if !os.IsNotExist(err) {
 			log.Println(err.Error())
-			return false
 		}
-		defer file.Close()
+		return false
+	}
+	defer file.Close()
 
-		// Read initial number of chunks
-		rbytes := make([]byte, 8)
-		_, err = file.Read(rbytes)
-		if err != nil {
-			return false
-		}
+	chunks, err := readMetadata(file, f.Size)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
 
-		var initialSize uint64
-		buf := bytes.NewBuffer(rbytes)
-		err = binary.Read(buf, binary.BigEndian, &initialSize)
-		if err != nil {
-			return false
-		}
+	if err := checkChunks(chunks, f.Size); err != nil {
+		log.Printf("Invalid metadata for %v, the download starts over: %v\n", f.Output, err.Error())
+		return false
+	}
 
-		initial = make([]Chunk, initialSize)
-		for i := 0; uint64(i) < initialSize; i++ {
-			rbytes = make([]byte, unsafe.Sizeof(Chunk{}))
-			_, err := file.Read(rbytes)
-			if err != nil {
-				return false
-			}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].Start < chunks[j].Start
+	})
 
-			initial[i] = Chunk{}
-			buf := bytes.NewBuffer(rbytes)
-			err = binary.Read(buf, binary.BigEndian, &initial[i])
-			if err != nil {
-				return false
-			}
-		}
+	for i := range chunks {
+		chunks[i].Worker = uint32(i)
+		chunks[i].Resumed = chunks[i].Done
+		f.Initial += chunks[i].Done
+	}
+	f.Chunks = chunks
 
-		sort.SliceStable(initial, func(i, j int) bool {
-			return initial[i].Start < initial[j].Start
+	// Re-arrange depending on max-conn-file input
+	// Only adding connections is supported
+	for len(f.Chunks) < maxConnPerFile {
+		sort.SliceStable(f.Chunks, func(i, j int) bool {
+			return f.Chunks[i].Remaining() > f.Chunks[j].Remaining()
 		})
 
-		f.Chunks = make([]Chunk, len(initial))
-		for i := 0; i < len(initial); i++ {
-			f.Initial += initial[i].Done
-
-			f.Chunks[i] = Chunk{
-				Start:  initial[i].Start + initial[i].Done,
-				End:    initial[i].End,
-				Worker: uint32(i),
-				Done:   0,
-				Total:  initial[i].Total - initial[i].Done,
-			}
-		}
-
-		// Re-arrange depending on max-conn-file input
-		// Only adding connections is supported
-		if maxConnPerFile > len(f.Chunks) {
-			sort.SliceStable(f.Chunks, func(i, j int) bool {
-				return f.Chunks[i].Total > f.Chunks[j].Total
-			})
-
-			for diff := maxConnPerFile - len(f.Chunks); diff > 0; diff-- {
-				e2 := f.splitChunk(&f.Chunks[0])
-
-				f.Chunks = append(f.Chunks, e2)
-
-				sort.SliceStable(f.Chunks, func(i, j int) bool {
-					return f.Chunks[i].Total > f.Chunks[j].Total
-				})
-			}
+		chunk2, ok := f.Chunks[0].split()
+		if !ok {
+			break
 		}
-
-		return true
+		f.Chunks = append(f.Chunks, chunk2)
 	}
 
-	return false
+	return true
 }
 
 // BuildChunks builds the Chunks slice for each part of the file to be downloaded
 // It retrieves existing metadata file in order to resume downloads.
-// Each created chunk is sent to the channel past in parameters.
 // The nbrPerFile parameter determines the max number of splits for each file. In case the download
 // is being resumed, the nbrPerFile is ignored in favor of the number stored in the metadata file.
-func (f *File) BuildChunks(wg *sync.WaitGroup, chunks chan download, nbrPerFile int) {
-	defer wg.Done()
-
+// The file must not be shared yet, probe builds the chunks of a file being monitored.
+func (f *File) BuildChunks(ctx context.Context, nbrPerFile int) {
 	client, err := NewClient()
 	if err != nil {
 		fmt.Printf(err.Error())
@@ -436,10 +758,19 @@ func (f *File) BuildChunks(wg *sync.WaitGroup, chunks chan download, nbrPerFile
 		f.Error = fmt.Sprintf("An error occurred: %v", err.Error())
 		return
 	}
+	req = req.WithContext(ctx)
+
+	if err := hosts.wait(ctx, hostOf(f.URL)); err != nil {
+		f.Error = fmt.Sprintf("An error occurred: %v", err.Error())
+		return
+	}
 
 	for name, value := range goxel.Headers {
 		req.Header.Set(name, value)
 	}
+	for name, value := range f.headers {
+		req.Header.Set(name, value)
+	}
 
 	head, err := client.Do(req)
 	if err != nil {
@@ -468,46 +799,188 @@ func (f *File) BuildChunks(wg *sync.WaitGroup, chunks chan download, nbrPerFile
 			f.Chunks = make([]Chunk, 1)
 
 			f.Chunks[0] = Chunk{
-				Start: 0,
-				Done:  0,
-				End:   contentLength,
-				Total: contentLength,
+				Range: Range{Start: 0, End: contentLength},
 			}
+			f.rangeless = true
 		} else {
 			buildRootChunks(f, nbrPerFile)
 		}
 	}
-	f.writeMetadata()
-
 	for i := 0; i < len(f.Chunks); i++ {
 		f.Chunks[i].ID = uint32(i)
-		chunks <- download{
-			Chunk:      &f.Chunks[i],
-			InputURL:   f.URL,
-			OutputPath: f.Output,
-			FileID:     f.ID,
+	}
+
+	if err := f.checkChunks(); err != nil {
+		f.Error = fmt.Sprintf("Invalid chunks: %v", err.Error())
+		return
+	}
+
+	f.Valid = true
+	f.writeMetadata()
+}
+
+// newFile builds the file of a download, the file is in error when the download is in error
+// or when it announces a name leaving the output directory or an invalid checksum.
+func newFile(id uint32, d Download, directory string, overwrite bool) *File {
+	file := &File{
+		URL:      d.URL,
+		ID:       id,
+		resolve:  d.Resolve,
+		expected: d.Size,
+		headers:  d.Headers,
+		checksum: d.Checksum,
+	}
+
+	nameErr := checkName(d.Name)
+	if nameErr == nil {
+		file.name = d.Name
+	}
+	file.setOutput(directory, overwrite)
+
+	if d.Err != nil {
+		file.Error = d.Err.Error()
+	} else if nameErr != nil {
+		file.Error = nameErr.Error()
+	} else if _, _, err := parseChecksum(d.Checksum); err != nil {
+		file.Error = err.Error()
+	}
+	return file
+}
+
+// unlock resolves the URL of the file before it is probed, the output follows the resolved URL
+// The file is marked in error when its URL can't be resolved. The empty fields of the resolved
+// download keep the value of the file.
+func (f *File) unlock(ctx context.Context, directory string, overwrite bool) {
+	if f.resolve == nil {
+		return
+	}
+
+	d, err := f.resolve(ctx)
+	if err == nil && d.Err != nil {
+		err = d.Err
+	}
+	if err == nil {
+		err = checkName(d.Name)
+	}
+	if err == nil {
+		_, _, err = parseChecksum(d.Checksum)
+	}
+	if err != nil {
+		f.setError(err.Error())
+		return
+	}
+
+	resolved := &File{URL: d.URL, name: f.name, expected: f.expected, headers: f.headers, checksum: f.checksum}
+	if d.Name != "" {
+		resolved.name = d.Name
+	}
+	if d.Size != 0 {
+		resolved.expected = d.Size
+	}
+	if len(d.Headers) > 0 {
+		resolved.headers = make(map[string]string, len(f.headers)+len(d.Headers))
+		for name, value := range f.headers {
+			resolved.headers[name] = value
+		}
+		for name, value := range d.Headers {
+			resolved.headers[name] = value
 		}
 	}
+	if d.Checksum != "" {
+		resolved.checksum = d.Checksum
+	}
+	resolved.setOutput(directory, overwrite)
+
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	f.URL, f.Output, f.OutputWork = resolved.URL, resolved.Output, resolved.OutputWork
+	f.name, f.expected, f.headers, f.checksum = resolved.name, resolved.expected, resolved.headers, resolved.checksum
+	f.revision++
+}
+
+// probe builds the chunks of the file while it is monitored
+// The chunks are built on a copy of the file and published once the file is valid, the
+// error of a file cancelled in the meantime is kept.
+func (f *File) probe(ctx context.Context, nbrPerFile int) {
+	probed := &File{
+		URL:        f.URL,
+		ID:         f.ID,
+		Output:     f.Output,
+		OutputWork: f.OutputWork,
+		headers:    f.headers,
+	}
+	probed.BuildChunks(ctx, nbrPerFile)
+
+	// The size announced by the preprocessors must match the size of the file
+	if f.expected != 0 && probed.Valid && probed.Size != f.expected {
+		probed.Error = fmt.Sprintf("Unexpected size %v, %v announced", probed.Size, f.expected)
+		probed.Valid = false
+	}
+
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	if f.Error == "" {
+		f.Error = probed.Error
+	}
+	f.Size = probed.Size
+	f.Chunks = probed.Chunks
+	f.rangeless = probed.rangeless
+	f.Valid = probed.Valid
+}
+
+// isValid checks if the file has been probed successfully
+func (f *File) isValid() bool {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	return f.Valid
 }
 
+// QueueChunks sends the incomplete chunks of the file to the rebalancer
+// It returns false when the session was complete before all the chunks were queued.
+func (f *File) QueueChunks(headers chan header, complete chan bool) bool {
+	for _, id := range f.incompleteChunks() {
+		select {
+		case headers <- header{FileID: f.ID, ChunkID: id, Retry: true}:
+		case <-complete:
+			return false
+		}
+	}
+	return true
+}
+
+// indexFiles maps the files by ID
+func indexFiles(files []*File) map[uint32]*File {
+	index := make(map[uint32]*File, len(files))
+	for _, f := range files {
+		index[f.ID] = f
+	}
+	return index
+}
+
+// buildRootChunks splits the file in chunks of the same size, the last one takes the remaining bytes
+// Each chunk has at least one byte, an empty file has a single empty chunk.
 func buildRootChunks(f *File, nbrPerFile int) {
+	if uint64(nbrPerFile) > f.Size {
+		nbrPerFile = int(f.Size)
+	}
+	if nbrPerFile < 1 {
+		nbrPerFile = 1
+	}
+
 	f.Chunks = make([]Chunk, nbrPerFile)
 
 	chunkSize := f.Size / uint64(len(f.Chunks))
-	remaining := f.Size - chunkSize*uint64(len(f.Chunks))
-
 	for i := 0; i < len(f.Chunks); i++ {
 		f.Chunks[i] = Chunk{
-			Start: uint64(i) * chunkSize,
-			End: uint64(math.Min(float64(uint64(i+1)*chunkSize-1),
-				float64(f.Size))),
+			Range: Range{
+				Start: uint64(i) * chunkSize,
+				End:   uint64(i+1) * chunkSize,
+			},
 			Worker: uint32(i),
-			Done:   0,
-		}
-		f.Chunks[i].Total = f.Chunks[i].End - f.Chunks[i].Start + 1
-
-		if i == len(f.Chunks)-1 {
-			f.Chunks[i].End += remaining
 		}
 	}
+	f.Chunks[len(f.Chunks)-1].End = f.Size
 }
@@ -1,11 +1,14 @@
 package goxel
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -23,25 +26,11 @@ func TestResume(t *testing.T) {
 	file := File{
 		Output:     path.Join(dir, "work.mp4"),
 		OutputWork: path.Join(dir, "work.mp4."+workExtension),
+		Size:       300,
 		Chunks: []Chunk{
-			{
-				Start: 0,
-				End:   99,
-				Done:  0,
-				Total: 100,
-			},
-			{
-				Start: 100,
-				End:   199,
-				Done:  0,
-				Total: 100,
-			},
-			{
-				Start: 200,
-				End:   299,
-				Done:  0,
-				Total: 100,
-			},
+			{Range: Range{Start: 0, End: 100}, Done: 0},
+			{Range: Range{Start: 100, End: 200}, Done: 0},
+			{Range: Range{Start: 200, End: 300}, Done: 0},
 		},
 	}
 	file.writeMetadata()
@@ -49,6 +38,7 @@ func TestResume(t *testing.T) {
 	fileR := File{
 		Output:     path.Join(dir, "work.mp4"),
 		OutputWork: path.Join(dir, "work.mp4."+workExtension),
+		Size:       300,
 	}
 	fileR.ResumeChunks(3)
 
@@ -78,25 +68,11 @@ func TestResumeWithUpdateMaxConn(t *testing.T) {
 	file := File{
 		Output:     path.Join(dir, "work.mp4"),
 		OutputWork: path.Join(dir, "work.mp4."+workExtension),
+		Size:       300,
 		Chunks: []Chunk{
-			{
-				Start: 0,
-				End:   99,
-				Done:  50,
-				Total: 100,
-			},
-			{
-				Start: 100,
-				End:   199,
-				Done:  50,
-				Total: 100,
-			},
-			{
-				Start: 200,
-				End:   299,
-				Done:  0,
-				Total: 100,
-			},
+			{Range: Range{Start: 0, End: 100}, Done: 50},
+			{Range: Range{Start: 100, End: 200}, Done: 50},
+			{Range: Range{Start: 200, End: 300}, Done: 0},
 		},
 	}
 	file.writeMetadata()
@@ -104,6 +80,7 @@ func TestResumeWithUpdateMaxConn(t *testing.T) {
 	fileR := File{
 		Output:     path.Join(dir, "work.mp4"),
 		OutputWork: path.Join(dir, "work.mp4."+workExtension),
+		Size:       300,
 	}
 	fileR.ResumeChunks(4)
 
@@ -119,7 +96,7 @@ func TestResumeWithUpdateMaxConn(t *testing.T) {
 	chkR1 := fileR.Chunks[2]
 	chkR2 := fileR.Chunks[3]
 
-	if chkI.Start != chkR1.Start || chkI.End != chkR2.End || chkI.Total != chkR1.Total+chkR2.Total {
+	if chkI.Start != chkR1.Start || chkI.End != chkR2.End || chkI.Len() != chkR1.Len()+chkR2.Len() {
 		t.Error("Fail to resume!")
 	}
 }
@@ -134,3 +111,188 @@ func TestEmptyDirectory(t *testing.T) {
 		t.Error("Directory should be equal to the filename")
 	}
 }
+
+func TestConcurrentProgress(t *testing.T) {
+	goxel = &GoXel{}
+
+	file := File{Size: 4 * 1024 * 1024}
+	buildRootChunks(&file, 4)
+	for i := range file.Chunks {
+		file.Chunks[i].ID = uint32(i)
+	}
+
+	var wg sync.WaitGroup
+	work := func(chunk *Chunk, worker uint32) {
+		defer wg.Done()
+		for {
+			if _, ok := file.startChunk(chunk, worker); !ok {
+				return
+			}
+			file.advance(chunk, 1024)
+		}
+	}
+
+	// The first chunk is completed so it can be replaced by a split
+	wg.Add(1)
+	work(&file.Chunks[0], 0)
+
+	for i := 1; i < len(file.Chunks); i++ {
+		wg.Add(1)
+		go work(&file.Chunks[i], uint32(i))
+	}
+
+	stop := make(chan bool)
+	monitored := make(chan bool)
+	go func() {
+		defer close(monitored)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				file.UpdateStatus(false)
+				file.BuildProgress(100 / float64(file.Size))
+			}
+		}
+	}()
+
+	var rebalanced int
+	for i := 0; i < 100; i++ {
+		if chunk := file.rebalance(uint32(i % len(file.Chunks))); chunk != nil {
+			rebalanced++
+			wg.Add(1)
+			go work(chunk, uint32(i))
+		}
+	}
+
+	wg.Wait()
+	close(stop)
+	<-monitored
+
+	if rebalanced == 0 {
+		t.Error("Completed chunk should have been replaced")
+	}
+
+	for _, chunk := range file.snapshot() {
+		if chunk.Remaining() != 0 {
+			t.Error("All chunks should be completed")
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	file := File{
+		Size:   100,
+		Chunks: []Chunk{{Range: Range{Start: 0, End: 100}}},
+	}
+	chunk := &file.Chunks[0]
+	file.startChunk(chunk, 1)
+
+	if file.retry(chunk, 2) {
+		t.Error("Only the worker owning the chunk should retry it")
+	}
+
+	for i := 0; i < maxRetries*2; i++ {
+		file.retry(chunk, 1)
+		file.advance(chunk, 1)
+	}
+	if file.failure() != "" {
+		t.Error("Chunk making progress should always be retried")
+	}
+
+	for i := 0; i < maxRetries; i++ {
+		if !file.retry(chunk, 1) {
+			t.Error("Chunk should be retried")
+		}
+	}
+
+	if file.retry(chunk, 1) || file.failure() == "" {
+		t.Error("File should be in error once the chunk stopped progressing")
+	}
+}
+
+func TestOutputName(t *testing.T) {
+	dir := path.Join(output, "names")
+
+	for _, name := range []string{"../x", "/etc/x", "a/../../x"} {
+		file := newFile(0, Download{URL: "http://test.fr/video.mp4", Name: name}, dir, false)
+		if file.failure() == "" || file.Output != path.Join(dir, "video.mp4") {
+			t.Error("Names leaving the output directory should be refused", name, file.Output)
+		}
+
+		file = &File{URL: "http://test.fr/video.mp4", name: name}
+		file.setOutput(dir, false)
+		if !strings.HasPrefix(file.Output, dir+"/") {
+			t.Error("Output should stay in the output directory", name, file.Output)
+		}
+
+		resolved := newFile(0, Download{URL: "http://test.fr/lazy.mp4", Resolve: func(ctx context.Context) (Download, error) {
+			return Download{URL: "http://test.fr/video.mp4", Name: name}, nil
+		}}, dir, false)
+		resolved.unlock(context.Background(), dir, false)
+		if resolved.failure() == "" {
+			t.Error("Resolved names leaving the output directory should be refused", name)
+		}
+	}
+
+	if file := newFile(0, Download{URL: "http://test.fr/video.mp4", Name: "season 1/video.mp4"}, dir, false); file.failure() != "" || file.Output != path.Join(dir, "season 1", "video.mp4") {
+		t.Error("Names in a subdirectory should be kept", file.Output, file.failure())
+	}
+}
+
+func TestExpectedSize(t *testing.T) {
+	for _, expected := range []uint64{25000000, 1024} {
+		file := &File{URL: "http://127.0.0.1:8080/25MB", expected: expected}
+		file.setOutput(path.Join(output, "expected"), true)
+		file.probe(context.Background(), 2)
+
+		if valid := expected == 25000000; file.isValid() != valid || (file.failure() == "") != valid {
+			t.Error("Size announced by the preprocessors should be checked", expected, file.failure())
+		}
+	}
+}
+
+func TestIncrementalProgress(t *testing.T) {
+	file := File{Size: 1000}
+	buildRootChunks(&file, 7)
+	for i := range file.Chunks {
+		file.Chunks[i].ID = uint32(i)
+		file.Chunks[i].Worker = uint32(i)
+	}
+
+	unit := 80 / float64(file.Size)
+	file.BuildProgress(unit)
+
+	for i := 0; i < 20; i++ {
+		chunk := &file.Chunks[i%len(file.Chunks)]
+		file.advance(chunk, 37)
+		if chunk.Remaining() == 0 {
+			file.rebalance(chunk.ID)
+		}
+
+		incremental := string(file.BuildProgress(unit))
+
+		expected := File{Size: file.Size, Chunks: file.snapshot()}
+		if full := string(expected.BuildProgress(unit)); incremental != full {
+			t.Errorf("Incremental progress differs from a full build:\n%q\n%q", incremental, full)
+		}
+	}
+
+	if len(file.BuildProgress(unit)) != 80 {
+		t.Error("Progress should have the requested width")
+	}
+	if len(file.BuildProgress(40/float64(file.Size))) != 40 {
+		t.Error("Progress should be rebuilt when the width changes")
+	}
+}
+
+func BenchmarkBuildProgress(b *testing.B) {
+	file := buildMonitoredFiles(1)[0]
+	unit := 100 / float64(file.Size)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		file.advance(&file.Chunks[i%8], 1024)
+		file.BuildProgress(unit)
+	}
+}
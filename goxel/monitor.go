@@ -2,178 +2,295 @@ package goxel
 
 import (
 	"fmt"
-	"math"
-	"strings"
+	"os"
+	"path"
+	"syscall"
 	"time"
 
 	"github.com/dustin/go-humanize"
 )
 
-const monitorCount = 40
-
-type monitor struct {
-	Duration time.Duration
-	Value    uint64
-}
+const (
+	// plainInterval is the number of monitoring ticks between two status reports of the plain output
+	plainInterval = 50
+	// plainCompactFiles is the number of files above which the plain output reports a single summary line
+	plainCompactFiles = 20
+)
 
 type monitorer interface {
-	monitor(files []*File, d chan download, messages []string) (int, []string)
+	start()
+	monitor(files []*File, messages []string) (int, []string)
+	stop(files []*File)
 }
 
-// QuietMonitoring only ensures the Files are synced every Xs
-type QuietMonitoring struct {
-	count uint64
+// newMonitorer returns the TUI when stdout is a terminal, the plain output otherwise
+func newMonitorer(quiet, scroll bool, controls controller) monitorer {
+	switch {
+	case quiet:
+		return &QuietMonitoring{}
+	case !scroll && isTerminal(syscall.Stdout):
+		return NewTUIMonitoring(os.Stdout, controls)
+	}
+	return &PlainMonitoring{}
 }
 
-func (q *QuietMonitoring) monitor(files []*File, d chan download, messages []string) (int, []string) {
-	finished := 0
-	for _, f := range files {
-		if !f.Valid {
-			if f.Error != "" {
-				finished++
-			}
-			continue
-		}
+// fileStatus is the status of a file for a monitoring tick
+type fileStatus struct {
+	File                    *File
+	Ratio                   float64
+	Size, Connections, Done uint64
+	Session, Revision       uint64
+	Speed                   float64
+	Output                  string
+	Valid, Finished         bool
+	Paused, Removed         bool
+	Error                   string
+}
 
-		f.UpdateStatus(q.count%10 == 0)
-		if f.Finished {
-			finished++
-		}
+// status reads the state of the file, the progress is filled by the statusCache
+func (f *File) status() fileStatus {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+
+	return fileStatus{
+		File:     f,
+		Revision: f.revision,
+		Size:     f.Size,
+		Output:   f.Output,
+		Valid:    f.Valid,
+		Finished: f.Finished,
+		Paused:   f.paused,
+		Removed:  f.removed,
+		Error:    f.Error,
 	}
-	q.count++
+}
 
-	return finished, make([]string, 0)
+// statusCache keeps the status of the files between two monitoring ticks
+// The chunks of a file are only read again when its revision changed, and its metadata is
+// only committed when it progressed since the previous commit.
+type statusCache struct {
+	statuses  []fileStatus
+	computed  []bool
+	committed []uint64
 }
 
-func buildFileDescription(output []string, files []*File) []string {
-	for idx, f := range files {
-		if f.Error == "" {
-			output = append(output, fmt.Sprintf("[%3d] - %-120v", idx, f.Output))
-		} else {
-			output = append(output, fmt.Sprintf("[ERR] - %v: %v", f.Output, f.Error))
-		}
+// update updates the status of the files, the metadata is committed when commit is set
+// It returns the number of files either finished or in error.
+func (c *statusCache) update(files []*File, commit bool) ([]fileStatus, int) {
+	if len(c.statuses) != len(files) {
+		c.statuses = make([]fileStatus, len(files))
+		c.computed = make([]bool, len(files))
+		c.committed = make([]uint64, len(files))
 	}
-	return output
-}
 
-func buildChunkDescription(output []string, files []*File, count uint64, speed uint64) ([]string, int, uint64) {
-	finished := 0
-	var gDone uint64
+	var finished int
+	for i, f := range files {
+		s := f.status()
+
+		switch {
+		case s.Error != "":
+			finished++
+
+		case !s.Valid:
 
-	for idx, f := range files {
-		if !f.Valid {
-			if f.Error != "" {
-				finished++
+		case !c.computed[i] || c.statuses[i].Revision != s.Revision || commit && c.committed[i] != s.Revision:
+			persist := commit && c.committed[i] != s.Revision
+			s.Ratio, s.Connections, s.Done, s.Session = f.UpdateStatus(persist)
+			if persist {
+				c.committed[i] = s.Revision
 			}
-			continue
+
+			// The file is finished by UpdateStatus once its last byte is written
+			s.Finished = f.isFinished()
+			c.computed[i] = true
+
+		default:
+			previous := c.statuses[i]
+			s.Ratio, s.Connections, s.Done, s.Session = previous.Ratio, previous.Connections, previous.Done, previous.Session
 		}
 
-		ratio, conn, done, sdone := f.UpdateStatus(count%10 == 0)
-		if f.Finished {
+		if s.Error == "" && s.Finished {
 			finished++
 		}
+		c.statuses[i] = s
+	}
+	return c.statuses, finished
+}
+
+// QuietMonitoring only ensures the Files are synced every Xs
+type QuietMonitoring struct {
+	count uint64
+	cache statusCache
+}
 
-		left := fmt.Sprintf("[%3d] - [%6.2f%%] [", idx, ratio)
+func (q *QuietMonitoring) start() {}
 
-		var remaining uint64
-		if speed > 0 {
-			remaining = uint64(math.Max(float64(f.Size)-float64(done), 0)) / speed
-		}
-		right := fmt.Sprintf("] (%d/%d) [%8v]", conn, len(f.Chunks), fmtDuration(remaining))
+func (q *QuietMonitoring) monitor(files []*File, messages []string) (int, []string) {
+	_, finished := q.cache.update(files, q.count%10 == 0)
+	q.count++
 
-		unit := float64(int(getWidth())-len(left)-len(right)-1) / float64(f.Size)
-		output = append(output, left+f.BuildProgress(unit)+right)
+	return finished, make([]string, 0)
+}
 
-		gDone += sdone
-	}
+func (q *QuietMonitoring) stop(files []*File) {}
 
-	return output, finished, gDone
+// PlainMonitoring prints the messages and a periodic status of the files without terminal control sequences
+// It is used when the output is not a terminal.
+type PlainMonitoring struct {
+	count    uint64
+	cache    statusCache
+	printed  int
+	reported map[*File]bool
+	speeds   map[*File]*speedWindow
 }
 
-// ConsoleMonitoring monitors the current downloads and display the speed and progress for each files
-type ConsoleMonitoring struct {
-	monitors            []monitor
-	count, pDone, gDone uint64
-	output              []string
-	lastStart           time.Time
+func (p *PlainMonitoring) start() {
+	p.reported = make(map[*File]bool)
+	p.speeds = make(map[*File]*speedWindow)
 }
 
-func (c *ConsoleMonitoring) monitor(files []*File, d chan download, messages []string) (int, []string) {
-	if goxel.Scroll {
-		c.output = make([]string, 0)
-	} else {
-		move := math.Max(float64(len(c.output)-1), 0)
-		c.output = make([]string, 0)
-		c.output = append(c.output, fmt.Sprintf(strings.Repeat("\033[F", int(move)))+"\r")
-	}
+func (p *PlainMonitoring) monitor(files []*File, messages []string) (int, []string) {
+	statuses, finished := p.cache.update(files, p.count%10 == 0)
 
-	for _, message := range messages {
-		c.output = append(c.output, message)
+	for _, message := range messages[p.printed:] {
+		fmt.Println(message)
 	}
-	c.output = append(c.output, "")
+	p.printed = len(messages)
+
+	now := time.Now()
+	report := p.count%plainInterval == 0
+	compact := len(statuses) > plainCompactFiles
+
+	var sum summary
+	for i := range statuses {
+		statuses[i].Speed = fileSpeed(p.speeds, statuses[i], now)
+		s := statuses[i]
+		sum.add(s)
+
+		switch {
+		case s.Error != "" || s.Finished:
+			if !p.reported[s.File] {
+				p.reported[s.File] = true
+				fmt.Printf("[%3d] %v: %v\n", s.File.ID, s.Output, statusLabel(s))
+			}
 
-	c.output = buildFileDescription(c.output, files)
-	c.output = append(c.output, "")
+		case s.Valid && report && !compact:
+			fmt.Printf("[%3d] %v: %6.2f%% of %v, %v/s, %v\n", s.File.ID, s.Output, s.Ratio, humanize.Bytes(s.Size), humanize.Bytes(uint64(s.Speed)), statusLabel(s))
+		}
+	}
 
-	var curDone uint64
-	var curDelay time.Duration
-	for _, vd := range c.monitors {
-		curDone += vd.Value
-		curDelay += vd.Duration
+	if report && compact {
+		fmt.Println(sum.String())
 	}
+	p.count++
 
-	speed := uint64(float64(curDone) / (float64(curDelay/time.Nanosecond) / 1000000000))
+	return finished, messages
+}
 
-	c.output = append(c.output, fmt.Sprintf("Download speed: %8v/s", humanize.Bytes(speed)))
-	c.output = append(c.output, fmt.Sprintf("Active connections: %6v", activeConnections.v))
-	c.output = append(c.output, "")
+func (p *PlainMonitoring) stop(files []*File) {}
 
-	var finished int
-	c.output, finished, c.gDone = buildChunkDescription(c.output, files, c.count, speed)
+// fileSpeed records the bytes downloaded by the file during the session and returns its current speed
+// The speed of the stopped files is not measured.
+func fileSpeed(speeds map[*File]*speedWindow, s fileStatus, now time.Time) float64 {
+	if s.Error != "" || s.Finished || !s.Valid {
+		delete(speeds, s.File)
+		return 0
+	}
+
+	w, ok := speeds[s.File]
+	if !ok {
+		// The bytes downloaded before the first observation are not measured
+		w = newSpeedWindow(5*time.Second, now)
+		w.total, w.samples[0].total = s.Session, s.Session
+		speeds[s.File] = w
+		return 0
+	}
+
+	var n uint64
+	if s.Session > w.total {
+		n = s.Session - w.total
+	}
+	w.add(now, n)
+	return w.rate(now)
+}
 
-	c.output = append(c.output, "")
+// summary aggregates the status of the files, the removed files are ignored
+type summary struct {
+	Running, Paused, Waiting, Finished, Failed int
+	Size, Done, Connections                    uint64
+	Speed                                      float64
+}
 
-	c.monitors[c.count%monitorCount] = monitor{
-		Duration: time.Since(c.lastStart),
-		Value:    c.gDone - c.pDone,
+func (sum *summary) add(s fileStatus) {
+	switch {
+	case s.Removed:
+		return
+	case s.Error != "":
+		sum.Failed++
+		return
+	case s.Finished:
+		sum.Finished++
+	case s.Paused:
+		sum.Paused++
+	case !s.Valid:
+		sum.Waiting++
+		return
+	default:
+		sum.Running++
 	}
-	c.count++
-	c.pDone = c.gDone
-	c.lastStart = time.Now()
-
-	for _, s := range c.output {
-		if s == "" {
-			fmt.Printf("%v", strings.Repeat(" ", int(getWidth())))
-		} else {
-			fmt.Print(s + "\n")
-		}
+
+	sum.Size += s.Size
+	sum.Done += s.Done
+	sum.Connections += s.Connections
+	sum.Speed += s.Speed
+}
+
+// Ratio returns the progress percentage of the files
+func (sum summary) Ratio() float64 {
+	if sum.Size == 0 {
+		return 0
 	}
+	return float64(sum.Done) / float64(sum.Size) * 100
+}
 
-	return finished, messages
+func (sum summary) String() string {
+	return fmt.Sprintf("%d running, %d paused, %d waiting, %d done, %d errors - %v / %v (%.1f%%), %v/s, ETA %v",
+		sum.Running, sum.Paused, sum.Waiting, sum.Finished, sum.Failed,
+		humanize.Bytes(sum.Done), humanize.Bytes(sum.Size), sum.Ratio(),
+		humanize.Bytes(uint64(sum.Speed)), eta(float64(sum.Size-sum.Done), sum.Speed))
 }
 
-// Monitoring handles the files' termination and monitoring
-func Monitoring(files []*File, done chan bool, d chan download, quiet bool) {
-	var m monitorer
-	if quiet {
-		m = &QuietMonitoring{}
-	} else {
-		m = &ConsoleMonitoring{
-			monitors:  make([]monitor, monitorCount),
-			lastStart: time.Now(),
-		}
+// statusLabel describes the state of the file
+func statusLabel(s fileStatus) string {
+	switch {
+	case s.Removed:
+		return "REMOVED"
+	case s.Error != "":
+		return "ERROR: " + s.Error
+	case s.Finished:
+		return "DONE"
+	case s.Paused:
+		return "PAUSED"
+	case !s.Valid:
+		return "WAITING"
 	}
+	return "RUNNING"
+}
 
+// Monitoring handles the files' termination and monitoring
+// The complete channel is closed once all the files are either finished or in error.
+func Monitoring(files []*File, done chan bool, complete chan bool, m monitorer) {
 	gMessages := make([]string, 0)
 	closed := false
+	index := indexFiles(files)
 
 	for {
 		select {
 		default:
 			var finished int
-			finished, gMessages = m.monitor(files, d, gMessages)
+			finished, gMessages = m.monitor(files, gMessages)
 			if finished == len(files) && !closed {
-				close(d)
+				close(complete)
 				closed = true
 			}
 			time.Sleep(100 * time.Millisecond)
@@ -181,12 +298,12 @@ func Monitoring(files []*File, done chan bool, d chan download, quiet bool) {
 		case s := <-cMessages:
 			if s.FileID == maxUint32 {
 				gMessages = append(gMessages, fmt.Sprintf("[%v] - %7v - %v", s.Context, s.Type.String(), s.Content))
-			} else {
-				for _, file := range files {
-					if file.ID == s.FileID {
-						file.Error = s.Content
-					}
+			} else if file, ok := index[s.FileID]; ok {
+				// Only errors stop the file, other messages are displayed with its name
+				if s.Type == Error {
+					file.setError(s.Content)
 				}
+				gMessages = append(gMessages, fmt.Sprintf("[%v] - %7v - %v: %v", s.Context, s.Type.String(), path.Base(file.status().Output), s.Content))
 			}
 
 		case <-done:
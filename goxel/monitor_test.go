@@ -0,0 +1,89 @@
+package goxel
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+// buildMonitoredFiles builds n files of 8 chunks being downloaded
+func buildMonitoredFiles(n int) []*File {
+	files := make([]*File, n)
+	for i := range files {
+		f := &File{ID: uint32(i), Output: fmt.Sprintf("/tmp/file%d", i), Size: 8 << 20, Valid: true}
+		buildRootChunks(f, 8)
+		for j := range f.Chunks {
+			f.Chunks[j].ID = uint32(j)
+			f.Chunks[j].Done = f.Chunks[j].Len() / 2
+		}
+		files[i] = f
+	}
+	return files
+}
+
+func TestStatusCache(t *testing.T) {
+	goxel = &GoXel{Resume: true}
+	defer func() { goxel = &GoXel{} }()
+
+	dir := path.Join(output, "cache")
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+
+	files := buildMonitoredFiles(2)
+	for _, f := range files {
+		f.Output = path.Join(dir, path.Base(f.Output))
+		f.OutputWork = f.Output + "." + workExtension
+	}
+
+	var cache statusCache
+	statuses, finished := cache.update(files, true)
+	if finished != 0 || statuses[0].Done != 4<<20 {
+		t.Error("Unexpected status", statuses[0])
+	}
+
+	// Unchanged files are not committed
+	for _, f := range files {
+		if _, err := os.Stat(f.OutputWork); !os.IsNotExist(err) {
+			t.Error("Unchanged file should not be committed")
+		}
+	}
+
+	files[1].advance(&files[1].Chunks[0], 1024)
+	statuses, _ = cache.update(files, true)
+	if statuses[1].Done != 4<<20+1024 {
+		t.Error("Progressed file should be updated", statuses[1])
+	}
+
+	if _, err := os.Stat(files[0].OutputWork); !os.IsNotExist(err) {
+		t.Error("Unchanged file should not be committed")
+	}
+	if _, err := os.Stat(files[1].OutputWork); err != nil {
+		t.Error("Progressed file should be committed", err)
+	}
+
+	files[0].setError("failed")
+	if _, finished := cache.update(files, false); finished != 1 {
+		t.Error("Files in error should be counted as finished")
+	}
+}
+
+func BenchmarkUpdateFiles(b *testing.B) {
+	for _, changed := range []int{0, 100, 5000} {
+		b.Run(fmt.Sprintf("changed-%d", changed), func(b *testing.B) {
+			files := buildMonitoredFiles(5000)
+
+			var cache statusCache
+			cache.update(files, false)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, f := range files[:changed] {
+					f.advance(&f.Chunks[i%8], 1)
+				}
+				cache.update(files, false)
+			}
+		})
+	}
+}
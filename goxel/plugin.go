@@ -0,0 +1,306 @@
+package goxel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPluginTimeout = 30 * time.Second
+	// pluginConcurrency is the number of plugins running at the same time
+	pluginConcurrency = 4
+)
+
+// pluginFlag is used to parse the plugins on the CLI
+// It allows multiple elements to be passed
+type pluginFlag []string
+
+func (p *pluginFlag) String() string {
+	return fmt.Sprintf("%v", *p)
+}
+
+func (p *pluginFlag) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+func (p *pluginFlag) Type() string {
+	return "host-pattern=command"
+}
+
+// PluginRequest is the request written on the standard input of a plugin
+type PluginRequest struct {
+	URL      string `json:"url"`
+	Password string `json:"password,omitempty"`
+}
+
+// PluginDownload is a download returned by a plugin
+type PluginDownload struct {
+	URL      string            `json:"url"`
+	Filename string            `json:"filename"`
+	Size     uint64            `json:"size"`
+	Headers  map[string]string `json:"headers"`
+	Cookies  map[string]string `json:"cookies"`
+	Checksum string            `json:"checksum"`
+}
+
+// PluginResponse is the response read on the standard output of a plugin
+// A plugin refusing the URL sets the error, its exit status is ignored then.
+type PluginResponse struct {
+	Downloads []PluginDownload `json:"downloads"`
+	Error     string           `json:"error"`
+}
+
+// plugin is an executable resolving the URLs whose host matches its pattern
+type plugin struct {
+	Host    *regexp.Regexp
+	Command []string
+}
+
+// parsePlugin parses a "host-pattern=command" plugin, the command is split on spaces
+func parsePlugin(option string) (plugin, error) {
+	idx := strings.Index(option, "=")
+	if idx <= 0 || strings.TrimSpace(option[idx+1:]) == "" {
+		return plugin{}, fmt.Errorf("Invalid plugin [%v], expected host-pattern=command", option)
+	}
+
+	host, err := regexp.Compile(option[:idx])
+	if err != nil {
+		return plugin{}, fmt.Errorf("Invalid plugin pattern [%v]: %v", option[:idx], err.Error())
+	}
+	return plugin{Host: host, Command: strings.Fields(option[idx+1:])}, nil
+}
+
+// PluginURLPreprocessor implements the UrlPreprocessor interface with external executables.
+// The first plugin whose pattern matches the host of a URL receives a PluginRequest in JSON on
+// its standard input and writes a PluginResponse on its standard output, the URL is replaced
+// by the downloads of the response. A plugin is killed after Timeout, the URLs of a failed
+// plugin are ignored.
+type PluginURLPreprocessor struct {
+	Timeout   time.Duration
+	Passwords map[string]string
+	plugins   []plugin
+	mux       sync.Mutex
+	downloads map[string]Download
+}
+
+// plugins builds the plugin preprocessor from the settings, nil when no plugin is configured
+func (g *GoXel) plugins(passwords map[string]string) (*PluginURLPreprocessor, error) {
+	if len(g.Plugins) == 0 {
+		return nil, nil
+	}
+
+	s := &PluginURLPreprocessor{Timeout: g.PluginTimeout, Passwords: passwords}
+	for _, option := range g.Plugins {
+		p, err := parsePlugin(option)
+		if err != nil {
+			return nil, err
+		}
+		s.plugins = append(s.plugins, p)
+	}
+	return s, nil
+}
+
+// plugin returns the plugin resolving the URL, nil when no pattern matches its host
+func (s *PluginURLPreprocessor) plugin(link string) *plugin {
+	host := hostOf(link)
+	for i := range s.plugins {
+		if host != "" && s.plugins[i].Host.MatchString(host) {
+			return &s.plugins[i]
+		}
+	}
+	return nil
+}
+
+// run sends the URL to the plugin and returns its downloads
+func (s *PluginURLPreprocessor) run(p *plugin, link string) ([]PluginDownload, error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = defaultPluginTimeout
+	}
+
+	request, err := json.Marshal(PluginRequest{URL: link, Password: s.Passwords[link]})
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, stderr, err := runPlugin(p.Command, request, timeout)
+	if err == errPluginTimeout {
+		return nil, fmt.Errorf("%v timed out after %v", p.Command[0], timeout)
+	}
+
+	var resp PluginResponse
+	if jsonErr := json.Unmarshal(stdout, &resp); jsonErr != nil {
+		if err != nil {
+			return nil, fmt.Errorf("%v failed: %v %v", p.Command[0], err.Error(), strings.TrimSpace(string(stderr)))
+		}
+		return nil, fmt.Errorf("%v returned an invalid response: %v", p.Command[0], jsonErr.Error())
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%v", resp.Error)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v failed: %v %v", p.Command[0], err.Error(), strings.TrimSpace(string(stderr)))
+	}
+	return resp.Downloads, nil
+}
+
+var errPluginTimeout = errors.New("plugin timed out")
+
+// runPlugin runs the command with the request on its standard input and returns its outputs
+// After the timeout, the command and the processes it started are killed and their outputs
+// are closed, so a child keeping them open doesn't block the run.
+func runPlugin(command []string, request []byte, timeout time.Duration) ([]byte, []byte, error) {
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, nil, err
+	}
+	defer stdoutR.Close()
+	defer stderrR.Close()
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout, cmd.Stderr = stdoutW, stderrW
+	setProcessGroup(cmd)
+
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			io.Copy(&stdout, stdoutR)
+		}()
+		go func() {
+			defer wg.Done()
+			io.Copy(&stderr, stderrR)
+		}()
+		wg.Wait()
+		done <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return stdout.Bytes(), stderr.Bytes(), err
+	case <-timer.C:
+	}
+
+	killProcessGroup(cmd)
+	stdoutR.Close()
+	stderrR.Close()
+	<-done
+	return nil, nil, errPluginTimeout
+}
+
+// resolve returns the URLs of the downloads returned by the plugin, they are described by the plugin
+func (s *PluginURLPreprocessor) resolve(p *plugin, link string) []string {
+	downloads, err := s.run(p, link)
+	if err != nil {
+		cMessages <- NewErrorMessage("PLUGIN", fmt.Sprintf("Ignoring [%v] due to an error: %v", link, err.Error()))
+		return nil
+	}
+
+	links := make([]string, 0, len(downloads))
+	for _, d := range downloads {
+		if d.URL == "" {
+			cMessages <- NewWarningMessage("PLUGIN", fmt.Sprintf("Ignoring a download without URL returned for [%v]", link))
+			continue
+		}
+
+		// The filename can have subdirectories but it must stay in the output directory
+		if err := checkName(d.Filename); err != nil {
+			cMessages <- NewErrorMessage("PLUGIN", fmt.Sprintf("Ignoring [%v] returned for [%v]: %v", d.URL, link, err.Error()))
+			continue
+		}
+
+		download := Download{URL: d.URL, Name: d.Filename, Size: d.Size, Headers: d.Headers, Checksum: d.Checksum}
+		if len(d.Cookies) > 0 {
+			cookies := make([]string, 0, len(d.Cookies))
+			for name, value := range d.Cookies {
+				cookies = append(cookies, (&http.Cookie{Name: name, Value: value}).String())
+			}
+
+			headers := map[string]string{"Cookie": strings.Join(cookies, "; ")}
+			for name, value := range d.Headers {
+				headers[name] = value
+			}
+			download.Headers = headers
+		}
+
+		s.mux.Lock()
+		s.downloads[d.URL] = download
+		s.mux.Unlock()
+
+		links = append(links, d.URL)
+	}
+	return links
+}
+
+// download returns the download described by the plugin for the URL
+func (s *PluginURLPreprocessor) download(link string) (Download, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	d, ok := s.downloads[link]
+	return d, ok
+}
+
+func (s *PluginURLPreprocessor) process(urls []string) []string {
+	s.downloads = make(map[string]Download)
+
+	// The plugins run concurrently, the order of the URLs is kept
+	resolved := make([][]string, len(urls))
+	slots := make(chan struct{}, pluginConcurrency)
+	var wg sync.WaitGroup
+	for i, link := range urls {
+		p := s.plugin(link)
+		if p == nil {
+			resolved[i] = []string{link}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, link string) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			resolved[i] = s.resolve(p, link)
+			<-slots
+		}(i, link)
+	}
+	wg.Wait()
+
+	output := make([]string, 0, len(urls))
+	for _, links := range resolved {
+		output = append(output, links...)
+	}
+	return output
+}
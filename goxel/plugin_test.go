@@ -0,0 +1,80 @@
+package goxel
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePlugin(dir, name, script string) string {
+	file := path.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		log.Fatal(err)
+	}
+	return file
+}
+
+func TestParsePlugin(t *testing.T) {
+	p, err := parsePlugin(`short\.link=/usr/bin/resolver --json`)
+	if err != nil || !p.Host.MatchString("short.link") || strings.Join(p.Command, " ") != "/usr/bin/resolver --json" {
+		t.Error("Plugin should be parsed", p, err)
+	}
+
+	for _, option := range []string{"resolver", "short.link=", "=resolver", "(=resolver"} {
+		if _, err := parsePlugin(option); err == nil {
+			t.Error("Invalid plugin should be refused", option)
+		}
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-plugin")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The plugin echoes the request in a header so it can be checked
+	resolver := writePlugin(dir, "resolver", `read request
+echo "{\"downloads\": [{\"url\": \"http://download.com/a\", \"filename\": \"a.mkv\", \"size\": 12, \"headers\": {\"X-Request\": $(echo "$request" | sed 's/"/\\"/g' | sed 's/.*/"&"/')}, \"cookies\": {\"session\": \"abc\"}, \"checksum\": \"md5:38c2ac6022f8ebf983bf5fadb1513b5c\"}, {\"url\": \"http://download.com/b\"}, {\"url\": \"http://download.com/up\", \"filename\": \"../../.bashrc\"}, {\"url\": \"http://download.com/root\", \"filename\": \"/\"}, {\"url\": \"http://download.com/abs\", \"filename\": \"/tmp/dir/c.mkv\"}, {\"url\": \"http://download.com/dir\", \"filename\": \"dir/c.mkv\"}, {\"url\": \"http://download.com/dots\", \"filename\": \"a..b.mkv\"}]}"
+`)
+	refusing := writePlugin(dir, "refusing", `echo '{"error": "Unknown link"}'`)
+	failing := writePlugin(dir, "failing", `echo crashed >&2; exit 3`)
+	slow := writePlugin(dir, "slow", `sleep 5`)
+
+	g := &GoXel{
+		Plugins:       []string{"short=" + resolver, "refused=" + refusing, "failing=" + failing, "slow=" + slow},
+		PluginTimeout: 200 * time.Millisecond,
+	}
+	plugins, err := g.plugins(map[string]string{"http://short.com/a": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	urls := plugins.process([]string{"http://short.com/a", "http://other.com/c", "http://refused.com/d", "http://failing.com/e", "http://slow.com/f"})
+	if strings.Join(urls, " ") != "http://download.com/a http://download.com/b http://download.com/dir http://download.com/dots http://other.com/c" {
+		t.Error("URLs should be replaced by the downloads of their plugin", urls)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("Slow plugins should be killed after the timeout")
+	}
+
+	d := newDownload([]URLPreprocessor{plugins}, "http://download.com/a")
+	if d.Name != "a.mkv" || d.Size != 12 || d.Checksum != "md5:38c2ac6022f8ebf983bf5fadb1513b5c" || d.Headers["Cookie"] != "session=abc" {
+		t.Error("Downloads should be described by their plugin", d)
+	}
+	if d := newDownload([]URLPreprocessor{plugins}, "http://download.com/dir"); d.Name != "dir/c.mkv" {
+		t.Error("Filenames should keep their subdirectories", d.Name)
+	}
+	if d := newDownload([]URLPreprocessor{plugins}, "http://download.com/dots"); d.Name != "a..b.mkv" {
+		t.Error("Filenames with dots should be kept", d.Name)
+	}
+	if d.Headers["X-Request"] != `{"url":"http://short.com/a","password":"secret"}` {
+		t.Error("Plugins should receive the URL and its password", d.Headers["X-Request"])
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package goxel
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the plugin in its own process group so its children can be killed with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the plugin and the processes it started
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
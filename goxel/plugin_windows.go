@@ -0,0 +1,13 @@
+package goxel
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing, the children of the plugin are not tracked
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the plugin, its output is closed by the caller for the children still running
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
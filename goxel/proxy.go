@@ -0,0 +1,241 @@
+package goxel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyConfig selects the proxy to use depending on the target URL
+// Proxies can be set per scheme of the target URL and bypassed using no proxy rules.
+type proxyConfig struct {
+	schemes map[string]*url.URL
+	env     map[string]bool
+	noProxy []noProxyRule
+}
+
+// buildProxyConfig builds the proxy configuration from the command line options
+// The HTTP_PROXY, HTTPS_PROXY, ALL_PROXY and NO_PROXY environment variables are used as defaults.
+func buildProxyConfig(g *GoXel) (*proxyConfig, error) {
+	p := &proxyConfig{
+		schemes: make(map[string]*url.URL, 2),
+		env:     make(map[string]bool, 2),
+	}
+
+	for scheme, option := range map[string]string{"http": g.HTTPProxy, "https": g.HTTPSProxy} {
+		raw, env := option, false
+		if raw == "" {
+			raw = g.Proxy
+		}
+		if raw == "" {
+			raw, env = getEnv(scheme+"_proxy"), true
+		}
+		if raw == "" {
+			raw = getEnv("all_proxy")
+		}
+		if raw == "" {
+			continue
+		}
+
+		u, err := parseProxyURL(raw)
+		if err != nil {
+			return nil, err
+		}
+		p.schemes[scheme] = u
+		p.env[scheme] = env
+	}
+
+	noProxy := g.NoProxy
+	if noProxy == "" {
+		noProxy = getEnv("no_proxy")
+	}
+	p.noProxy = parseNoProxy(noProxy)
+
+	return p, nil
+}
+
+// getEnv returns the environment variable using either its upper or lower case name
+func getEnv(name string) string {
+	if v := os.Getenv(strings.ToUpper(name)); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// parseProxyURL parses and validates a proxy URL, the scheme defaults to http
+func parseProxyURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy URL [%v]", raw)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("Invalid proxy protocol [%v]", u.Scheme)
+	}
+
+	return u, nil
+}
+
+// urls returns all the distinct proxies of the configuration
+func (p *proxyConfig) urls() []*url.URL {
+	urls := make([]*url.URL, 0, len(p.schemes))
+	seen := make(map[string]bool, len(p.schemes))
+	for _, u := range p.schemes {
+		if !seen[u.String()] {
+			seen[u.String()] = true
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// proxyFor returns the proxy to use for the URL, nil means a direct connection
+func (p *proxyConfig) proxyFor(u *url.URL) *url.URL {
+	pURL, ok := p.schemes[u.Scheme]
+	if !ok {
+		return nil
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+
+	// Environment proxies never apply to the local host, as for http.ProxyFromEnvironment
+	if p.env[u.Scheme] {
+		if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+			return nil
+		}
+	}
+
+	for _, rule := range p.noProxy {
+		if rule.match(host, port) {
+			return nil
+		}
+	}
+
+	return pURL
+}
+
+// noProxyRule is a host, domain, IP or CIDR that must be reached without proxy
+type noProxyRule struct {
+	all          bool
+	network      *net.IPNet
+	ip           net.IP
+	domain, port string
+}
+
+// parseNoProxy parses a comma or space separated list of rules
+// Supported rules are "*", IPs, CIDRs and domains (matching their sub-domains), with an optional port.
+func parseNoProxy(list string) []noProxyRule {
+	rules := make([]noProxyRule, 0)
+	for _, entry := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		if entry == "*" {
+			rules = append(rules, noProxyRule{all: true})
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			rules = append(rules, noProxyRule{network: network})
+			continue
+		}
+
+		var rule noProxyRule
+		if host, port, err := net.SplitHostPort(entry); err == nil {
+			entry, rule.port = host, port
+		}
+
+		if ip := net.ParseIP(strings.Trim(entry, "[]")); ip != nil {
+			rule.ip = ip
+		} else {
+			rule.domain = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func (r noProxyRule) match(host, port string) bool {
+	if r.all {
+		return true
+	}
+
+	if r.port != "" && r.port != port {
+		return false
+	}
+
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	switch {
+	case r.network != nil:
+		return ip != nil && r.network.Contains(ip)
+	case r.ip != nil:
+		return ip != nil && r.ip.Equal(ip)
+	default:
+		return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+	}
+}
+
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// socksDialContext returns a dial function connecting through the SOCKS5 proxy
+// Host names are resolved locally for socks5:// proxies and by the proxy for socks5h:// ones.
+func socksDialContext(u *url.URL, forward *net.Dialer) (func(ctx context.Context, network, address string) (net.Conn, error), error) {
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{
+			User:     u.User.Username(),
+			Password: password,
+		}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", u.Host, auth, forward)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SOCKS5 proxy [%v]: %v", u.Host, err.Error())
+	}
+
+	cDialer, ok := dialer.(contextDialer)
+	if !ok {
+		return nil, errors.New("SOCKS5 dialer does not support contexts")
+	}
+
+	remoteDNS := u.Scheme == "socks5h"
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if !remoteDNS {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+
+			if net.ParseIP(host) == nil {
+				addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+				if err != nil {
+					return nil, err
+				}
+				if len(addrs) == 0 {
+					return nil, fmt.Errorf("No address found for [%v]", host)
+				}
+				address = net.JoinHostPort(addrs[0].IP.String(), port)
+			}
+		}
+
+		return cDialer.DialContext(ctx, network, address)
+	}, nil
+}
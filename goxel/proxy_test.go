@@ -0,0 +1,316 @@
+package goxel
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+)
+
+// socksStandIn is a minimal SOCKS5 server answering a single HTTP request per connection
+type socksStandIn struct {
+	listener       net.Listener
+	user, password string
+
+	mux     sync.Mutex
+	targets []string
+	domains []bool
+}
+
+func startSocksStandIn(user, password string) *socksStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	s := &socksStandIn{listener: listener, user: user, password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socksStandIn) read(r io.Reader, n int) []byte {
+	b := make([]byte, n)
+	io.ReadFull(r, b)
+	return b
+}
+
+func (s *socksStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	greeting := s.read(r, 2)
+	s.read(r, int(greeting[1]))
+
+	if s.user != "" {
+		conn.Write([]byte{5, 2})
+
+		user := s.read(r, int(s.read(r, 2)[1]))
+		password := s.read(r, int(s.read(r, 1)[0]))
+		if string(user) != s.user || string(password) != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	} else {
+		conn.Write([]byte{5, 0})
+	}
+
+	request := s.read(r, 4)
+
+	var host string
+	switch request[3] {
+	case 1:
+		host = net.IP(s.read(r, 4)).String()
+	case 3:
+		host = string(s.read(r, int(s.read(r, 1)[0])))
+	case 4:
+		host = net.IP(s.read(r, 16)).String()
+	}
+	port := s.read(r, 2)
+
+	s.mux.Lock()
+	s.targets = append(s.targets, net.JoinHostPort(host, fmt.Sprintf("%d", int(port[0])<<8|int(port[1]))))
+	s.domains = append(s.domains, request[3] == 3)
+	s.mux.Unlock()
+
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	if _, err := http.ReadRequest(r); err != nil {
+		return
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nsocks")
+}
+
+func (s *socksStandIn) last() (string, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(s.targets) == 0 {
+		return "", false
+	}
+	return s.targets[len(s.targets)-1], s.domains[len(s.domains)-1]
+}
+
+// startHTTPProxyStandIn starts a HTTP proxy answering all requests itself
+func startHTTPProxyStandIn(user, password string) *httptest.Server {
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user != "" && r.Header.Get("Proxy-Authorization") != expected {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		fmt.Fprintf(w, "proxy %v", r.URL.String())
+	}))
+}
+
+func getBody(g *GoXel, rawurl string) (string, error) {
+	goxel = g
+	resetTransport()
+
+	client, err := NewClient()
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %v", resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestHTTPProxyAuthentication(t *testing.T) {
+	defer resetTransport()
+	defer func(g *GoXel) { goxel = g }(goxel)
+
+	ts := startHTTPProxyStandIn("goxel", "secret")
+	defer ts.Close()
+
+	pURL, _ := url.Parse(ts.URL)
+
+	body, err := getBody(&GoXel{Proxy: "http://goxel:secret@" + pURL.Host}, "http://goxel.test/video.mp4")
+	if err != nil || body != "proxy http://goxel.test/video.mp4" {
+		t.Error("Request should go through the authenticated proxy", body, err)
+	}
+
+	if _, err := getBody(&GoXel{Proxy: "http://goxel:wrong@" + pURL.Host}, "http://goxel.test/video.mp4"); err == nil {
+		t.Error("Invalid proxy credentials should be rejected")
+	}
+}
+
+func TestSocks5Authentication(t *testing.T) {
+	defer resetTransport()
+	defer func(g *GoXel) { goxel = g }(goxel)
+
+	s := startSocksStandIn("goxel", "secret")
+	defer s.listener.Close()
+
+	body, err := getBody(&GoXel{Proxy: "socks5h://goxel:secret@" + s.listener.Addr().String()}, "http://goxel.test/video.mp4")
+	if err != nil || body != "socks" {
+		t.Error("Request should go through the authenticated SOCKS5 proxy", body, err)
+	}
+
+	if target, domain := s.last(); target != "goxel.test:80" || !domain {
+		t.Error("Host name should be resolved by the proxy", target)
+	}
+
+	if _, err := getBody(&GoXel{Proxy: "socks5h://goxel:wrong@" + s.listener.Addr().String()}, "http://goxel.test/video.mp4"); err == nil {
+		t.Error("Invalid SOCKS5 credentials should be rejected")
+	}
+}
+
+func TestSocks5LocalDNS(t *testing.T) {
+	defer resetTransport()
+	defer func(g *GoXel) { goxel = g }(goxel)
+
+	s := startSocksStandIn("", "")
+	defer s.listener.Close()
+
+	body, err := getBody(&GoXel{Proxy: "socks5://" + s.listener.Addr().String()}, "http://localhost:1234/video.mp4")
+	if err != nil || body != "socks" {
+		t.Error("Request should go through the SOCKS5 proxy", body, err)
+	}
+
+	if target, domain := s.last(); domain || net.ParseIP(target[:len(target)-len(":1234")]) == nil {
+		t.Error("Host name should be resolved locally", target)
+	}
+}
+
+func TestPerSchemeProxies(t *testing.T) {
+	p, err := buildProxyConfig(&GoXel{
+		Proxy:      "socks5://127.0.0.1:1080",
+		HTTPSProxy: "http://127.0.0.1:3128",
+	})
+	if err != nil {
+		t.Error("Proxy configuration should be valid", err)
+	}
+
+	for rawurl, expected := range map[string]string{
+		"http://test.fr/video.mp4":  "socks5://127.0.0.1:1080",
+		"https://test.fr/video.mp4": "http://127.0.0.1:3128",
+		"ftp://test.fr/video.mp4":   "",
+	} {
+		u, _ := url.Parse(rawurl)
+
+		var actual string
+		if pURL := p.proxyFor(u); pURL != nil {
+			actual = pURL.String()
+		}
+		if actual != expected {
+			t.Errorf("Invalid proxy for [%v]: [%v]", rawurl, actual)
+		}
+	}
+
+	if len(p.urls()) != 2 {
+		t.Error("Both proxies should be listed")
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	p, _ := buildProxyConfig(&GoXel{
+		Proxy:   "http://127.0.0.1:3128",
+		NoProxy: "example.com, .internal.net,10.0.0.0/8 192.168.1.1,intranet:8080,[::1]",
+	})
+
+	for rawurl, direct := range map[string]bool{
+		"http://example.com/video.mp4":          true,
+		"http://www.example.com/video.mp4":      true,
+		"http://notexample.com/video.mp4":       false,
+		"http://files.internal.net/video.mp4":   true,
+		"http://10.1.2.3/video.mp4":             true,
+		"http://11.1.2.3/video.mp4":             false,
+		"http://192.168.1.1/video.mp4":          true,
+		"http://192.168.1.2/video.mp4":          false,
+		"http://intranet:8080/video.mp4":        true,
+		"http://intranet/video.mp4":             false,
+		"http://[::1]:8080/video.mp4":           true,
+		"https://www.EXAMPLE.com:443/video.mp4": true,
+	} {
+		u, _ := url.Parse(rawurl)
+		if (p.proxyFor(u) == nil) != direct {
+			t.Errorf("Invalid no proxy match for [%v]", rawurl)
+		}
+	}
+
+	p, _ = buildProxyConfig(&GoXel{Proxy: "http://127.0.0.1:3128", NoProxy: "*"})
+	u, _ := url.Parse("http://test.fr/video.mp4")
+	if p.proxyFor(u) != nil {
+		t.Error("Wildcard should disable the proxy")
+	}
+}
+
+func TestNoProxyBypassesProxy(t *testing.T) {
+	defer resetTransport()
+	defer func(g *GoXel) { goxel = g }(goxel)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "direct")
+	}))
+	defer ts.Close()
+
+	body, err := getBody(&GoXel{Proxy: "http://127.0.0.1:1", NoProxy: "127.0.0.0/8"}, ts.URL)
+	if err != nil || body != "direct" {
+		t.Error("Request should not go through the proxy", body, err)
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	defer os.Unsetenv("HTTP_PROXY")
+	defer os.Unsetenv("no_proxy")
+
+	os.Setenv("HTTP_PROXY", "127.0.0.1:3128")
+	os.Setenv("no_proxy", "internal.net")
+
+	p, err := buildProxyConfig(&GoXel{})
+	if err != nil {
+		t.Error("Proxy configuration should be valid", err)
+	}
+
+	for rawurl, expected := range map[string]string{
+		"http://test.fr/video.mp4":       "http://127.0.0.1:3128",
+		"http://files.internal.net/a.gz": "",
+		"http://127.0.0.1:8080/a.gz":     "",
+		"http://localhost/a.gz":          "",
+		"https://test.fr/video.mp4":      "",
+	} {
+		u, _ := url.Parse(rawurl)
+
+		var actual string
+		if pURL := p.proxyFor(u); pURL != nil {
+			actual = pURL.String()
+		}
+		if actual != expected {
+			t.Errorf("Invalid proxy for [%v]: [%v]", rawurl, actual)
+		}
+	}
+
+	p, _ = buildProxyConfig(&GoXel{Proxy: "http://127.0.0.1:8123", NoProxy: "example.com"})
+	u, _ := url.Parse("http://127.0.0.1:8080/a.gz")
+	if pURL := p.proxyFor(u); pURL == nil || pURL.Host != "127.0.0.1:8123" {
+		t.Error("Command line proxy should override the environment and apply to the local host")
+	}
+}
@@ -0,0 +1,137 @@
+package goxel
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Range is a half-open range of bytes: Start is included, End is excluded
+// An empty range has Start equal to End.
+type Range struct {
+	Start, End uint64
+}
+
+// Len returns the number of bytes in the range
+func (r Range) Len() uint64 {
+	if r.End < r.Start {
+		return 0
+	}
+	return r.End - r.Start
+}
+
+// Contains checks if the byte at offset belongs to the range
+func (r Range) Contains(offset uint64) bool {
+	return offset >= r.Start && offset < r.End
+}
+
+// Split cuts the range at offset, offset belongs to the second range
+// The offset is clamped to the range so both returned ranges are always valid.
+func (r Range) Split(offset uint64) (Range, Range) {
+	if offset < r.Start {
+		offset = r.Start
+	}
+	if offset > r.End {
+		offset = r.End
+	}
+	return Range{Start: r.Start, End: offset}, Range{Start: offset, End: r.End}
+}
+
+// Merge joins two ranges, ok is false when the ranges neither overlap nor touch
+func (r Range) Merge(o Range) (merged Range, ok bool) {
+	if o.Start > r.End || r.Start > o.End {
+		return r, false
+	}
+
+	merged = r
+	if o.Start < merged.Start {
+		merged.Start = o.Start
+	}
+	if o.End > merged.End {
+		merged.End = o.End
+	}
+	return merged, true
+}
+
+// check verifies the range is well formed
+func (r Range) check() error {
+	if r.End < r.Start {
+		return fmt.Errorf("Invalid range [%d, %d): end is before start", r.Start, r.End)
+	}
+	return nil
+}
+
+// String returns the range using the interval notation
+func (r Range) String() string {
+	return fmt.Sprintf("[%d, %d)", r.Start, r.End)
+}
+
+// checkTiling verifies the ranges cover [0, size) exactly, without gaps nor overlaps
+func checkTiling(ranges []Range, size uint64) error {
+	sorted := make([]Range, len(ranges))
+	copy(sorted, ranges)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	covered := Range{}
+	for _, r := range sorted {
+		if err := r.check(); err != nil {
+			return err
+		}
+
+		if r.Start < covered.End {
+			return fmt.Errorf("Range %v overlaps %v", r, covered)
+		}
+		if r.Start > covered.End {
+			return fmt.Errorf("Gap between %v and %v", covered, r)
+		}
+		covered, _ = covered.Merge(r)
+	}
+
+	if covered.End != size {
+		return fmt.Errorf("Ranges cover %v instead of [0, %d)", covered, size)
+	}
+	return nil
+}
+
+// parseContentRange parses the value of a Content-Range header such as "bytes 0-499/1234"
+// The returned total is 0 when the server doesn't know the size of the file.
+func parseContentRange(value string) (Range, uint64, error) {
+	invalid := fmt.Errorf("Invalid Content-Range: %q", value)
+
+	if !strings.HasPrefix(value, "bytes ") {
+		return Range{}, 0, invalid
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return Range{}, 0, invalid
+	}
+
+	var total uint64
+	if parts[1] != "*" {
+		var err error
+		if total, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return Range{}, 0, invalid
+		}
+	}
+
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) != 2 {
+		return Range{}, 0, invalid
+	}
+
+	start, err := strconv.ParseUint(bounds[0], 10, 64)
+	if err != nil {
+		return Range{}, 0, invalid
+	}
+
+	// HTTP ranges include their last byte
+	last, err := strconv.ParseUint(bounds[1], 10, 64)
+	if err != nil || last < start || (total > 0 && last >= total) {
+		return Range{}, 0, invalid
+	}
+	return Range{Start: start, End: last + 1}, total, nil
+}
@@ -0,0 +1,166 @@
+package goxel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"testing/quick"
+)
+
+func TestRange(t *testing.T) {
+	r := Range{Start: 100, End: 200}
+
+	if r.Len() != 100 || (Range{Start: 100, End: 100}).Len() != 0 {
+		t.Error("Length should exclude the end of the range")
+	}
+
+	if !r.Contains(100) || !r.Contains(199) || r.Contains(200) || r.Contains(99) {
+		t.Error("Range should contain its start but not its end")
+	}
+
+	head, tail := r.Split(150)
+	if head != (Range{Start: 100, End: 150}) || tail != (Range{Start: 150, End: 200}) {
+		t.Error("Split should cut the range at the offset", head, tail)
+	}
+
+	if head, tail := r.Split(500); head != r || tail.Len() != 0 {
+		t.Error("Split outside of the range should be clamped", head, tail)
+	}
+
+	if merged, ok := head.Merge(tail); !ok || merged != r {
+		t.Error("Adjacent ranges should be merged", merged)
+	}
+
+	if _, ok := (Range{Start: 0, End: 10}).Merge(Range{Start: 11, End: 20}); ok {
+		t.Error("Disjoint ranges should not be merged")
+	}
+
+	if (Range{Start: 10, End: 5}).check() == nil {
+		t.Error("Range ending before its start should be invalid")
+	}
+}
+
+func TestCheckTiling(t *testing.T) {
+	valid := []Range{{Start: 50, End: 100}, {Start: 0, End: 50}}
+	if err := checkTiling(valid, 100); err != nil {
+		t.Error("Ranges should tile the file", err)
+	}
+
+	invalid := map[string][]Range{
+		"gap":       {{Start: 0, End: 40}, {Start: 50, End: 100}},
+		"overlap":   {{Start: 0, End: 60}, {Start: 50, End: 100}},
+		"short":     {{Start: 0, End: 50}, {Start: 50, End: 90}},
+		"long":      {{Start: 0, End: 50}, {Start: 50, End: 110}},
+		"not start": {{Start: 10, End: 100}},
+	}
+	for name, ranges := range invalid {
+		if err := checkTiling(ranges, 100); err == nil {
+			t.Error("Ranges should not tile the file:", name)
+		}
+	}
+}
+
+func TestLegacyMetadata(t *testing.T) {
+	// Previous versions used inclusive ends, the first 50 bytes were downloaded before a resume
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint64(2))
+	binary.Write(&buf, binary.BigEndian, legacyChunkRecord{Start: 50, End: 99, Done: 10, Total: 50})
+	binary.Write(&buf, binary.BigEndian, legacyChunkRecord{Start: 100, End: 199, Done: 100, Total: 100})
+
+	chunks, err := readMetadata(&buf, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkChunks(chunks, 200); err != nil {
+		t.Error("Legacy chunks should tile the file", err)
+	}
+
+	var done uint64
+	for _, chunk := range chunks {
+		done += chunk.Done
+	}
+	if done != 160 {
+		t.Error("Legacy progress should be kept, got", done)
+	}
+}
+
+// TestChunksTiling applies random sequences of downloads, splits and resumes
+// and verifies the chunks always cover the file exactly without losing progress
+func TestChunksTiling(t *testing.T) {
+	goxel = &GoXel{Resume: true}
+
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	done := func(f *File) (done uint64) {
+		for _, chunk := range f.snapshot() {
+			done += chunk.Done
+		}
+		return done
+	}
+
+	property := func(seed int64) bool {
+		rnd := rand.New(rand.NewSource(seed))
+
+		f := &File{
+			OutputWork: path.Join(dir, "work.mp4."+workExtension),
+			Size:       uint64(rnd.Intn(1 << 20)),
+		}
+		buildRootChunks(f, 1+rnd.Intn(16))
+
+		for op := 0; op < 100; op++ {
+			for i := range f.Chunks {
+				f.Chunks[i].ID = uint32(i)
+			}
+			before := done(f)
+
+			c := &f.Chunks[rnd.Intn(len(f.Chunks))]
+			switch rnd.Intn(3) {
+			case 0:
+				if _, ok := f.startChunk(c, 0); ok {
+					f.advance(c, uint64(rnd.Int63n(int64(c.Remaining())+1)))
+				}
+
+			case 1:
+				f.advance(c, c.Remaining())
+				f.rebalance(c.ID)
+
+			case 2:
+				f.writeMetadata()
+				f = &File{OutputWork: f.OutputWork, Size: f.Size}
+				if !f.ResumeChunks(1 + rnd.Intn(16)) {
+					t.Log("Resume failed")
+					return false
+				}
+				if f.Initial != before {
+					t.Log("Resumed progress doesn't match", f.Initial, before)
+					return false
+				}
+			}
+
+			if err := f.checkChunks(); err != nil {
+				t.Log(err)
+				return false
+			}
+
+			if done(f) < before {
+				t.Log("Progress was lost", done(f), before)
+				return false
+			}
+		}
+		return true
+	}
+
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,286 @@
+package goxel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var rderrors = map[int]string{
+	-1: "Internal error",
+	1:  "Missing parameter",
+	2:  "Bad parameter value",
+	3:  "Unknown method",
+	4:  "Method not allowed",
+	5:  "Slow down",
+	6:  "Resource unreachable",
+	7:  "Resource not found",
+	8:  "Bad token",
+	9:  "Permission denied",
+	10: "Two-Factor authentication needed",
+	11: "Two-Factor authentication pending",
+	12: "Invalid login",
+	13: "Invalid password",
+	14: "Account locked",
+	15: "Account not activated",
+	16: "Unsupported hoster",
+	17: "Hoster in maintenance",
+	18: "Hoster limit reached",
+	19: "Hoster temporarily unavailable",
+	20: "Hoster not available for free users",
+	21: "Too many active downloads",
+	22: "IP Address not allowed",
+	23: "Traffic exhausted",
+	24: "File unavailable",
+	25: "Service unavailable",
+	34: "Too many requests",
+	35: "Infringing file",
+	36: "Fair Usage Limit",
+}
+
+// RealDebridUser represents a Real-Debrid user as returned by the user call
+type RealDebridUser struct {
+	Username string `json:"username"`
+	Type     string `json:"type"`
+}
+
+// UnrestrictResponse represents the answer of the link's unrestricting request
+type UnrestrictResponse struct {
+	Filename string `json:"filename"`
+	Filesize uint64 `json:"filesize"`
+	Download string `json:"download"`
+}
+
+// RealDebridError represents the errors returned by Real-Debrid with an HTTP error status
+type RealDebridError struct {
+	Message string `json:"error"`
+	Code    int    `json:"error_code"`
+}
+
+func (e *RealDebridError) Error() string {
+	if message, ok := rderrors[e.Code]; ok {
+		return message
+	}
+	return e.Message
+}
+
+// RealDebridProvider is the Real-Debrid provider of the DebridURLPreprocessor, it is not a URLPreprocessor
+// and is only used through the DebridURLPreprocessor.
+// It unrestricts the links supported by Real-Debrid with the API token, the output of a file
+// is the filename returned by Real-Debrid and its size is checked. Passwords holds the
+// passwords of the protected links.
+type RealDebridProvider struct {
+	Client             *http.Client
+	Token              string
+	Initialized, UseMe bool
+	Domains            []*regexp.Regexp
+	Passwords          map[string]string
+	API                string
+	mux                sync.Mutex
+	files              map[string]UnrestrictResponse
+}
+
+const rdapi = "https://api.real-debrid.com/rest/1.0"
+
+// call sends a request to the API and decodes its response, the form is posted when set
+func (s *RealDebridProvider) call(path string, form url.Values, data interface{}) error {
+	method, body := "GET", ""
+	if form != nil {
+		method, body = "POST", form.Encode()
+	}
+
+	r, err := http.NewRequest(method, s.API+path, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+s.Token)
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	req, err := s.Client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer req.Body.Close()
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	if req.StatusCode > 399 {
+		rderr := &RealDebridError{Message: fmt.Sprintf("HTTP status %d", req.StatusCode)}
+		if err := json.Unmarshal(b, rderr); err != nil {
+			return statusError(req.StatusCode)
+		}
+		return rderr
+	}
+	return json.Unmarshal(b, data)
+}
+
+func (s *RealDebridProvider) initialize(url string) {
+	if url != "" {
+		s.API = url
+	} else {
+		s.API = rdapi
+	}
+
+	s.Client, _ = NewClient()
+	s.files = make(map[string]UnrestrictResponse)
+
+	var user RealDebridUser
+	if err := s.call("/user", nil, &user); err != nil {
+		cMessages <- NewErrorMessage("REALDEBRID", fmt.Sprintf("Following error occurred while connecting to Real-Debrid service: %v", err.Error()))
+		return
+	}
+
+	if user.Type != "premium" {
+		cMessages <- NewWarningMessage("REALDEBRID", "Non premium user are not supported, bypassing.")
+		return
+	}
+
+	cMessages <- NewInfoMessage("REALDEBRID", fmt.Sprintf("Successfully logged as [%v]", user.Username))
+	s.UseMe = true
+
+	var expressions []string
+	if err := s.call("/hosts/regex", nil, &expressions); err != nil {
+		cMessages <- NewErrorMessage("REALDEBRID", fmt.Sprintf("Can't retrieve hosts listing: %v", err.Error()))
+		return
+	}
+
+	// The expressions are delimited by slashes, the ones unsupported by the regexp package are skipped
+	s.Domains = make([]*regexp.Regexp, 0, len(expressions))
+	for _, expression := range expressions {
+		expression = strings.TrimSuffix(strings.TrimPrefix(expression, "/"), "/")
+		if re, err := regexp.Compile(expression); expression != "" && err == nil {
+			s.Domains = append(s.Domains, re)
+		}
+	}
+
+	s.Initialized = true
+}
+
+// matches checks if the link is hosted on a domain supported by Real-Debrid
+func (s *RealDebridProvider) matches(link string) bool {
+	for _, v := range s.Domains {
+		if v.MatchString(link) {
+			return true
+		}
+	}
+	return false
+}
+
+// unrestrictLink sends the unrestricting request for the link
+func (s *RealDebridProvider) unrestrictLink(link string) (UnrestrictResponse, error) {
+	form := url.Values{"link": {link}}
+	if password := s.Passwords[link]; password != "" {
+		form.Set("password", password)
+	}
+
+	var resp UnrestrictResponse
+	if err := s.call("/unrestrict/link", form, &resp); err != nil {
+		return resp, err
+	}
+
+	if resp.Download == "" {
+		return resp, rejectedError("No link was generated")
+	}
+
+	s.mux.Lock()
+	s.files[resp.Download] = resp
+	s.mux.Unlock()
+
+	return resp, nil
+}
+
+// describe returns the filename and the size returned by Real-Debrid for the download link
+func (s *RealDebridProvider) describe(link string) (string, uint64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// The file stays in the output directory whatever its name
+	file := s.files[link]
+	name := path.Base(torrentPath(file.Filename))
+	if name == "." || name == "/" {
+		name = ""
+	}
+	return name, file.Filesize
+}
+
+// realdebrid builds the Real-Debrid preprocessor from the settings, nil when Real-Debrid is not used
+// The token is taken from the arguments, the environment or the configuration, in that order.
+func (g *GoXel) realdebrid(config debridConfig) *RealDebridProvider {
+	token := g.RealdebridToken
+	if token == "" {
+		token = os.Getenv("GOXEL_REALDEBRID_TOKEN")
+	}
+	if token == "" {
+		token = config.RealDebrid.Token
+	}
+
+	if token == "" {
+		return nil
+	}
+	return &RealDebridProvider{Token: token}
+}
+
+// providerName returns the name of Real-Debrid in the messages
+func (s *RealDebridProvider) providerName() string {
+	return "Real-Debrid"
+}
+
+// setup authenticates with the token, Real-Debrid is used if the user is premium
+func (s *RealDebridProvider) setup() bool {
+	if !s.Initialized {
+		s.initialize(s.API)
+	}
+	return s.Initialized && s.UseMe
+}
+
+// supports checks if the link is hosted on a domain supported by Real-Debrid
+func (s *RealDebridProvider) supports(link string) bool {
+	return s.matches(link)
+}
+
+// debrid unrestricts the link, the file is named after the filename returned by Real-Debrid
+func (s *RealDebridProvider) debrid(ctx context.Context, link string) (debridLink, error) {
+	resp, err := s.unrestrictLink(link)
+	if err != nil {
+		return debridLink{}, &debridError{Kind: realDebridErrorKind(err), Provider: s.providerName(), Err: err}
+	}
+
+	name, size := s.describe(resp.Download)
+	return debridLink{URL: resp.Download, Name: name, Size: size}, nil
+}
+
+// realDebridErrorKind classifies the errors of Real-Debrid
+func realDebridErrorKind(err error) debridErrorKind {
+	e, ok := err.(*RealDebridError)
+	if !ok {
+		if _, ok := err.(rejectedError); ok {
+			return debridRefused
+		}
+		return debridUnreachable
+	}
+
+	switch e.Code {
+	case 5, 18, 19, 21, 23, 34, 36:
+		return debridLimited
+	case 16, 17, 20:
+		return debridUnsupported
+	case 7, 24, 35:
+		return debridUnavailable
+	case -1, 6, 25:
+		return debridUnreachable
+	}
+	return debridRefused
+}
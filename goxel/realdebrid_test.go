@@ -0,0 +1,91 @@
+package goxel
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func SetupRealDebridTest() {
+	token := func(r *http.Request) string {
+		return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+
+	http.HandleFunc("/rd/user", func(w http.ResponseWriter, r *http.Request) {
+		switch token(r) {
+		case "premiumtoken":
+			fmt.Fprintf(w, "{\"username\": \"realdebrid\", \"type\": \"premium\"}")
+		case "freetoken":
+			fmt.Fprintf(w, "{\"username\": \"realdebrid\", \"type\": \"free\"}")
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "{\"error\": \"bad_token\", \"error_code\": 8}")
+		}
+	})
+
+	http.HandleFunc("/rd/hosts/regex", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "[\"/(http|https):\\\\/\\\\/hoster\\\\.com\\\\/.+/\", \"/(?=unsupported)/\"]")
+	})
+
+	http.HandleFunc("/rd/unrestrict/link", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || token(r) != "premiumtoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "{\"error\": \"bad_token\", \"error_code\": 8}")
+			return
+		}
+
+		switch r.FormValue("link") {
+		case "http://hoster.com/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "{\"error\": \"unavailable_file\", \"error_code\": 24}")
+		case "http://hoster.com/escape":
+			fmt.Fprintf(w, "{\"filename\": \"../escape.mkv\", \"filesize\": 12, \"download\": \"http://download.com/escape\"}")
+		default:
+			fmt.Fprintf(w, "{\"filename\": \"movie.mkv\", \"filesize\": 1024, \"download\": \"http://download.com/movie\"}")
+		}
+	})
+}
+
+func TestRealDebridToken(t *testing.T) {
+	for _, token := range []string{"badtoken", "freetoken"} {
+		realdebrid := RealDebridProvider{Token: token}
+		realdebrid.initialize("http://127.0.0.1:8080/rd")
+
+		if realdebrid.Initialized || realdebrid.UseMe {
+			t.Error("Real-Debrid should not be usable", token)
+		}
+	}
+
+	realdebrid := RealDebridProvider{Token: "premiumtoken"}
+	realdebrid.initialize("http://127.0.0.1:8080/rd")
+
+	if !realdebrid.Initialized || !realdebrid.UseMe || len(realdebrid.Domains) != 1 {
+		t.Error("Real-Debrid should be usable and initialized", realdebrid.Domains)
+	}
+}
+
+func TestRealDebridUnrestrict(t *testing.T) {
+	realdebrid := RealDebridProvider{Token: "premiumtoken"}
+	realdebrid.initialize("http://127.0.0.1:8080/rd")
+
+	urls := debridWith(&realdebrid).process([]string{"http://hoster.com/movie", "http://hoster.com/unavailable", "http://other.com/video.mp4", "http://hoster.com/escape"})
+	if strings.Join(urls, " ") != "http://download.com/movie http://other.com/video.mp4 http://download.com/escape" {
+		t.Error("Supported links should be unrestricted", urls)
+	}
+
+	if name, size := realdebrid.describe("http://download.com/movie"); name != "movie.mkv" || size != 1024 {
+		t.Error("Filename and size should be returned by Real-Debrid", name, size)
+	}
+	if name, _ := realdebrid.describe("http://download.com/escape"); name != "escape.mkv" {
+		t.Error("File should stay in the output directory, got", name)
+	}
+	if name, size := realdebrid.describe("http://other.com/video.mp4"); name != "" || size != 0 {
+		t.Error("Other links should be named after their URL")
+	}
+
+	err := &RealDebridError{Message: "unavailable_file", Code: 24}
+	if err.Error() != "File unavailable" {
+		t.Error("Error codes should be described", err.Error())
+	}
+}
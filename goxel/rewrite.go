@@ -0,0 +1,131 @@
+package goxel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// RewriteRule rewrites the URLs matching its expression, the replacement can refer to the groups of the expression
+// The headers are sent with the requests of the rewritten URLs.
+type RewriteRule struct {
+	Match   string            `json:"match"`
+	Replace string            `json:"replace"`
+	Headers map[string]string `json:"headers"`
+	re      *regexp.Regexp
+}
+
+// RewriteURLPreprocessor implements the UrlPreprocessor interface with rewrite rules.
+// The rules are applied in order, a URL is rewritten by every rule matching it and
+// receives the headers of these rules, the headers of the first rules taking precedence.
+// The password of a URL is carried over to the rewritten URL.
+type RewriteURLPreprocessor struct {
+	Rules     []RewriteRule
+	Passwords map[string]string
+	mux       sync.Mutex
+	headers   map[string]map[string]string
+}
+
+// readRewriteRules reads the JSON array of rules of the file
+func readRewriteRules(file string) ([]RewriteRule, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []RewriteRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("Invalid rewrite rules %v: %v", file, err.Error())
+	}
+
+	for i := range rules {
+		if rules[i].re, err = regexp.Compile(rules[i].Match); err != nil || rules[i].Match == "" {
+			return nil, fmt.Errorf("Invalid rewrite rule [%v] in %v", rules[i].Match, file)
+		}
+	}
+	return rules, nil
+}
+
+// rewrite builds the rewrite preprocessor from the settings, nil when no rules are configured
+// The passwords of the protected links are updated with the rewritten URLs.
+func (g *GoXel) rewrite(passwords map[string]string) (*RewriteURLPreprocessor, error) {
+	if g.RewriteRulesFile == "" {
+		return nil, nil
+	}
+
+	rules, err := readRewriteRules(g.RewriteRulesFile)
+	if err != nil {
+		return nil, err
+	}
+	return &RewriteURLPreprocessor{Rules: rules, Passwords: passwords}, nil
+}
+
+// rewriteURL applies the rules to the URL and returns the headers of the rules matching it
+func (s *RewriteURLPreprocessor) rewriteURL(link string) (string, map[string]string) {
+	var headers map[string]string
+	for _, rule := range s.Rules {
+		if !rule.re.MatchString(link) {
+			continue
+		}
+		link = rule.re.ReplaceAllString(link, rule.Replace)
+
+		for name, value := range rule.Headers {
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			if _, ok := headers[name]; !ok {
+				headers[name] = value
+			}
+		}
+	}
+	return link, headers
+}
+
+// download returns the headers of the rules which rewrote the URL
+func (s *RewriteURLPreprocessor) download(link string) (Download, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	headers, ok := s.headers[link]
+	return Download{URL: link, Headers: headers}, ok
+}
+
+func (s *RewriteURLPreprocessor) process(urls []string) []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.headers = make(map[string]map[string]string)
+	output := make([]string, 0, len(urls))
+	for _, link := range urls {
+		rewritten, headers := s.rewriteURL(link)
+		if headers != nil {
+			s.headers[rewritten] = headers
+		}
+		if password, ok := s.Passwords[link]; ok && rewritten != link {
+			s.Passwords[rewritten] = password
+		}
+		output = append(output, rewritten)
+	}
+	return output
+}
+
+// dryRun prints the URLs returned by the preprocessors, one per line
+// The messages of the preprocessors are printed on the error output so the URLs can be piped.
+func (g *GoXel) dryRun(urlPreprocessors []URLPreprocessor, urls []string) {
+	release := holdMessages()
+	for _, up := range urlPreprocessors {
+		urls = up.process(urls)
+	}
+	release()
+
+	for len(cMessages) > 0 {
+		m := <-cMessages
+		fmt.Fprintf(os.Stderr, "[%v] - %7v - %v\n", m.Context, m.Type.String(), m.Content)
+	}
+	for _, url := range urls {
+		fmt.Println(url)
+	}
+}
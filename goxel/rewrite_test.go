@@ -0,0 +1,88 @@
+package goxel
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-rewrite")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "rules.json")
+	ioutil.WriteFile(file, []byte(`[
+		{"match": "^https://releases\\.example\\.com/(.*)$", "replace": "http://mirror.internal/example/$1", "headers": {"X-Mirror": "example"}},
+		{"match": "^http://mirror\\.internal/", "replace": "http://mirror.internal:8080/", "headers": {"X-Mirror": "ignored", "X-Cache": "1"}}
+	]`), 0644)
+
+	rules, err := readRewriteRules(file)
+	if err != nil || len(rules) != 2 {
+		t.Fatal("Rules should be read", rules, err)
+	}
+
+	passwords := map[string]string{"https://releases.example.com/v1/goxel.tar.gz": "secret"}
+	rewrite := &RewriteURLPreprocessor{Rules: rules, Passwords: passwords}
+	urls := rewrite.process([]string{"https://releases.example.com/v1/goxel.tar.gz", "https://other.com/file"})
+	if strings.Join(urls, " ") != "http://mirror.internal:8080/example/v1/goxel.tar.gz https://other.com/file" {
+		t.Error("URLs should be rewritten by the matching rules in order", urls)
+	}
+	if passwords[urls[0]] != "secret" || passwords[urls[1]] != "" {
+		t.Error("Passwords should be carried over to the rewritten URLs", passwords)
+	}
+
+	d := newDownload([]URLPreprocessor{rewrite}, urls[0])
+	if len(d.Headers) != 2 || d.Headers["X-Mirror"] != "example" || d.Headers["X-Cache"] != "1" {
+		t.Error("Rewritten URLs should receive the headers of their rules", d.Headers)
+	}
+	if d := newDownload([]URLPreprocessor{rewrite}, urls[1]); d.Headers != nil {
+		t.Error("Other URLs should not receive headers", d.Headers)
+	}
+
+	ioutil.WriteFile(file, []byte(`[{"match": "(", "replace": ""}]`), 0644)
+	if _, err := readRewriteRules(file); err == nil {
+		t.Error("Invalid rules should be refused")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-rewrite")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rules := path.Join(dir, "rules.json")
+	ioutil.WriteFile(rules, []byte(`[{"match": "^http://public\\.com/", "replace": "http://mirror.internal/"}]`), 0644)
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	goxel = &GoXel{
+		URLs:                  []string{"http://public.com/25MB", "not an url"},
+		OutputDirectory:       path.Join(dir, "output"),
+		MaxConnections:        4,
+		MaxConnectionsPerFile: 4,
+		RewriteRulesFile:      rules,
+		DryRun:                true,
+	}
+	goxel.Run()
+
+	w.Close()
+	os.Stdout = stdout
+	b, _ := ioutil.ReadAll(r)
+
+	if string(b) != "http://mirror.internal/25MB\n" {
+		t.Error("The rewritten URLs should be printed", string(b))
+	}
+	if _, err := os.Stat(path.Join(dir, "output")); !os.IsNotExist(err) {
+		t.Error("Nothing should be downloaded by a dry run")
+	}
+}
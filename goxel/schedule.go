@@ -0,0 +1,169 @@
+package goxel
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeConcurrency = 8
+	// scheduleInterval is the delay between two checks of the started files
+	scheduleInterval = 10 * time.Millisecond
+)
+
+// scheduler starts the files in order, only the started files have their chunks queued
+// At most ProbeConcurrency files are probed at the same time and at most MaxConcurrentFiles
+// files are probed or started without being finished, the other files are not probed yet.
+type scheduler struct {
+	g        *GoXel
+	files    []*File
+	headers  chan header
+	complete chan bool
+
+	started []*File
+	noSpace bool
+
+	// announced is the space announced for the files not started yet, it is reserved until they start
+	announced map[*File]uint64
+	pending   uint64
+}
+
+// unreserve releases the space announced for the file once it is started or skipped
+func (s *scheduler) unreserve(f *File) {
+	s.pending -= s.announced[f]
+	delete(s.announced, f)
+}
+
+// run probes and starts the files until all of them are started or the session is complete
+// The probes still running are cancelled once the session is complete.
+func (s *scheduler) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.announced = make(map[*File]uint64)
+	for _, f := range s.files {
+		if size := f.knownSize(); size > 0 {
+			s.announced[f] = size
+			s.pending += size
+		}
+	}
+
+	probed := make(chan *File)
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	var next, probing int
+	for {
+		s.started = active(s.started)
+
+		for next < len(s.files) && probing < s.g.ProbeConcurrency && probing+len(s.started) < s.g.MaxConcurrentFiles {
+			f := s.files[next]
+			next++
+
+			// Files cancelled before being probed are skipped
+			if f.failure() != "" {
+				s.unreserve(f)
+				continue
+			}
+
+			probing++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				// The URL is resolved just before the probe so it doesn't expire while the file waits
+				f.unlock(ctx, s.g.OutputDirectory, s.g.OverwriteOutputFile)
+				if f.failure() == "" {
+					f.probe(ctx, s.g.MaxConnectionsPerFile)
+				}
+				select {
+				case probed <- f:
+				case <-ctx.Done():
+				}
+			}()
+		}
+
+		if next == len(s.files) && probing == 0 {
+			return
+		}
+
+		select {
+		case f := <-probed:
+			probing--
+			s.unreserve(f)
+			if s.start(f) {
+				s.started = append(s.started, f)
+			}
+
+		case <-ticker.C:
+
+		case <-s.complete:
+			return
+		}
+	}
+}
+
+// start prepares the output of a probed file and queues its chunks
+// It returns false when the file can't be downloaded.
+func (s *scheduler) start(f *File) bool {
+	if f.failure() != "" || !f.isValid() {
+		return false
+	}
+
+	// The space of the started files which is not written yet is reserved, as well as the space
+	// announced for the next files
+	reserved := make([]*File, 0, len(s.started)+1)
+	reserved = append(append(reserved, s.started...), f)
+	if err := checkDiskSpace(s.g.OutputDirectory, reserved, s.pending); err != nil {
+		f.setError(err.Error())
+		return false
+	}
+
+	if s.g.Preallocate && !s.noSpace {
+		if err := f.preallocate(); err != nil {
+			if isNoSpaceError(err) {
+				s.noSpace = true
+				cMessages <- NewErrorMessage("DISK", noSpaceMessage)
+			} else {
+				f.setError(fmt.Sprintf("Can't preallocate file: %v", err.Error()))
+				return false
+			}
+		}
+	}
+
+	// Remaining files are not started once the disk is full
+	if s.noSpace {
+		f.setError(noSpaceMessage)
+		return false
+	}
+
+	if err := f.open(); err != nil {
+		f.setError(fmt.Sprintf("Can't open file: %v", err.Error()))
+		return false
+	}
+
+	return f.QueueChunks(s.headers, s.complete)
+}
+
+// active returns the files which are neither finished nor in error
+// Completed files are finished right away so the next files don't wait for the monitoring.
+func active(files []*File) []*File {
+	running := files[:0]
+	for _, f := range files {
+		if f.isFinished() || f.failure() != "" {
+			continue
+		}
+
+		if f.remaining() == 0 {
+			f.finish()
+			continue
+		}
+		running = append(running, f)
+	}
+	return running
+}
@@ -0,0 +1,173 @@
+package goxel
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyServer serves the same content on every path and records the highest number
+// of simultaneous HEAD requests, GET requests and files downloaded at the same time
+type concurrencyServer struct {
+	mux             sync.Mutex
+	heads, maxHeads int
+	gets, maxGets   int
+	files           map[string]int
+	maxFiles        int
+	content         []byte
+	*httptest.Server
+}
+
+func startConcurrencyServer(content []byte) *concurrencyServer {
+	s := &concurrencyServer{files: make(map[string]int), content: content}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			s.track(func() { s.heads++ }, func() int { return s.heads }, &s.maxHeads)
+			defer s.track(func() { s.heads-- }, nil, nil)
+
+			time.Sleep(10 * time.Millisecond)
+		} else {
+			s.track(func() { s.gets++ }, func() int { return s.gets }, &s.maxGets)
+			defer s.track(func() { s.gets-- }, nil, nil)
+
+			s.track(func() { s.files[r.URL.Path]++ }, func() int { return len(s.files) }, &s.maxFiles)
+			defer s.track(func() {
+				if s.files[r.URL.Path]--; s.files[r.URL.Path] == 0 {
+					delete(s.files, r.URL.Path)
+				}
+			}, nil, nil)
+		}
+
+		http.ServeContent(&throttledWriter{w}, r, "content", time.Now(), bytes.NewReader(s.content))
+	}))
+	return s
+}
+
+func (s *concurrencyServer) track(update func(), current func() int, max *int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	update()
+	if current != nil && current() > *max {
+		*max = current()
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, 32*1024)
+	rand.Read(content)
+
+	ts := startConcurrencyServer(content)
+	defer ts.Close()
+
+	var urls []string
+	for i := 0; i < 30; i++ {
+		urls = append(urls, fmt.Sprintf("%v/file%d", ts.URL, i))
+	}
+
+	g := &GoXel{
+		URLs:                  urls,
+		Headers:               map[string]string{},
+		OutputDirectory:       dir,
+		MaxConnections:        4,
+		MaxConnectionsPerFile: 2,
+		MaxConcurrentFiles:    3,
+		ProbeConcurrency:      2,
+		Quiet:                 true,
+		BufferSize:            16,
+		Resume:                true,
+	}
+	resetTransport()
+	g.Run()
+
+	for i := range urls {
+		b, _ := ioutil.ReadFile(path.Join(dir, fmt.Sprintf("file%d", i)))
+		if !bytes.Equal(b, content) {
+			t.Error("File should be downloaded", i)
+		}
+	}
+
+	if ts.maxHeads > 2 || ts.maxHeads == 0 {
+		t.Error("Probes should be bounded, got", ts.maxHeads)
+	}
+	if ts.maxFiles > 3 || ts.maxFiles == 0 {
+		t.Error("Started files should be bounded, got", ts.maxFiles)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+
+	ts := startConcurrencyServer(content)
+	defer ts.Close()
+
+	var urls []string
+	for i := 0; i < 20; i++ {
+		urls = append(urls, fmt.Sprintf("%v/cancelled%d", ts.URL, i))
+	}
+
+	g := &GoXel{
+		URLs:                  urls,
+		Headers:               map[string]string{},
+		OutputDirectory:       dir,
+		MaxConnections:        2,
+		MaxConnectionsPerFile: 2,
+		MaxConcurrentFiles:    1,
+		Quiet:                 true,
+		BufferSize:            16,
+		Resume:                true,
+	}
+	done := startControlledRun(t, g)
+
+	// Files which are not probed yet are never started
+	files := g.files()
+	g.CancelAll()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Cancelled run should stop")
+	}
+
+	for _, f := range files[1:] {
+		if f.isValid() {
+			t.Error("Waiting files should not be probed", f.ID)
+		}
+	}
+}
+
+func TestSchedulerReservation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &scheduler{g: &GoXel{OutputDirectory: dir}, pending: 1 << 62}
+	f := &File{Output: path.Join(dir, "video.mp4"), Size: 1024, Valid: true}
+	if s.start(f) || f.failure() == "" {
+		t.Error("Files should not use the space announced for the next files")
+	}
+}
@@ -0,0 +1,50 @@
+package goxel
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func getTermios(fd int) (*syscall.Termios, error) {
+	termios := &syscall.Termios{}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ioctlGetTermios, uintptr(unsafe.Pointer(termios))); errno != 0 {
+		return nil, errno
+	}
+	return termios, nil
+}
+
+func setTermios(fd int, termios *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ioctlSetTermios, uintptr(unsafe.Pointer(termios))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isTerminal checks if the file descriptor is a terminal
+func isTerminal(fd int) bool {
+	_, err := getTermios(fd)
+	return err == nil
+}
+
+// rawTerminal disables the line buffering and the echo of the terminal so keys are read as they are typed
+// Signals and output processing are kept. The returned function restores the previous state.
+func rawTerminal(fd int) (func(), error) {
+	previous, err := getTermios(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := *previous
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO
+	// Reads return after a tenth of a second without key so the reader can stop
+	raw.Cc[syscall.VMIN] = 0
+	raw.Cc[syscall.VTIME] = 1
+
+	if err := setTermios(fd, &raw); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		setTermios(fd, previous)
+	}, nil
+}
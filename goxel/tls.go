@@ -0,0 +1,208 @@
+package goxel
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const pinPrefix = "sha256//"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// hostOptionFlag is used to parse options that can be restricted to a single host on the CLI
+// Values are either "value" to apply to all hosts or "host=value" to apply to one host only
+type hostOptionFlag []string
+
+func (h *hostOptionFlag) String() string {
+	return fmt.Sprintf("%v", *h)
+}
+
+func (h *hostOptionFlag) Set(value string) error {
+	*h = append(*h, value)
+	return nil
+}
+
+func (h *hostOptionFlag) Type() string {
+	return "[host=]value"
+}
+
+// splitHostOption splits a "host=value" option, host is empty when the option applies to all hosts
+func splitHostOption(option string) (string, string) {
+	idx := strings.Index(option, "=")
+	if idx <= 0 || strings.ContainsAny(option[:idx], "/\\") {
+		return "", option
+	}
+	return option[:idx], option[idx+1:]
+}
+
+// tlsProfile stores the TLS options applicable to a host
+type tlsProfile struct {
+	CACert, ClientCert, ClientKey, MinVersion string
+	Pins                                      []string
+}
+
+// merge fills the unset options of the profile with the ones of the parent profile
+func (p *tlsProfile) merge(parent *tlsProfile) {
+	if p.CACert == "" {
+		p.CACert = parent.CACert
+	}
+	if p.ClientCert == "" && p.ClientKey == "" {
+		p.ClientCert, p.ClientKey = parent.ClientCert, parent.ClientKey
+	}
+	if p.MinVersion == "" {
+		p.MinVersion = parent.MinVersion
+	}
+	if len(p.Pins) == 0 {
+		p.Pins = parent.Pins
+	}
+}
+
+// buildTLSProfiles groups the TLS options by host
+// The profile stored with the empty key applies to all hosts without a dedicated profile.
+// Nil is returned when no TLS option has been configured.
+func buildTLSProfiles(g *GoXel) map[string]*tlsProfile {
+	profiles := make(map[string]*tlsProfile)
+	get := func(option string) (*tlsProfile, string) {
+		host, value := splitHostOption(option)
+		if _, ok := profiles[host]; !ok {
+			profiles[host] = &tlsProfile{}
+		}
+		return profiles[host], value
+	}
+
+	for _, option := range g.CACertificates {
+		p, v := get(option)
+		p.CACert = v
+	}
+	for _, option := range g.ClientCertificates {
+		p, v := get(option)
+		p.ClientCert = v
+	}
+	for _, option := range g.ClientKeys {
+		p, v := get(option)
+		p.ClientKey = v
+	}
+	for _, option := range g.TLSMinVersions {
+		p, v := get(option)
+		p.MinVersion = v
+	}
+	for _, option := range g.PinnedPublicKeys {
+		p, v := get(option)
+		p.Pins = append(p.Pins, v)
+	}
+
+	if len(profiles) == 0 && !g.IgnoreSSLVerification {
+		return nil
+	}
+
+	if _, ok := profiles[""]; !ok {
+		profiles[""] = &tlsProfile{}
+	}
+	for host, p := range profiles {
+		if host != "" {
+			p.merge(profiles[""])
+		}
+	}
+	return profiles
+}
+
+// config builds the tls.Config matching the profile
+func (p *tlsProfile) config(insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+
+	if p.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := ioutil.ReadFile(p.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read CA certificate [%v]: %v", p.CACert, err.Error())
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No valid certificate found in CA file [%v]", p.CACert)
+		}
+		config.RootCAs = pool
+	}
+
+	if p.ClientCert != "" || p.ClientKey != "" {
+		if p.ClientCert == "" || p.ClientKey == "" {
+			return nil, errors.New("Both client certificate and client key must be provided")
+		}
+
+		cert, err := tls.LoadX509KeyPair(p.ClientCert, p.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Can't load client certificate [%v]: %v", p.ClientCert, err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if p.MinVersion != "" {
+		version, ok := tlsVersions[p.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Invalid TLS version [%v], expected one of 1.0, 1.1, 1.2 or 1.3", p.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(p.Pins) > 0 {
+		pins := make(map[string]bool, len(p.Pins))
+		for _, pin := range p.Pins {
+			if !strings.HasPrefix(pin, pinPrefix) {
+				return nil, fmt.Errorf("Invalid public key pin [%v], expected %v<base64 hash>", pin, pinPrefix)
+			}
+			pins[strings.TrimPrefix(pin, pinPrefix)] = true
+		}
+		config.VerifyPeerCertificate = verifyPins(pins, insecure)
+	}
+
+	return config, nil
+}
+
+// verifyPins ensures at least one certificate of the verified chains matches one of the SPKI pins
+// The certificates presented by the server are only used when the verification is disabled, they
+// could include any certificate otherwise.
+func verifyPins(pins map[string]bool, insecure bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if !insecure {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					if pins[spkiHash(cert)] {
+						return nil
+					}
+				}
+			}
+			return errors.New("No certificate matches the pinned public keys")
+		}
+
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				continue
+			}
+
+			if pins[spkiHash(cert)] {
+				return nil
+			}
+		}
+		return errors.New("No certificate matches the pinned public keys")
+	}
+}
+
+// spkiHash returns the base64 SHA-256 hash of the certificate's public key
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,234 @@
+package goxel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	Cert              *x509.Certificate
+	Key               *ecdsa.PrivateKey
+	CertFile, KeyFile string
+}
+
+func createTestCertificate(dir, name string, parent *testCertificate, isCA bool) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.Cert, parent.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	c := &testCertificate{
+		Cert:     cert,
+		Key:      key,
+		CertFile: path.Join(dir, name+".crt"),
+		KeyFile:  path.Join(dir, name+".key"),
+	}
+	ioutil.WriteFile(c.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(c.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return c
+}
+
+// startTLSServer starts a server presenting the certificate followed by the extra certificates
+func startTLSServer(server, clientCA *testCertificate, extra ...*testCertificate) *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{server.Cert.Raw},
+		PrivateKey:  server.Key,
+	}
+	for _, c := range extra {
+		cert.Certificate = append(cert.Certificate, c.Cert.Raw)
+	}
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.Cert)
+		ts.TLS.ClientCAs = pool
+		ts.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	ts.StartTLS()
+	return ts
+}
+
+func getWithGoXel(g *GoXel, url string) error {
+	goxel = g
+	resetTransport()
+
+	client, err := NewClient()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func TestSplitHostOption(t *testing.T) {
+	for option, expected := range map[string][2]string{
+		"/tmp/ca.pem":                     {"", "/tmp/ca.pem"},
+		"example.com=/tmp/ca.pem":         {"example.com", "/tmp/ca.pem"},
+		"sha256//AAAA=":                   {"", "sha256//AAAA="},
+		"example.com=sha256//AAAA=":       {"example.com", "sha256//AAAA="},
+		"1.2":                             {"", "1.2"},
+		"/tmp/dir=with=equals/ca.pem":     {"", "/tmp/dir=with=equals/ca.pem"},
+		"127.0.0.1=/tmp/dir=x/client.pem": {"127.0.0.1", "/tmp/dir=x/client.pem"},
+	} {
+		host, value := splitHostOption(option)
+		if host != expected[0] || value != expected[1] {
+			t.Errorf("Invalid split for [%v]: [%v] [%v]", option, host, value)
+		}
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	defer resetTransport()
+	defer func(g *GoXel) { goxel = g }(goxel)
+
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := createTestCertificate(dir, "ca", nil, true)
+	server := createTestCertificate(dir, "server", ca, false)
+	client := createTestCertificate(dir, "client", ca, false)
+	other := createTestCertificate(dir, "other", nil, true)
+
+	ts := startTLSServer(server, ca)
+	defer ts.Close()
+
+	if err := getWithGoXel(&GoXel{}, ts.URL); err == nil {
+		t.Error("Unknown CA should be rejected")
+	}
+
+	if err := getWithGoXel(&GoXel{CACertificates: []string{ca.CertFile}}, ts.URL); err == nil {
+		t.Error("Missing client certificate should be rejected")
+	}
+
+	valid := &GoXel{
+		CACertificates:     []string{ca.CertFile},
+		ClientCertificates: []string{client.CertFile},
+		ClientKeys:         []string{client.KeyFile},
+	}
+	if err := getWithGoXel(valid, ts.URL); err != nil {
+		t.Error("Mutual TLS should succeed", err)
+	}
+
+	valid.PinnedPublicKeys = []string{pinPrefix + spkiHash(server.Cert)}
+	if err := getWithGoXel(valid, ts.URL); err != nil {
+		t.Error("Pinned public key should match", err)
+	}
+
+	valid.PinnedPublicKeys = []string{pinPrefix + spkiHash(other.Cert)}
+	if err := getWithGoXel(valid, ts.URL); err == nil {
+		t.Error("Pinned public key should not match")
+	}
+
+	// Certificates appended to a valid chain are not part of the verified chain
+	appended := startTLSServer(server, ca, other)
+	defer appended.Close()
+
+	valid.PinnedPublicKeys = []string{pinPrefix + spkiHash(other.Cert)}
+	if err := getWithGoXel(valid, appended.URL); err == nil {
+		t.Error("Pinned public key appended to the chain should not match")
+	}
+
+	insecure := &GoXel{
+		IgnoreSSLVerification: true,
+		ClientCertificates:    []string{client.CertFile},
+		ClientKeys:            []string{client.KeyFile},
+		PinnedPublicKeys:      []string{pinPrefix + spkiHash(other.Cert)},
+	}
+	if err := getWithGoXel(insecure, appended.URL); err != nil {
+		t.Error("Presented certificates should be pinned when the verification is disabled", err)
+	}
+
+	perHost := &GoXel{
+		CACertificates:     []string{"127.0.0.1=" + ca.CertFile},
+		ClientCertificates: []string{"127.0.0.1=" + client.CertFile},
+		ClientKeys:         []string{"127.0.0.1=" + client.KeyFile},
+		TLSMinVersions:     []string{"1.2"},
+	}
+	if err := getWithGoXel(perHost, ts.URL); err != nil {
+		t.Error("Host options should be used", err)
+	}
+
+	otherHost := &GoXel{
+		CACertificates:     []string{"localhost=" + ca.CertFile},
+		ClientCertificates: []string{"localhost=" + client.CertFile},
+		ClientKeys:         []string{"localhost=" + client.KeyFile},
+	}
+	if err := getWithGoXel(otherHost, ts.URL); err == nil {
+		t.Error("Options for another host should not be used")
+	}
+}
+
+func TestInvalidTLSOptions(t *testing.T) {
+	defer resetTransport()
+	defer func(g *GoXel) { goxel = g }(goxel)
+
+	for _, g := range []*GoXel{
+		{CACertificates: []string{"/does/not/exist.pem"}},
+		{ClientCertificates: []string{"/does/not/exist.pem"}},
+		{TLSMinVersions: []string{"2.0"}},
+		{PinnedPublicKeys: []string{"md5//AAAA"}},
+	} {
+		goxel = g
+		resetTransport()
+		if _, err := NewClient(); err == nil {
+			t.Errorf("Options %+v should be rejected", g)
+		}
+	}
+}
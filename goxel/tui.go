@@ -0,0 +1,418 @@
+package goxel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	tuiMessageRows = 5
+	tuiMaxMessages = 100
+	tuiHelp        = "up/down select  p pause  r resume  t retry  d remove  P/R pause/resume all  Ctrl-C quit"
+)
+
+// controller is the set of runtime controls used by the TUI, it is implemented by GoXel
+type controller interface {
+	PauseFile(id uint32) error
+	ResumeFile(id uint32) error
+	RetryFile(id uint32) error
+	RemoveFile(id uint32) error
+	PauseAll()
+	ResumeAll()
+}
+
+// TUIMonitoring displays the downloads in a full screen terminal interface
+// The files are listed in a scrollable list with their speed and ETA, followed by the messages.
+// Only the lines which changed since the previous frame are written to the terminal.
+type TUIMonitoring struct {
+	out      io.Writer
+	controls controller
+	size     func() (int, int)
+
+	mux              sync.Mutex
+	statuses         []fileStatus
+	selected, offset int
+	selectedFile     *File
+	escape           []byte
+
+	count    uint64
+	cache    statusCache
+	speeds   map[*File]*speedWindow
+	frame    bytes.Buffer
+	previous []string
+	clear    bool
+	resized  chan os.Signal
+}
+
+// NewTUIMonitoring builds a TUI writing to out and using the controls on key presses
+func NewTUIMonitoring(out io.Writer, controls controller) *TUIMonitoring {
+	return &TUIMonitoring{
+		out:      out,
+		controls: controls,
+		size:     terminalSize,
+		speeds:   make(map[*File]*speedWindow),
+		resized:  make(chan os.Signal, 1),
+	}
+}
+
+// start switches to the alternate screen and hides the cursor
+func (t *TUIMonitoring) start() {
+	signal.Notify(t.resized, syscall.SIGWINCH)
+	fmt.Fprint(t.out, "\033[?1049h\033[?25l")
+	t.clear = true
+}
+
+// reset shows the cursor and leaves the alternate screen
+func (t *TUIMonitoring) reset() {
+	fmt.Fprint(t.out, "\033[?25h\033[?1049l")
+}
+
+// stop restores the screen and prints the totals with the files in error or cancelled
+func (t *TUIMonitoring) stop(files []*File) {
+	signal.Stop(t.resized)
+	t.reset()
+
+	statuses, _ := t.cache.update(files, false)
+	var sum summary
+	var removed int
+	for _, s := range statuses {
+		if s.Removed {
+			removed++
+		}
+		sum.add(s)
+	}
+	fmt.Fprintf(t.out, "%d done, %d errors, %d cancelled, %d unfinished - %v / %v\n",
+		sum.Finished, sum.Failed, removed, sum.Running+sum.Paused+sum.Waiting, humanize.Bytes(sum.Done), humanize.Bytes(sum.Size))
+
+	// Only the files which were not downloaded are listed, a batch can have thousands of files
+	for _, s := range statuses {
+		if s.Removed || s.Error != "" {
+			fmt.Fprintf(t.out, "[%3d] %v: %v\n", s.File.ID, s.Output, statusLabel(s))
+		}
+	}
+}
+
+func (t *TUIMonitoring) monitor(files []*File, messages []string) (int, []string) {
+	statuses, finished := t.cache.update(files, t.count%10 == 0)
+	t.count++
+
+	if len(messages) > tuiMaxMessages {
+		messages = messages[len(messages)-tuiMaxMessages:]
+	}
+
+	select {
+	case <-t.resized:
+		t.clear = true
+	default:
+	}
+
+	width, height := t.size()
+
+	now := time.Now()
+	var sum summary
+	for i := range statuses {
+		statuses[i].Speed = fileSpeed(t.speeds, statuses[i], now)
+		sum.add(statuses[i])
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	lines := t.render(width, height, statuses, sum, messages)
+	t.out.Write(t.draw(lines))
+	t.clear = false
+
+	return finished, messages
+}
+
+// render builds the lines of the frame, it must be called with the Mux held
+// When there are more files than rows, the finished files are collapsed in a single line.
+func (t *TUIMonitoring) render(width, height int, statuses []fileStatus, sum summary, messages []string) []string {
+	messageRows := tuiMessageRows
+	if len(messages) < messageRows {
+		messageRows = len(messages)
+	}
+
+	// Title, separators, details, messages and help
+	rows := height - 5 - messageRows
+	if rows < 1 {
+		rows = 1
+	}
+
+	var visible int
+	for _, s := range statuses {
+		if !s.Removed {
+			visible++
+		}
+	}
+	compact := visible > rows
+
+	var hidden int
+	t.statuses = t.statuses[:0]
+	for _, s := range statuses {
+		switch {
+		case s.Removed:
+		case compact && s.Finished:
+			hidden++
+		default:
+			t.statuses = append(t.statuses, s)
+		}
+	}
+
+	if hidden > 0 {
+		rows--
+	}
+	t.relocate()
+	t.scroll(rows)
+
+	lines := []string{
+		fit(fmt.Sprintf("GoXel v%.1f  %d files  %s", version, visible, sum.String()), width),
+		strings.Repeat("-", width),
+	}
+
+	for i := t.offset; i < t.offset+rows; i++ {
+		if i >= len(t.statuses) {
+			lines = append(lines, "")
+			continue
+		}
+
+		line := t.fileLine(t.statuses[i], width, !compact)
+		if i == t.selected {
+			line = "\033[7m" + line + "\033[0m"
+		}
+		lines = append(lines, line)
+	}
+
+	if hidden > 0 {
+		lines = append(lines, fit(fmt.Sprintf("      %d finished files", hidden), width))
+	}
+
+	details := ""
+	if t.selected < len(t.statuses) {
+		s := t.statuses[t.selected]
+		details = fmt.Sprintf("%v: %v", s.Output, statusLabel(s))
+	}
+	lines = append(lines, fit(details, width), strings.Repeat("-", width))
+
+	for _, message := range messages[len(messages)-messageRows:] {
+		lines = append(lines, fit(message, width))
+	}
+	lines = append(lines, fit(tuiHelp, width))
+
+	for len(lines) < height {
+		lines = append(lines, "")
+	}
+	return lines[:height]
+}
+
+// draw returns the control sequences updating the terminal with the lines of the frame
+// The whole screen is only drawn after a resize, otherwise the unchanged lines are skipped.
+func (t *TUIMonitoring) draw(lines []string) []byte {
+	t.frame.Reset()
+
+	full := t.clear || len(t.previous) != len(lines)
+	if full {
+		t.frame.WriteString("\033[2J")
+	}
+
+	for i, line := range lines {
+		if !full && line == t.previous[i] {
+			continue
+		}
+
+		fmt.Fprintf(&t.frame, "\033[%d;1H", i+1)
+		t.frame.WriteString(line)
+		t.frame.WriteString("\033[K")
+	}
+
+	t.previous = lines
+	return t.frame.Bytes()
+}
+
+// fileLine describes a file in a line of the given width, the progress bar is only shown when bar is set
+func (t *TUIMonitoring) fileLine(s fileStatus, width int, bar bool) string {
+	prefix := fmt.Sprintf("[%3d] ", s.File.ID)
+	label := statusLabel(s)
+	if s.Error != "" {
+		label = "ERROR"
+	}
+
+	remaining := float64(s.Size) - float64(s.Done)
+	suffix := fmt.Sprintf(" %6.2f%% %10s/s %8s %-7s", s.Ratio, humanize.Bytes(uint64(s.Speed)), eta(remaining, s.Speed), label)
+
+	available := width - utf8.RuneCountInString(prefix) - utf8.RuneCountInString(suffix)
+	nameWidth := available * 2 / 5
+	if nameWidth < 10 || !bar {
+		nameWidth = available
+	}
+	barWidth := available - nameWidth - 3
+
+	var line bytes.Buffer
+	line.WriteString(prefix)
+	line.WriteString(fit(path.Base(s.Output), nameWidth))
+	if barWidth >= 5 {
+		line.WriteString(" [")
+		if s.Valid && s.Size > 0 && s.Error == "" {
+			progress := s.File.BuildProgress(float64(barWidth) / float64(s.Size))
+			if len(progress) > barWidth {
+				progress = progress[:barWidth]
+			}
+			line.Write(progress)
+			line.WriteString(strings.Repeat(" ", barWidth-len(progress)))
+		} else {
+			line.WriteString(strings.Repeat(" ", barWidth))
+		}
+		line.WriteString("]")
+	}
+	line.WriteString(suffix)
+
+	return fit(line.String(), width)
+}
+
+// relocate selects again the selected file once the list changed, it must be called with the Mux held
+func (t *TUIMonitoring) relocate() {
+	for i, s := range t.statuses {
+		if s.File == t.selectedFile {
+			t.selected = i
+			return
+		}
+	}
+}
+
+// move changes the selected file, it must be called with the Mux held
+func (t *TUIMonitoring) move(selected int) {
+	t.selected = selected
+	if t.selected >= len(t.statuses) {
+		t.selected = len(t.statuses) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+
+	t.selectedFile = nil
+	if t.selected < len(t.statuses) {
+		t.selectedFile = t.statuses[t.selected].File
+	}
+}
+
+// scroll keeps the selected file visible, it must be called with the Mux held
+func (t *TUIMonitoring) scroll(rows int) {
+	t.move(t.selected)
+
+	if t.selected < t.offset {
+		t.offset = t.selected
+	}
+	if t.selected >= t.offset+rows {
+		t.offset = t.selected - rows + 1
+	}
+	if t.offset > len(t.statuses)-rows {
+		t.offset = len(t.statuses) - rows
+	}
+	if t.offset < 0 {
+		t.offset = 0
+	}
+}
+
+// key handles a key typed by the user, escape sequences are read one byte at a time
+func (t *TUIMonitoring) key(key byte) {
+	t.mux.Lock()
+
+	// A lone ESC doesn't start a sequence, the key is handled normally
+	if len(t.escape) == 1 && key != '[' {
+		t.escape = nil
+	}
+
+	if len(t.escape) > 0 || key == 0x1b {
+		t.escape = append(t.escape, key)
+		sequence := string(t.escape)
+		switch {
+		case sequence == "\033[A":
+			t.move(t.selected - 1)
+		case sequence == "\033[B":
+			t.move(t.selected + 1)
+		case sequence == "\033[5~":
+			t.move(t.selected - 10)
+		case sequence == "\033[6~":
+			t.move(t.selected + 10)
+		case sequence == "\033[H":
+			t.move(0)
+		case sequence == "\033[F":
+			t.move(len(t.statuses) - 1)
+		case len(t.escape) < 4 && (len(t.escape) < 2 || t.escape[1] == '['):
+			// The sequence is not complete yet
+			t.mux.Unlock()
+			return
+		}
+		t.escape = nil
+		t.mux.Unlock()
+		return
+	}
+
+	var id uint32
+	selected := t.selectedFile != nil
+	if selected {
+		id = t.selectedFile.ID
+	}
+
+	switch key {
+	case 'k':
+		t.move(t.selected - 1)
+	case 'j':
+		t.move(t.selected + 1)
+	}
+	t.mux.Unlock()
+
+	var err error
+	switch {
+	case key == 'P':
+		t.controls.PauseAll()
+	case key == 'R':
+		t.controls.ResumeAll()
+	case !selected:
+	case key == 'p':
+		err = t.controls.PauseFile(id)
+	case key == 'r':
+		err = t.controls.ResumeFile(id)
+	case key == 't':
+		err = t.controls.RetryFile(id)
+	case key == 'd':
+		err = t.controls.RemoveFile(id)
+	}
+
+	if err != nil {
+		cMessages <- NewWarningMessage("CONTROL", err.Error())
+	}
+}
+
+// eta formats the time needed to download the remaining bytes
+func eta(remaining, speed float64) string {
+	if speed <= 0 {
+		return "--:--:--"
+	}
+	return fmtDuration(uint64(remaining / speed))
+}
+
+// fit truncates or pads s to the given number of characters
+func fit(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+
+	count := utf8.RuneCountInString(s)
+	if count > width {
+		runes := []rune(s)
+		return string(runes[:width])
+	}
+	return s + strings.Repeat(" ", width-count)
+}
@@ -0,0 +1,211 @@
+package goxel
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var cursorPosition = regexp.MustCompile(`\033\[\d+;1H`)
+
+// screenLines returns the lines written in a frame without the control sequences
+func screenLines(frame string) []string {
+	var lines []string
+	for _, line := range cursorPosition.Split(frame, -1)[1:] {
+		line = strings.NewReplacer("\033[7m", "", "\033[0m", "", "\033[K", "", "\033[2J", "").Replace(line)
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// recordingController records the controls requested by the TUI
+type recordingController struct {
+	actions []string
+}
+
+func (c *recordingController) record(action string, id uint32) error {
+	c.actions = append(c.actions, action+string(rune('0'+id)))
+	return nil
+}
+
+func (c *recordingController) PauseFile(id uint32) error  { return c.record("pause", id) }
+func (c *recordingController) ResumeFile(id uint32) error { return c.record("resume", id) }
+func (c *recordingController) RetryFile(id uint32) error  { return c.record("retry", id) }
+func (c *recordingController) RemoveFile(id uint32) error { return c.record("remove", id) }
+func (c *recordingController) PauseAll()                  { c.actions = append(c.actions, "pause") }
+func (c *recordingController) ResumeAll()                 { c.actions = append(c.actions, "resume") }
+
+func buildTUI(width, height int) (*TUIMonitoring, *bytes.Buffer, *recordingController) {
+	var out bytes.Buffer
+	controls := &recordingController{}
+
+	t := NewTUIMonitoring(&out, controls)
+	t.size = func() (int, int) { return width, height }
+	return t, &out, controls
+}
+
+func testFiles() []*File {
+	return []*File{
+		{ID: 0, Output: "/tmp/first.bin", Size: 100, Valid: true, Chunks: []Chunk{{Range: Range{Start: 0, End: 100}, Done: 50}}},
+		{ID: 1, Output: "/tmp/second.bin", Size: 100, Valid: true, paused: true, Chunks: []Chunk{{Range: Range{Start: 0, End: 100}, Done: 20}}},
+		{ID: 2, Output: "/tmp/third.bin", Error: "Cancelled", removed: true},
+		{ID: 3, Output: "/tmp/fourth.bin", Error: "Too many retries"},
+	}
+}
+
+func TestTUIRender(t *testing.T) {
+	tui, out, _ := buildTUI(120, 20)
+	files := testFiles()
+
+	finished, _ := tui.monitor(files, []string{"[HEAD] - WARNING - first message"})
+	if finished != 2 {
+		t.Error("Files in error should be counted as finished, got", finished)
+	}
+
+	frame := out.String()
+	for _, expected := range []string{"first.bin", "second.bin", "PAUSED", "fourth.bin", "ERROR", "first message", "70 B / 200 B"} {
+		if !strings.Contains(frame, expected) {
+			t.Error("Frame should contain", expected)
+		}
+	}
+
+	if strings.Contains(frame, "third.bin") {
+		t.Error("Removed files should be hidden")
+	}
+
+	lines := screenLines(frame)
+	if len(lines) != 20 {
+		t.Error("Frame should fill the terminal height, got", len(lines))
+	}
+	for _, line := range lines {
+		if len([]rune(line)) > 120 {
+			t.Error("Line should fit the terminal width", line)
+		}
+	}
+
+	// Unchanged lines are not written again
+	out.Reset()
+	tui.monitor(files, []string{"[HEAD] - WARNING - first message"})
+	if out.Len() != 0 {
+		t.Error("Unchanged frame should not be written", out.String())
+	}
+
+	files[0].advance(&files[0].Chunks[0], 10)
+	out.Reset()
+	tui.monitor(files, []string{"[HEAD] - WARNING - first message"})
+	if lines := screenLines(out.String()); len(lines) != 2 {
+		t.Error("Only the header and the progressed file should be written, got", lines)
+	}
+}
+
+func TestTUIKeys(t *testing.T) {
+	tui, _, controls := buildTUI(120, 20)
+	files := testFiles()
+	tui.monitor(files, nil)
+
+	// Down twice skips the removed file, up comes back to the second file
+	for _, key := range []byte("j\033[B\033[At") {
+		tui.key(key)
+	}
+	tui.monitor(files, nil)
+	// The key typed after a lone ESC is not dropped
+	for _, key := range []byte("pP\033r") {
+		tui.key(key)
+	}
+
+	expected := []string{"retry1", "pause1", "pause", "resume1"}
+	if strings.Join(controls.actions, " ") != strings.Join(expected, " ") {
+		t.Error("Unexpected actions", controls.actions)
+	}
+}
+
+func TestTUIScroll(t *testing.T) {
+	tui, out, _ := buildTUI(80, 8)
+
+	files := make([]*File, 10)
+	for i := range files {
+		files[i] = &File{ID: uint32(i), Output: fmt.Sprintf("/tmp/file%d", i)}
+	}
+
+	for i := 0; i < 9; i++ {
+		tui.key('j')
+	}
+	tui.monitor(files, nil)
+	for i := 0; i < 9; i++ {
+		tui.key('j')
+	}
+	out.Reset()
+	tui.monitor(files, nil)
+
+	// Only 3 rows are available for the files
+	if frame := out.String(); !strings.Contains(frame, "file9") || !strings.Contains(frame, "file7") || strings.Contains(frame, "file6") {
+		t.Error("List should scroll to the selected file", frame)
+	}
+
+	for _, key := range []byte("\033[H") {
+		tui.key(key)
+	}
+	out.Reset()
+	tui.monitor(files, nil)
+
+	if frame := out.String(); !strings.Contains(frame, "file0") || strings.Contains(frame, "file9") {
+		t.Error("Home should select the first file", frame)
+	}
+}
+
+func TestTUICompact(t *testing.T) {
+	tui, out, _ := buildTUI(80, 8)
+
+	files := make([]*File, 10)
+	for i := range files {
+		files[i] = &File{ID: uint32(i), Output: fmt.Sprintf("/tmp/file%d", i), Size: 100, Valid: true, Finished: i > 0,
+			Chunks: []Chunk{{Range: Range{Start: 0, End: 100}, Done: 100}}}
+	}
+	files[0].Chunks[0].Done = 10
+
+	tui.monitor(files, nil)
+
+	frame := out.String()
+	if !strings.Contains(frame, "file0") || strings.Contains(frame, "file1") || !strings.Contains(frame, "9 finished files") {
+		t.Error("Finished files should be collapsed", frame)
+	}
+
+	if !strings.Contains(frame, "1 running, 0 paused, 0 waiting, 9 done, 0 errors") {
+		t.Error("Header should aggregate the files", frame)
+	}
+}
+
+func TestTUIStop(t *testing.T) {
+	tui, out, _ := buildTUI(80, 24)
+	tui.stop(testFiles())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "0 done, 1 errors, 1 cancelled, 2 unfinished") {
+		t.Fatal("Final status should only list the totals and the files not downloaded", lines)
+	}
+	if !strings.Contains(lines[1], "third.bin: REMOVED") || !strings.Contains(lines[2], "fourth.bin: ERROR: Too many retries") {
+		t.Error("Files in error or cancelled should be listed", lines)
+	}
+}
+
+func BenchmarkTUIMonitor(b *testing.B) {
+	for _, changed := range []int{0, 100, 5000} {
+		b.Run(fmt.Sprintf("changed-%d", changed), func(b *testing.B) {
+			files := buildMonitoredFiles(5000)
+			tui, out, _ := buildTUI(160, 50)
+			tui.monitor(files, nil)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, f := range files[:changed] {
+					f.advance(&f.Chunks[i%8], 1)
+				}
+				out.Reset()
+				tui.monitor(files, nil)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package goxel
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -9,13 +10,113 @@ import (
 	"strings"
 )
 
-// URLPreprocessor defines the interface for the URL processors
-// New processors can easily be added to transform input URLs for example
+// URLPreprocessor defines the interface for the builtin URL processors
+// External packages implement Preprocessor instead.
 type URLPreprocessor interface {
 	process(urls []string) []string
 }
 
+// Download describes a file to download as built by the preprocessors
+type Download struct {
+	URL string
+	// Name is the output path relative to the output directory, the file is named after the URL when empty
+	Name string
+	// Size is the size announced for the file, the file is in error when it differs; 0 when unknown
+	Size uint64
+	// Headers are sent with the requests of the file in addition to the global headers
+	Headers map[string]string
+	// Checksum is the expected digest of the file as "<algorithm>:<hex digest>", algorithm being md5, sha1, sha256 or sha512
+	Checksum string
+	// Resolve is called when the file starts, the download it returns replaces this one except for its empty fields
+	// The URL is only displayed until then, so generated links don't expire while the file waits.
+	Resolve func(ctx context.Context) (Download, error)
+	// Err marks the download in error instead of downloading it
+	Err error
+}
+
+// Preprocessor transforms the downloads before they start, it is called after the builtin preprocessors
+// The downloads can be rewritten, described, removed or added. An error aborts the run, the errors
+// of a single download are reported with its Err field.
+type Preprocessor interface {
+	Preprocess(ctx context.Context, downloads []Download) ([]Download, error)
+}
+
+// PreprocessorFunc is a function used as Preprocessor
+type PreprocessorFunc func(ctx context.Context, downloads []Download) ([]Download, error)
+
+// Preprocess calls the function
+func (f PreprocessorFunc) Preprocess(ctx context.Context, downloads []Download) ([]Download, error) {
+	return f(ctx, downloads)
+}
+
+// urlResolver is implemented by the preprocessors resolving URLs when their file starts
+// resolver returns nil when the URL is not resolved by the preprocessor.
+type urlResolver interface {
+	resolver(url string) func(ctx context.Context) (string, error)
+}
+
+// urlDescriber is implemented by the preprocessors knowing the files behind URLs
+// describe returns the output path relative to the output directory, an empty string to use
+// the URL, and the size of the file, 0 when it is unknown.
+type urlDescriber interface {
+	describe(url string) (string, uint64)
+}
+
+// newDownload builds the download of a URL returned by the builtin preprocessors
+// The first preprocessor resolving the URL also describes the resolved URL.
+func newDownload(preprocessors []URLPreprocessor, url string) Download {
+	download := Download{URL: url}
+	for _, up := range preprocessors {
+		if r, ok := up.(urlResolver); ok && download.Resolve == nil {
+			if resolve := r.resolver(url); resolve != nil {
+				describer, _ := up.(urlDescriber)
+				download.Resolve = func(ctx context.Context) (Download, error) {
+					resolved, err := resolve(ctx)
+					if err != nil {
+						return Download{}, err
+					}
+
+					d := Download{URL: resolved}
+					if describer != nil {
+						d.Name, d.Size = describer.describe(resolved)
+					}
+					return d, nil
+				}
+			}
+		}
+		if d, ok := up.(urlDescriber); ok && download.Name == "" {
+			download.Name, download.Size = d.describe(url)
+		}
+		if d, ok := up.(downloadDescriber); ok {
+			if described, ok := d.download(url); ok {
+				if download.Name == "" {
+					download.Name, download.Size = described.Name, described.Size
+				}
+				for name, value := range described.Headers {
+					if download.Headers == nil {
+						download.Headers = make(map[string]string)
+					}
+					if _, ok := download.Headers[name]; !ok {
+						download.Headers[name] = value
+					}
+				}
+				if download.Checksum == "" {
+					download.Checksum = described.Checksum
+				}
+			}
+		}
+	}
+	return download
+}
+
+// downloadDescriber is implemented by the preprocessors returning rich downloads for URLs
+// download returns false when the URL is not described by the preprocessor.
+type downloadDescriber interface {
+	download(url string) (Download, bool)
+}
+
 // StandardURLPreprocessor ensures the URL is correct and trims it
+// Magnets and torrent files are kept for the AllDebrid preprocessor.
 type StandardURLPreprocessor struct{}
 
 func (s *StandardURLPreprocessor) process(urls []string) []string {
@@ -28,6 +129,11 @@ func (s *StandardURLPreprocessor) process(urls []string) []string {
 			continue
 		}
 
+		if isTorrent(nURL) {
+			output = append(output, nURL)
+			continue
+		}
+
 		if !re.Match([]byte(nURL)) {
 			cMessages <- NewInfoMessage("URLS", fmt.Sprintf("Removing non URL line [%s].", nURL))
 			continue
@@ -38,6 +144,23 @@ func (s *StandardURLPreprocessor) process(urls []string) []string {
 	return output
 }
 
+var linkPassword = regexp.MustCompile(`^\s*(\S+)\s+password=(.*?)\s*$`)
+
+// parseLinkPasswords removes the passwords following the URLs, as in "http://host/folder password=secret"
+// It returns the URLs and the passwords of the protected URLs.
+func parseLinkPasswords(lines []string) ([]string, map[string]string) {
+	urls := make([]string, 0, len(lines))
+	passwords := make(map[string]string)
+	for _, line := range lines {
+		if match := linkPassword.FindStringSubmatch(line); match != nil {
+			line = match[1]
+			passwords[line] = match[2]
+		}
+		urls = append(urls, line)
+	}
+	return urls, passwords
+}
+
 // BuildURLSlice builds the initial URLs list containing URLs from command line and input file
 func BuildURLSlice(urls []string, inputFile string) []string {
 	if inputFile != "" {
@@ -17,6 +17,26 @@ func TestUrl(t *testing.T) {
 	}
 }
 
+func TestTorrentUrl(t *testing.T) {
+	p := StandardURLPreprocessor{}
+
+	urls := p.process([]string{"magnet:?xt=urn:btih:show", " /tmp/movie.torrent\n", "movie.mkv"})
+	if len(urls) != 2 || urls[0] != "magnet:?xt=urn:btih:show" || urls[1] != "/tmp/movie.torrent" {
+		t.Error("Magnets and torrent files should be kept", urls)
+	}
+}
+
+func TestLinkPasswords(t *testing.T) {
+	urls, passwords := parseLinkPasswords([]string{"http://test.fr/folder password=my secret \r", "http://test.fr/test.mp4", " http://test.fr/other\tpassword=pass"})
+	if len(urls) != 3 || urls[0] != "http://test.fr/folder" || urls[1] != "http://test.fr/test.mp4" || urls[2] != "http://test.fr/other" {
+		t.Error("Passwords should be removed from the URLs", urls)
+	}
+
+	if len(passwords) != 2 || passwords["http://test.fr/folder"] != "my secret" || passwords["http://test.fr/other"] != "pass" {
+		t.Error("Passwords should be associated with their URL", passwords)
+	}
+}
+
 func TestURLSlice(t *testing.T) {
 	dir, err := ioutil.TempDir("", "goxel-test")
 	if err != nil {
@@ -1,17 +1,19 @@
 package goxel
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
-	"regexp"
-	"strings"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
-	"golang.org/x/net/proxy"
+	"golang.org/x/net/http2"
 )
 
 type winsize struct {
@@ -21,17 +23,21 @@ type winsize struct {
 	Ypixel uint16
 }
 
-func getWidth() uint {
-	ws := &winsize{}
-	retCode, _, _ := syscall.Syscall(syscall.SYS_IOCTL,
-		uintptr(syscall.Stdin),
-		uintptr(syscall.TIOCGWINSZ),
-		uintptr(unsafe.Pointer(ws)))
-
-	if int(retCode) == -1 {
-		return uint(100)
+// terminalSize returns the number of columns and rows of the terminal
+// Stdout is queried first as stdin can be redirected, a 100x25 terminal is assumed when none is available.
+func terminalSize() (int, int) {
+	for _, fd := range []int{syscall.Stdout, syscall.Stdin} {
+		ws := &winsize{}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+			uintptr(fd),
+			uintptr(syscall.TIOCGWINSZ),
+			uintptr(unsafe.Pointer(ws)))
+
+		if errno == 0 && ws.Col > 0 && ws.Row > 0 {
+			return int(ws.Col), int(ws.Row)
+		}
 	}
-	return uint(ws.Col)
+	return 100, 25
 }
 
 func fmtDuration(d uint64) string {
@@ -45,6 +51,8 @@ func fmtDuration(d uint64) string {
 	return fmt.Sprintf("%02d:%02d:%02d", h, m, s)
 }
 
+const keepAlive = 30 * time.Second
+
 // headerFlag is used to parse headers on the CLI
 // It allows multiple elements to be passed
 type headerFlag []string
@@ -62,64 +70,169 @@ func (h *headerFlag) Type() string {
 	return "header-name=header-value"
 }
 
-// counter allows for an atomic counter
-type counter struct {
-	v   int
-	mux sync.Mutex
-}
+// sessionTransport is shared by all the clients of a session so connections can be reused
+var sessionTransport http.RoundTripper
+var sessionTransportMux sync.Mutex
+
+// NewClient returns a HTTP client with the requested configuration
+// All clients share the session transport which supports HTTP and SOCKS proxies and per host TLS options
+func NewClient() (*http.Client, error) {
+	sessionTransportMux.Lock()
+	defer sessionTransportMux.Unlock()
 
-func (c *counter) inc() {
-	c.mux.Lock()
-	c.v++
-	c.mux.Unlock()
+	if sessionTransport == nil {
+		transport, err := buildTransport()
+		if err != nil {
+			return &http.Client{}, err
+		}
+		sessionTransport = transport
+	}
+
+	return &http.Client{Transport: sessionTransport}, nil
 }
 
-func (c *counter) dec() {
-	c.mux.Lock()
-	c.v--
-	c.mux.Unlock()
+// resetTransport closes the idle connections of the session transport
+// A new transport will be built on the next call to NewClient
+func resetTransport() {
+	sessionTransportMux.Lock()
+	defer sessionTransportMux.Unlock()
+
+	if closer, ok := sessionTransport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+	sessionTransport = nil
 }
 
-// NewClient returns a HTTP client with the requested configuration
-// It supports HTTP and SOCKS proxies
-func NewClient() (*http.Client, error) {
-	client := &http.Client{}
-
-	if goxel.Proxy != "" {
-		re := regexp.MustCompile(`^(http|https|socks5)://`)
-		protocol := re.Find([]byte(goxel.Proxy))
-
-		if protocol != nil {
-			var transport *http.Transport
-
-			if string(protocol) == "http://" || string(protocol) == "https://" {
-				pURL, err := url.Parse(goxel.Proxy)
-				if err != nil {
-					return client, errors.New("Invalid proxy URL")
-				}
-
-				transport = &http.Transport{
-					Proxy: http.ProxyURL(pURL),
-				}
-			} else if string(protocol) == "socks5://" {
-				dialer, _ := proxy.SOCKS5("tcp", strings.Replace(goxel.Proxy, "socks5://", "", 1), nil, proxy.Direct)
-				transport = &http.Transport{
-					Dial: dialer.Dial,
-				}
-			} else {
-				return client, errors.New("Invalid proxy protocol")
+// buildTransport builds the session transport
+// A dedicated transport is built for each combination of TLS profile and proxy.
+func buildTransport() (http.RoundTripper, error) {
+	proxies, err := buildProxyConfig(goxel)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &routeTransport{
+		profiles:   buildTLSProfiles(goxel),
+		proxies:    proxies,
+		transports: make(map[route]*http.Transport),
+	}
+
+	hosts := []string{""}
+	for host := range r.profiles {
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	for _, host := range hosts {
+		for _, pURL := range append(proxies.urls(), nil) {
+			transport, err := newTransport(r.profiles[host], pURL)
+			if err != nil {
+				return nil, err
 			}
 
-			if transport != nil {
-				client = &http.Client{
-					Transport: transport,
-				}
+			key := route{host: host}
+			if pURL != nil {
+				key.proxy = pURL.String()
 			}
-		} else {
-			return client, errors.New("Invalid proxy URL")
+			r.transports[key] = transport
 		}
+	}
 
+	return r, nil
+}
+
+// newTransport builds a transport using the connection settings, the TLS profile and the proxy
+func newTransport(profile *tlsProfile, pURL *url.URL) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   goxel.ConnectTimeout,
+		KeepAlive: keepAlive,
 	}
 
-	return client, nil
+	// Each worker keeps its connection alive between two chunks, the idle pool
+	// must be large enough to keep all of them
+	idle := int(math.Max(float64(goxel.MaxConnections), http.DefaultMaxIdleConnsPerHost))
+
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          int(math.Max(float64(idle), 100)),
+		MaxIdleConnsPerHost:   idle,
+		MaxConnsPerHost:       goxel.MaxConnectionsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   goxel.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: goxel.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if profile != nil {
+		config, err := profile.config(goxel.IgnoreSSLVerification)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = config
+	}
+
+	// HTTP/2 multiplexes all the requests to a host over a single connection
+	// which defeats the purpose of using multiple connections
+	// It is configured once the TLS settings are known, a custom dialer disables it otherwise.
+	if !goxel.AllowHTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	} else if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, err
+	}
+
+	if pURL == nil {
+		return transport, nil
+	}
+
+	switch pURL.Scheme {
+	case "http", "https":
+		// Credentials of the proxy URL are sent in the Proxy-Authorization header
+		transport.Proxy = http.ProxyURL(pURL)
+	case "socks5", "socks5h":
+		dial, err := socksDialContext(pURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+		transport.DialContext = dial
+	default:
+		return nil, errors.New("Invalid proxy protocol")
+	}
+
+	return transport, nil
+}
+
+// route identifies the transport to use for a request
+// The host is only set when TLS options were configured for it, the proxy is empty for direct connections.
+type route struct {
+	host, proxy string
+}
+
+// routeTransport routes requests to the transport matching their TLS options and proxy
+type routeTransport struct {
+	profiles   map[string]*tlsProfile
+	proxies    *proxyConfig
+	transports map[route]*http.Transport
+}
+
+func (r *routeTransport) route(u *url.URL) route {
+	var key route
+	if _, ok := r.profiles[u.Hostname()]; ok {
+		key.host = u.Hostname()
+	}
+	if pURL := r.proxies.proxyFor(u); pURL != nil {
+		key.proxy = pURL.String()
+	}
+	return key
+}
+
+func (r *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r.transports[r.route(req.URL)].RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of all the transports
+func (r *routeTransport) CloseIdleConnections() {
+	for _, transport := range r.transports {
+		transport.CloseIdleConnections()
+	}
 }
@@ -2,18 +2,27 @@ package goxel
 
 import (
 	"net/http"
+	"net/url"
 	"testing"
+	"time"
 )
 
+func transportFor(client *http.Client, rawurl string) *http.Transport {
+	r := client.Transport.(*routeTransport)
+	u, _ := url.Parse(rawurl)
+	return r.transports[r.route(u)]
+}
+
 func TestHTTP(t *testing.T) {
 	goxel.Proxy = "http://127.0.0.1:8123"
+	resetTransport()
 	client, err := NewClient()
 
 	if err != nil {
 		t.Error("Error while creating http proxy", err)
 	}
 
-	tr := client.Transport.(*http.Transport)
+	tr := transportFor(client, "http://test.fr/video.mp4")
 	if tr.Proxy == nil {
 		t.Error("Error while creating http proxy, proxy is nil")
 	}
@@ -21,6 +30,7 @@ func TestHTTP(t *testing.T) {
 
 func TestHttpError(t *testing.T) {
 	goxel.Proxy = "http://" + string([]byte{0x7f, 0x7f}) + ":1234"
+	resetTransport()
 	_, err := NewClient()
 
 	if err == nil {
@@ -30,13 +40,14 @@ func TestHttpError(t *testing.T) {
 
 func TestHTTPS(t *testing.T) {
 	goxel.Proxy = "https://127.0.0.1:8123"
+	resetTransport()
 	client, err := NewClient()
 
 	if err != nil {
 		t.Error("Error while creating https proxy", err)
 	}
 
-	tr := client.Transport.(*http.Transport)
+	tr := transportFor(client, "https://test.fr/video.mp4")
 	if tr.Proxy == nil {
 		t.Error("Error while creating https proxy, proxy is nil")
 	}
@@ -44,6 +55,7 @@ func TestHTTPS(t *testing.T) {
 
 func TestHttpsError(t *testing.T) {
 	goxel.Proxy = "https://" + string([]byte{0x7f, 0x7f}) + ":1234"
+	resetTransport()
 	_, err := NewClient()
 
 	if err == nil {
@@ -53,23 +65,90 @@ func TestHttpsError(t *testing.T) {
 
 func TestSocks5(t *testing.T) {
 	goxel.Proxy = "socks5://127.0.0.1:8123"
+	resetTransport()
 	client, err := NewClient()
 
 	if err != nil {
 		t.Error("Error while creating socks proxy", err)
 	}
 
-	tr := client.Transport.(*http.Transport)
-	if tr.Dial == nil {
-		t.Error("Error while creating socks proxy, Dial is nil")
+	tr := transportFor(client, "http://test.fr/video.mp4")
+	if tr.Proxy != nil || tr.DialContext == nil {
+		t.Error("Error while creating socks proxy, DialContext is nil")
 	}
 }
 
 func TestBadProtocol(t *testing.T) {
 	goxel.Proxy = "ftp://127.0.0.1:8123"
+	resetTransport()
 	_, err := NewClient()
 
 	if err == nil {
 		t.Error("Error, shoud fail")
 	}
 }
+
+func TestSharedTransport(t *testing.T) {
+	goxel = &GoXel{MaxConnections: 16}
+	resetTransport()
+
+	c1, _ := NewClient()
+	c2, _ := NewClient()
+	if c1.Transport != c2.Transport {
+		t.Error("Clients should share the same transport")
+	}
+
+	tr := transportFor(c1, "http://test.fr/video.mp4")
+	if tr.MaxIdleConnsPerHost != 16 {
+		t.Error("Idle pool should be able to keep all connections", tr.MaxIdleConnsPerHost)
+	}
+
+	resetTransport()
+	c3, _ := NewClient()
+	if c3.Transport == c1.Transport {
+		t.Error("A new transport should be built after a reset")
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	goxel = &GoXel{}
+	resetTransport()
+
+	client, _ := NewClient()
+	tr := transportFor(client, "https://test.fr/video.mp4")
+	if tr.TLSNextProto == nil || tr.TLSNextProto["h2"] != nil {
+		t.Error("HTTP/2 should be disabled by default")
+	}
+
+	goxel = &GoXel{AllowHTTP2: true}
+	resetTransport()
+
+	client, _ = NewClient()
+	tr = transportFor(client, "https://test.fr/video.mp4")
+	if tr.TLSNextProto["h2"] == nil {
+		t.Error("HTTP/2 should be allowed")
+	}
+}
+
+func TestInsecureWithProxy(t *testing.T) {
+	goxel = &GoXel{
+		Proxy:                 "http://127.0.0.1:8123",
+		IgnoreSSLVerification: true,
+		TLSHandshakeTimeout:   5 * time.Second,
+	}
+	resetTransport()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Error("Error while creating http proxy", err)
+	}
+
+	tr := transportFor(client, "https://test.fr/video.mp4")
+	if tr.TLSClientConfig == nil || !tr.TLSClientConfig.InsecureSkipVerify {
+		t.Error("SSL validation should be bypassed when using a proxy")
+	}
+
+	if tr.TLSHandshakeTimeout != 5*time.Second {
+		t.Error("Timeouts should be applied when using a proxy")
+	}
+}
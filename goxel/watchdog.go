@@ -0,0 +1,215 @@
+package goxel
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// speedSample is the number of bytes received by a connection at a given time
+type speedSample struct {
+	at    time.Time
+	total uint64
+}
+
+// speedWindow measures the speed of a connection over a sliding window
+type speedWindow struct {
+	window  time.Duration
+	start   time.Time
+	total   uint64
+	samples []speedSample
+}
+
+func newSpeedWindow(window time.Duration, now time.Time) *speedWindow {
+	return &speedWindow{
+		window:  window,
+		start:   now,
+		samples: []speedSample{{at: now}},
+	}
+}
+
+// add records n bytes received at now
+func (w *speedWindow) add(now time.Time, n uint64) {
+	w.total += n
+	w.samples = append(w.samples, speedSample{at: now, total: w.total})
+
+	// The first sample is kept at the beginning of the window, the samples are
+	// moved in place so the slice doesn't grow
+	var expired int
+	for expired < len(w.samples)-1 && !w.samples[expired+1].at.After(now.Add(-w.window)) {
+		expired++
+	}
+	if expired > 0 {
+		n := copy(w.samples, w.samples[expired:])
+		w.samples = w.samples[:n]
+	}
+}
+
+// speed returns the number of bytes per second over the window
+// ok is false until the connection has been observed for a whole window.
+func (w *speedWindow) speed(now time.Time) (speed float64, ok bool) {
+	if now.Sub(w.start) < w.window {
+		return 0, false
+	}
+
+	first := w.samples[0]
+	elapsed := now.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return float64(w.total-first.total) / elapsed, true
+}
+
+// rate returns the number of bytes per second over the samples received so far
+// Unlike speed, it doesn't wait for a whole window to be observed.
+func (w *speedWindow) rate(now time.Time) float64 {
+	first := w.samples[0]
+	elapsed := now.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(w.total-first.total) / elapsed
+}
+
+// connectionWatch aborts a connection which doesn't receive data for the idle timeout
+// or whose speed stays below the lowest speed limit over the whole window
+type connectionWatch struct {
+	idle    *time.Timer
+	timeout time.Duration
+	limit   uint64
+	speed   *speedWindow
+	cancel  context.CancelFunc
+}
+
+// watchConnection starts watching a connection, the zero values disable the checks
+func watchConnection(cancel context.CancelFunc, timeout time.Duration, limit uint64, window time.Duration) *connectionWatch {
+	w := &connectionWatch{
+		timeout: timeout,
+		limit:   limit,
+		cancel:  cancel,
+	}
+
+	if timeout > 0 {
+		w.idle = time.AfterFunc(timeout, cancel)
+	}
+
+	if limit > 0 && window > 0 {
+		w.speed = newSpeedWindow(window, time.Now())
+	}
+	return w
+}
+
+// received records n bytes received by the connection
+// It returns false and aborts the connection when it is too slow.
+func (w *connectionWatch) received(n int) bool {
+	if w.idle != nil {
+		w.idle.Reset(w.timeout)
+	}
+
+	if w.speed == nil {
+		return true
+	}
+
+	now := time.Now()
+	w.speed.add(now, uint64(n))
+	if speed, ok := w.speed.speed(now); ok && speed < float64(w.limit) {
+		w.cancel()
+		return false
+	}
+	return true
+}
+
+// stop releases the idle timer
+func (w *connectionWatch) stop() {
+	if w.idle != nil {
+		w.idle.Stop()
+	}
+}
+
+// Watchdog aborts the session when the files don't progress for the stall timeout
+// The unfinished files are marked in error and the abort function cancels the running requests.
+// It returns true when the session was aborted, false once the complete channel is closed.
+func Watchdog(files []*File, timeout time.Duration, complete chan bool, abort context.CancelFunc) bool {
+	if timeout <= 0 {
+		return false
+	}
+
+	interval := timeout / 10
+	if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := downloaded(files)
+	lastProgress := time.Now()
+	for {
+		select {
+		case <-complete:
+			return false
+
+		case now := <-ticker.C:
+			// Paused files are not expected to progress
+			if current := downloaded(files); current != last || !running(files) {
+				last = current
+				lastProgress = now
+				continue
+			}
+
+			if now.Sub(lastProgress) < timeout {
+				continue
+			}
+
+			for _, f := range files {
+				if !f.isFinished() && f.failure() == "" {
+					f.setError(fmt.Sprintf("Stalled: no data received for %v", timeout))
+				}
+			}
+			abort()
+			return true
+		}
+	}
+}
+
+// running checks if at least one file is being probed or downloaded
+// The files waiting for the answer of their server are running, a server which never answers stalls the session.
+func running(files []*File) bool {
+	for _, f := range files {
+		if !f.isFinished() && f.failure() == "" && !f.IsPaused() {
+			return true
+		}
+	}
+	return false
+}
+
+// downloaded returns the number of bytes downloaded for all the files
+func downloaded(files []*File) (done uint64) {
+	for _, f := range files {
+		for _, chunk := range f.snapshot() {
+			done += chunk.Done
+		}
+	}
+	return done
+}
+
+// stallReport describes the state of the files once the session was aborted
+func stallReport(files []*File, timeout time.Duration) []string {
+	report := []string{fmt.Sprintf("[ERROR] No data received for %v, the download was aborted", timeout)}
+	for _, f := range files {
+		if f.isFinished() {
+			continue
+		}
+
+		// The files which were not probed don't have a size
+		if !f.isValid() {
+			report = append(report, fmt.Sprintf("[ERROR] %v: %v", path.Base(f.Output), f.failure()))
+			continue
+		}
+
+		report = append(report, fmt.Sprintf("[ERROR] %v: %s of %s downloaded", path.Base(f.Output), humanize.Bytes(downloaded([]*File{f})), humanize.Bytes(f.Size)))
+	}
+	return report
+}
@@ -0,0 +1,196 @@
+package goxel
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpeedWindow(t *testing.T) {
+	now := time.Now()
+	w := newSpeedWindow(10*time.Second, now)
+
+	w.add(now.Add(5*time.Second), 1000)
+	if _, ok := w.speed(now.Add(5 * time.Second)); ok {
+		t.Error("Speed should not be measured before a whole window")
+	}
+
+	for i := 6; i <= 20; i++ {
+		w.add(now.Add(time.Duration(i)*time.Second), 100)
+	}
+
+	// Only the last 10 seconds are measured
+	if speed, ok := w.speed(now.Add(20 * time.Second)); !ok || speed != 100 {
+		t.Error("Speed should be measured over the window, got", speed)
+	}
+}
+
+// startStallingServer sends the first bytes of the range then sends the next ones every delay
+func startStallingServer(delay time.Duration) (*httptest.Server, chan bool) {
+	stop := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-9999/10000")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(make([]byte, 1000))
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-r.Context().Done():
+				return
+			case <-time.After(delay):
+				w.Write([]byte{0})
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	return ts, stop
+}
+
+func testAbortedConnection(t *testing.T, delay time.Duration) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts, stop := startStallingServer(delay)
+	defer ts.Close()
+	defer close(stop)
+
+	file := File{
+		URL:    ts.URL,
+		Output: path.Join(dir, "content"),
+		Size:   10000,
+		Chunks: []Chunk{{Range: Range{Start: 0, End: 10000}}},
+	}
+	if err := file.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+
+	resetTransport()
+	defer resetTransport()
+	client, _ := NewClient()
+
+	start := time.Now()
+	handleChunkDownload(context.Background(), &download{Chunk: &file.Chunks[0], File: &file, InputURL: file.URL}, 0, client, 1)
+
+	if time.Since(start) > 5*time.Second {
+		t.Error("Connection should have been aborted")
+	}
+
+	if done := file.Chunks[0].Done; done < 1000 || done == 10000 {
+		t.Error("Received bytes should be kept, got", done)
+	}
+
+	if !file.retry(&file.Chunks[0], 0) {
+		t.Error("Aborted chunk should be retried")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	goxel = &GoXel{ReadTimeout: 200 * time.Millisecond}
+	defer func() { goxel = &GoXel{} }()
+
+	testAbortedConnection(t, time.Hour)
+}
+
+func TestLowestSpeedLimit(t *testing.T) {
+	goxel = &GoXel{LowestSpeedLimit: 1024 * 1024, LowestSpeedWindow: 300 * time.Millisecond}
+	defer func() { goxel = &GoXel{} }()
+
+	defer func(messages chan Message) { cMessages = messages }(cMessages)
+	cMessages = make(chan Message, 100)
+
+	testAbortedConnection(t, 10*time.Millisecond)
+
+	var reported bool
+	for len(cMessages) > 0 {
+		if m := <-cMessages; strings.Contains(m.Content, "Connection slower than") {
+			reported = true
+		}
+	}
+	if !reported {
+		t.Error("Aborted connection should be reported as a message of the file")
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	files := []*File{
+		{Size: 100, Valid: true, Chunks: []Chunk{{Range: Range{Start: 0, End: 100}, Done: 50}}},
+		{Size: 100, Valid: true, Finished: true, Chunks: []Chunk{{Range: Range{Start: 0, End: 100}, Done: 100}}},
+	}
+
+	ctx, abort := context.WithCancel(context.Background())
+	if !Watchdog(files, 200*time.Millisecond, make(chan bool), abort) {
+		t.Error("Stalled session should be aborted")
+	}
+
+	if ctx.Err() == nil {
+		t.Error("Running requests should be cancelled")
+	}
+
+	if files[0].failure() == "" || files[1].failure() != "" {
+		t.Error("Only unfinished files should be in error")
+	}
+
+	if report := stallReport(files, 200*time.Millisecond); len(report) != 2 {
+		t.Error("Report should describe the unfinished file", report)
+	}
+
+	complete := make(chan bool)
+	close(complete)
+	if Watchdog(files, time.Hour, complete, abort) {
+		t.Error("Completed session should not be aborted")
+	}
+}
+
+func TestWatchdogProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The server never answers the probe of the file
+	release := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	f := &File{URL: ts.URL + "/stalled"}
+	f.setOutput(dir, true)
+
+	ctx, abort := context.WithCancel(context.Background())
+	probed := make(chan bool)
+	go func() {
+		f.probe(ctx, 2)
+		close(probed)
+	}()
+
+	if !Watchdog([]*File{f}, 200*time.Millisecond, make(chan bool), abort) {
+		t.Error("Session stalled on a probe should be aborted")
+	}
+
+	select {
+	case <-probed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stalled probe should be cancelled")
+	}
+
+	if report := stallReport([]*File{f}, 200*time.Millisecond); len(report) != 2 || !strings.Contains(report[1], "stalled: Stalled") {
+		t.Error("Report should describe the file being probed", report)
+	}
+}